@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	accessLogPath   string
+	accessLogFormat string
+)
+
+// openAccessLog returns the writer for ACCESS_LOG, or nil when disabled.
+func openAccessLog() io.Writer {
+	switch accessLogPath {
+	case "":
+		return nil
+	case "stdout", "-":
+		return os.Stdout
+	}
+	f, err := os.OpenFile(accessLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[accesslog] failed to open %s: %v", accessLogPath, err)
+		return nil
+	}
+	return f
+}
+
+// accessLogger writes one line per request in Common or Combined Log Format
+// so goaccess/awstats can read it without a custom parser.
+func accessLogger(w io.Writer, combined bool) gin.HandlerFunc {
+	var mu sync.Mutex
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		size := "-"
+		if n := c.Writer.Size(); n > 0 {
+			size = strconv.Itoa(n)
+		}
+
+		line := fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s`,
+			c.ClientIP(),
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			c.Request.Method,
+			c.Request.RequestURI,
+			c.Request.Proto,
+			c.Writer.Status(),
+			size,
+		)
+		if combined {
+			line += fmt.Sprintf(` "%s" "%s"`, orDash(c.Request.Referer()), orDash(c.Request.UserAgent()))
+		}
+
+		mu.Lock()
+		io.WriteString(w, line+"\n")
+		mu.Unlock()
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userAssets returns every indexed asset of a user, banner slots included,
+// in key order.
+func userAssets(username string) []AssetMeta {
+	var metas []AssetMeta
+	indexMutex.RLock()
+	for _, meta := range assetIndex {
+		if user, _ := splitBannerKey(meta.Username); user == username {
+			metas = append(metas, meta)
+		}
+	}
+	indexMutex.RUnlock()
+	slices.SortFunc(metas, func(a, b AssetMeta) int {
+		return strings.Compare(assetKey(a.Kind, a.Username), assetKey(b.Kind, b.Username))
+	})
+	return metas
+}
+
+// exportUserHandler streams a zip of everything stored about a user: the
+// asset files and avatar history, their metadata and alt text, banner
+// rotation and the audit entries, for data-subject access requests.
+func exportUserHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+	metas := userAssets(username)
+	versions := avatarVersions(username)
+	audit, err := readAuditEntries(username, int(^uint(0)>>1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading audit log"})
+		return
+	}
+	if len(metas) == 0 && len(versions) == 0 && len(audit) == 0 && bannerRotation(username) == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No data stored for this user"})
+		return
+	}
+
+	assets := make([]gin.H, 0, len(metas))
+	for _, meta := range metas {
+		assets = append(assets, gin.H{
+			"kind":       meta.Kind,
+			"key":        meta.Username,
+			"file":       exportFileName(meta),
+			"format":     meta.Format,
+			"width":      meta.Width,
+			"height":     meta.Height,
+			"size":       meta.Size,
+			"hash":       meta.Hash,
+			"animated":   meta.Animated,
+			"updated_at": meta.UpdatedAt,
+			"overlay":    meta.Overlay,
+			"focus":      meta.Focus,
+			"safe_area":  meta.SafeArea,
+			"alt":        getAltText(meta.Kind, meta.Username),
+		})
+	}
+	metadata, err := json.MarshalIndent(gin.H{
+		"username": username,
+		"assets":   assets,
+		"history":  versions,
+		"rotation": bannerRotation(username),
+	}, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encoding metadata"})
+		return
+	}
+	auditJSON, err := json.MarshalIndent(audit, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encoding audit log"})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-export.zip"`, username))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	defer zw.Close()
+	for name, data := range map[string][]byte{"metadata.json": metadata, "audit.json": auditJSON} {
+		w, err := zw.Create(name)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			log.Printf("[accounts] export of %s failed writing %s: %v", username, name, err)
+			return
+		}
+	}
+	for _, meta := range metas {
+		if err := addFileToZip(zw, exportFileName(meta), meta.Path); err != nil {
+			log.Printf("[accounts] export of %s failed adding %s: %v", username, meta.Path, err)
+			return
+		}
+	}
+	for _, v := range versions {
+		name := filepath.Join("assets", "history", filepath.Base(v.path))
+		if err := addFileToZip(zw, name, v.path); err != nil {
+			log.Printf("[accounts] export of %s failed adding %s: %v", username, v.path, err)
+			return
+		}
+	}
+}
+
+func exportFileName(meta AssetMeta) string {
+	return filepath.Join("assets", meta.Kind, meta.Username+filepath.Ext(meta.Path))
+}
+
+func addFileToZip(zw *zip.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := zw.Create(filepath.ToSlash(name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// eraseUserHandler deletes everything stored about a user: asset files,
+// presets and previous avatars, index, alias and alt text entries, banner
+// rotation, audit history and cached variants. Peers and the dual-write
+// store are told too; the replication loop picks the deletions up on its
+// own. readOnlyGuard refuses it in maintenance mode.
+func eraseUserHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+	metas := userAssets(username)
+
+	failed := 0
+	for _, meta := range metas {
+		if err := os.Remove(meta.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("[accounts] failed to erase %s: %v", meta.Path, err)
+			failed++
+			continue
+		}
+		unindexAsset(meta.Kind, meta.Username)
+		removeDeletedAsset(meta.Kind, meta.Username)
+	}
+	deleteAvatars(username)
+	if err := removeStateDir(historyDir(username)); err != nil {
+		log.Printf("[accounts] failed to erase avatar history of %s: %v", username, err)
+		failed++
+	}
+	deleteBanners(username)
+	// the user layout's directory, once everything in it is gone
+	os.Remove(userDir(username))
+
+	rotationMutex.Lock()
+	_, rotated := bannerRotations[username]
+	delete(bannerRotations, username)
+	rotationMutex.Unlock()
+	if rotated {
+		saveBannerRotations()
+	}
+
+	moveAliases(username, "")
+	avatarCache.forgetHot(username)
+	bannerCache.forgetHot(username)
+
+	removed, err := removeAuditEntries(username)
+	if err != nil {
+		log.Printf("[accounts] failed to remove audit entries for %s: %v", username, err)
+		failed++
+	}
+
+	avatarCache.Invalidate(username)
+	bannerCache.Invalidate(username)
+
+	if failed > 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Some data could not be erased", "failed": failed})
+		return
+	}
+	log.Printf("[accounts] erased %d assets and %d audit entries", len(metas), removed)
+	c.JSON(http.StatusOK, gin.H{"status": "Success", "assets": len(metas), "audit_entries": removed})
+}
+
+// renameUserHandler moves every asset of a user, banner slots included, to
+// a new username along with presets, previous avatars, alt text, overlays,
+// banner rotation and audit history. With redirect=true the old name is
+// left as a redirecting alias. readOnlyGuard refuses it in maintenance mode.
+func renameUserHandler(c *gin.Context) {
+	from := strings.ToLower(strings.TrimSpace(c.Query("from")))
+	to := strings.ToLower(strings.TrimSpace(c.Query("to")))
+	if from == "" || to == "" || from == to {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be two different usernames"})
+		return
+	}
+	if !validUsername(to) || strings.Contains(to, "@") || strings.HasPrefix(to, ".") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target username"})
+		return
+	}
+	metas := userAssets(from)
+	if len(metas) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User has no stored assets"})
+		return
+	}
+	if len(userAssets(to)) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Target username already has assets"})
+		return
+	}
+
+	moved := 0
+	var notify [][2]string
+	for _, meta := range metas {
+		_, slot := splitBannerKey(meta.Username)
+		key := to
+		if meta.Kind == "banner" {
+			key = bannerKey(to, slot)
+		}
+		if err := moveAsset(meta, key); err != nil {
+			log.Printf("[accounts] failed to move %s to %s: %v", meta.Path, key, err)
+			continue
+		}
+		notify = append(notify, [2]string{meta.Kind, meta.Username}, [2]string{meta.Kind, key})
+		moved++
+	}
+	if _, err := os.Stat(historyDir(from)); err == nil {
+		if err := moveStateDir(historyDir(from), historyDir(to)); err != nil {
+			log.Printf("[accounts] failed to move avatar history of %s: %v", from, err)
+		}
+	}
+	for _, size := range presetSizes {
+		for _, ext := range []string{".gif", ".jpg"} {
+			os.Rename(presetPath(from, size, ext), presetPath(to, size, ext))
+		}
+	}
+
+	rotationMutex.Lock()
+	rot, rotated := bannerRotations[from]
+	if rotated {
+		delete(bannerRotations, from)
+		bannerRotations[to] = rot
+	}
+	rotationMutex.Unlock()
+	if rotated {
+		saveBannerRotations()
+	}
+
+	audit, err := rewriteAuditLog(func(entry *AuditEntry) (bool, bool) {
+		if entry.Username != from {
+			return true, false
+		}
+		entry.Username = to
+		return true, true
+	})
+	if err != nil {
+		log.Printf("[accounts] failed to rename audit entries for %s: %v", from, err)
+	}
+
+	moveAliases(from, to)
+	avatarCache.forgetHot(from)
+	bannerCache.forgetHot(from)
+	redirect := c.Query("redirect") == "true"
+	if redirect {
+		setAlias(from, Alias{Target: to, Redirect: true})
+	}
+
+	avatarCache.Invalidate(from)
+	bannerCache.Invalidate(from)
+	// after the aliases have moved, as peers take them from the invalidation
+	for _, n := range notify {
+		notifyPeers(n[0], n[1])
+	}
+
+	if moved < len(metas) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Some assets could not be moved", "moved": moved, "failed": len(metas) - moved})
+		return
+	}
+	log.Printf("[accounts] renamed %s to %s (%d assets, %d audit entries)", from, to, moved, audit)
+	c.JSON(http.StatusOK, gin.H{"status": "Success", "from": from, "to": to, "assets": moved, "audit_entries": audit, "redirect": redirect})
+}
+
+// moveAsset stores an asset under a new key, carrying over its overlay,
+// focus and alt text, and then removes the old copy.
+func moveAsset(meta AssetMeta, key string) error {
+	data, err := os.ReadFile(meta.Path)
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(meta.Path)
+	path, err := storeAsset(meta.Kind, key, ext, data)
+	if err != nil {
+		return err
+	}
+	indexAsset(meta.Kind, key, path)
+	if meta.Overlay != "" {
+		setAssetOverlay(meta.Kind, key, meta.Overlay)
+	}
+	if meta.Focus != nil {
+		setAssetFocus(meta.Kind, key, *meta.Focus)
+	}
+	if meta.SafeArea != nil {
+		setAssetSafeArea(meta.Kind, key, meta.SafeArea)
+	}
+	if alt := getAltText(meta.Kind, meta.Username); alt != "" {
+		setAltText(meta.Kind, key, alt)
+		setAltText(meta.Kind, meta.Username, "")
+	}
+
+	if path != meta.Path {
+		os.Remove(meta.Path)
+	}
+	unindexAsset(meta.Kind, meta.Username)
+	removeBackendFormats(meta.Kind, meta.Username, "")
+	if secondaryStore != nil {
+		secondaryStore.Delete(meta.Kind, meta.Username, ext)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAssetPage = 100
+	maxAssetPage     = 1000
+)
+
+// assetFilter selects index entries for adminAssetsHandler. Zero fields
+// match everything.
+type assetFilter struct {
+	kind          string
+	format        string
+	animated      *bool
+	minSize       int64
+	maxSize       int64
+	updatedSince  time.Time
+	updatedBefore time.Time
+}
+
+func (f assetFilter) match(m AssetMeta) bool {
+	switch {
+	case f.kind != "" && m.Kind != f.kind,
+		f.format != "" && m.Format != f.format,
+		f.animated != nil && m.Animated != *f.animated,
+		f.minSize > 0 && m.Size < f.minSize,
+		f.maxSize > 0 && m.Size > f.maxSize,
+		!f.updatedSince.IsZero() && m.UpdatedAt.Before(f.updatedSince),
+		!f.updatedBefore.IsZero() && !m.UpdatedAt.Before(f.updatedBefore):
+		return false
+	}
+	return true
+}
+
+func parseAssetFilter(c *gin.Context) (assetFilter, error) {
+	f := assetFilter{
+		kind:   c.Query("kind"),
+		format: strings.TrimPrefix(strings.ToLower(c.Query("format")), "."),
+	}
+	if v, ok := c.GetQuery("animated"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("animated must be true or false")
+		}
+		f.animated = &b
+	}
+	var err error
+	if f.minSize, err = parseByteSize(c.Query("min_size")); err != nil {
+		return f, fmt.Errorf("min_size: %w", err)
+	}
+	if f.maxSize, err = parseByteSize(c.Query("max_size")); err != nil {
+		return f, fmt.Errorf("max_size: %w", err)
+	}
+	if f.updatedSince, err = parseQueryTime(c.Query("updated_since")); err != nil {
+		return f, fmt.Errorf("updated_since: %w", err)
+	}
+	if f.updatedBefore, err = parseQueryTime(c.Query("updated_before")); err != nil {
+		return f, fmt.Errorf("updated_before: %w", err)
+	}
+	return f, nil
+}
+
+// parseByteSize accepts plain byte counts or a KB/MB/GB suffix (binary
+// multiples). An empty string is zero.
+func parseByteSize(v string) (int64, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	if v == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if n, ok := strings.CutSuffix(v, unit.suffix); ok {
+			v, mult = strings.TrimSpace(n), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseQueryTime accepts RFC 3339 timestamps, dates, or unix seconds.
+func parseQueryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", v)
+}
+
+// adminAssetsHandler lists indexed assets matching the query filters,
+// ordered by index key. Pass next_cursor back as cursor for the next page.
+func adminAssetsHandler(c *gin.Context) {
+	filter, err := parseAssetFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := boundedQuery(c, "limit", defaultAssetPage, 1, maxAssetPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cursor := c.Query("cursor")
+
+	indexMutex.RLock()
+	keys := make([]string, 0, len(assetIndex))
+	for key, meta := range assetIndex {
+		if key > cursor && filter.match(meta) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	page := keys[:min(limit, len(keys))]
+	assets := make([]AssetMeta, 0, len(page))
+	for _, key := range page {
+		assets = append(assets, assetIndex[key])
+	}
+	indexMutex.RUnlock()
+
+	resp := gin.H{"assets": assets, "next_cursor": nil}
+	if len(keys) > len(page) {
+		resp["next_cursor"] = page[len(page)-1]
+	}
+	c.JSON(http.StatusOK, resp)
+}
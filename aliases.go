@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Alias points an extra username, such as a name the user had before a
+// rename or a vanity name, at a user's assets. Redirect answers with a 301
+// to the current name; otherwise the alias serves the assets directly.
+type Alias struct {
+	Target   string `json:"target"`
+	Redirect bool   `json:"redirect"`
+}
+
+// userAliases lives in the asset index and shares its lock.
+var userAliases = make(map[string]Alias)
+
+func lookupAlias(name string) (Alias, bool) {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+	alias, ok := userAliases[strings.ToLower(name)]
+	return alias, ok
+}
+
+// setAlias points name at target, or removes the alias when target is
+// empty. Aliases that pointed at name follow it to the new target, so
+// lookups never have to chase a chain.
+func setAlias(name string, alias Alias) {
+	name = strings.ToLower(name)
+	alias.Target = strings.ToLower(alias.Target)
+	indexMutex.Lock()
+	if alias.Target == "" {
+		delete(userAliases, name)
+	} else {
+		retargetAliases(name, alias.Target)
+		userAliases[name] = alias
+	}
+	indexMutex.Unlock()
+	saveAssetIndex()
+}
+
+// moveAliases points every alias of from at to instead; an empty to drops
+// them.
+func moveAliases(from, to string) {
+	indexMutex.Lock()
+	retargetAliases(strings.ToLower(from), strings.ToLower(to))
+	indexMutex.Unlock()
+	saveAssetIndex()
+}
+
+// aliasesOf returns the aliases pointing at target.
+func aliasesOf(target string) map[string]Alias {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+	aliases := make(map[string]Alias)
+	for name, alias := range userAliases {
+		if alias.Target == target {
+			aliases[name] = alias
+		}
+	}
+	return aliases
+}
+
+// replaceAliasesOf makes aliases the only ones pointing at target, as
+// another instance has them.
+func replaceAliasesOf(target string, aliases map[string]Alias) {
+	indexMutex.Lock()
+	for name, alias := range userAliases {
+		if alias.Target == target {
+			delete(userAliases, name)
+		}
+	}
+	for name, alias := range aliases {
+		alias.Target = target
+		userAliases[strings.ToLower(name)] = alias
+	}
+	indexMutex.Unlock()
+	saveAssetIndex()
+}
+
+// retargetAliases must be called with indexMutex held.
+func retargetAliases(from, to string) {
+	for name, alias := range userAliases {
+		if alias.Target != from {
+			continue
+		}
+		if to == "" {
+			delete(userAliases, name)
+			continue
+		}
+		alias.Target = to
+		userAliases[name] = alias
+	}
+	delete(userAliases, to)
+}
+
+// resolveAlias applies an alias to a request for an asset. It returns the
+// username to serve, or false when it has already answered with a redirect.
+// An asset stored under the alias itself takes precedence.
+func resolveAlias(c *gin.Context, kind, username string) (string, bool) {
+	alias, ok := lookupAlias(username)
+	if !ok {
+		return username, true
+	}
+	if _, exists, _ := lookupAsset(kind, username); exists {
+		return username, true
+	}
+	if !alias.Redirect {
+		return alias.Target, true
+	}
+
+	target := "/" + url.PathEscape(alias.Target)
+	if kind == "banner" {
+		target = "/.banners" + target
+		if slot := c.Param("slot"); slot != "" {
+			target += "/" + url.PathEscape(slot)
+		}
+	}
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Redirect(http.StatusMovedPermanently, publicURL(c, target))
+	return "", false
+}
+
+func listAliasesHandler(c *gin.Context) {
+	indexMutex.RLock()
+	aliases := make(map[string]Alias, len(userAliases))
+	for name, alias := range userAliases {
+		aliases[name] = alias
+	}
+	indexMutex.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"aliases": aliases})
+}
+
+// putAliasHandler creates or replaces the alias in the URL.
+func putAliasHandler(c *gin.Context) {
+	name := strings.ToLower(c.Param("alias"))
+	var req Alias
+	if err := c.ShouldBindJSON(&req); err != nil || req.Target == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target is required"})
+		return
+	}
+	if strings.ContainsAny(name, "@/") || strings.HasPrefix(name, ".") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alias"})
+		return
+	}
+	if target, ok := lookupAlias(req.Target); ok {
+		req.Target = target.Target
+	}
+	if strings.EqualFold(req.Target, name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An alias cannot point at itself"})
+		return
+	}
+	if len(userAssets(name)) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Alias is a username with stored assets"})
+		return
+	}
+
+	setAlias(name, req)
+	avatarCache.Invalidate(name)
+	bannerCache.Invalidate(name)
+	log.Printf("[aliases] %s now points at %s (redirect=%t)", name, strings.ToLower(req.Target), req.Redirect)
+	c.JSON(http.StatusOK, gin.H{"status": "Success", "alias": name, "target": strings.ToLower(req.Target), "redirect": req.Redirect})
+}
+
+func deleteAliasHandler(c *gin.Context) {
+	name := strings.ToLower(c.Param("alias"))
+	if _, ok := lookupAlias(name); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alias not found"})
+		return
+	}
+	setAlias(name, Alias{})
+	avatarCache.Invalidate(name)
+	bannerCache.Invalidate(name)
+	c.JSON(http.StatusOK, gin.H{"status": "Success"})
+}
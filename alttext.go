@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxAltTextLength = 300
+
+var errAltTextTooLong = errors.New("alt text is too long")
+
+// Alt text is kept apart from the asset index so a reindex, which rebuilds
+// the index from the files on disk, never loses it.
+var (
+	altTexts     = make(map[string]string)
+	altTextMutex sync.RWMutex
+)
+
+func altTextPath() string {
+	return filepath.Join(storageRoot(), "alt.json")
+}
+
+func loadAltTexts() {
+	data, err := os.ReadFile(altTextPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[alt] failed to read %s: %v", altTextPath(), err)
+		}
+		return
+	}
+	texts := make(map[string]string)
+	if err := json.Unmarshal(data, &texts); err != nil {
+		log.Printf("[alt] failed to parse %s: %v", altTextPath(), err)
+		return
+	}
+	altTextMutex.Lock()
+	altTexts = texts
+	altTextMutex.Unlock()
+}
+
+func saveAltTexts() {
+	altTextMutex.RLock()
+	data, err := json.Marshal(altTexts)
+	altTextMutex.RUnlock()
+	if err != nil {
+		log.Printf("[alt] failed to encode alt text: %v", err)
+		return
+	}
+	if err := writeStateFile(altTextPath(), data); err != nil {
+		log.Printf("[alt] failed to write alt text: %v", err)
+	}
+}
+
+// normalizeAltText collapses whitespace and drops control characters.
+func normalizeAltText(text string) (string, error) {
+	text = strings.Join(strings.FieldsFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+	if utf8.RuneCountInString(text) > maxAltTextLength {
+		return "", errAltTextTooLong
+	}
+	return text, nil
+}
+
+// setAltText stores the alt text for an asset. An empty text clears it.
+func setAltText(kind, username, text string) {
+	cacheAltText(kind, username, text)
+	saveAltTexts()
+}
+
+// cacheAltText updates the alt text in memory only, for a change another
+// instance has already written to alt.json.
+func cacheAltText(kind, username, text string) {
+	altTextMutex.Lock()
+	defer altTextMutex.Unlock()
+	if text == "" {
+		delete(altTexts, assetKey(kind, username))
+	} else {
+		altTexts[assetKey(kind, username)] = text
+	}
+}
+
+func getAltText(kind, username string) string {
+	altTextMutex.RLock()
+	defer altTextMutex.RUnlock()
+	return altTexts[assetKey(kind, username)]
+}
+
+// setAltTextHeader exposes the alt text as X-Alt-Text, percent-encoded so
+// non-ASCII text survives as a header value.
+func setAltTextHeader(c *gin.Context, kind, username string) {
+	if text := getAltText(kind, username); text != "" {
+		c.Header("X-Alt-Text", url.PathEscape(text))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nfnt/resize"
+)
+
+const (
+	defaultANSICols   = 40
+	maxANSICols       = 120
+	defaultANSIColors = 16
+)
+
+// ansiHandler renders the avatar as 24-bit ANSI art for terminal clients.
+// Each character is an upper half block covering two pixel rows, so a
+// cols-wide rendering is cols/2 lines tall. ?colors limits the palette.
+func ansiHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+
+	cols, err := boundedQuery(c, "cols", defaultANSICols, 4, maxANSICols)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	colors, err := boundedQuery(c, "colors", defaultANSIColors, 2, 256)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	spec, err := parseTransformSpec(c, "avatar")
+	if err != nil {
+		invalidTransform(c, err)
+		return
+	}
+	spec.Size = 0
+
+	variant, etag, err := avatarVariant(c.Request.Context(), username, spec)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error transforming image"})
+		return
+	}
+
+	etag = fmt.Sprintf(`%s-ansi-%d-%d"`, strings.TrimSuffix(etag, `"`), cols, colors)
+	if notModified(c, etag) {
+		return
+	}
+
+	cacheKey := "ansi-" + etag
+	art, ok := avatarCache.Get(cacheKey)
+	if !ok {
+		data, err := renderANSI(variant.Data, cols, colors)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error decoding image"})
+			return
+		}
+		art = CachedImage{Data: data, ContentType: "text/plain; charset=utf-8", Timestamp: time.Now()}
+		avatarCache.Put(cacheKey, art)
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age=0, must-revalidate")
+	c.Data(http.StatusOK, art.ContentType, art.Data)
+}
+
+// boundedQuery reads an optional integer query parameter within [lo, hi].
+func boundedQuery(c *gin.Context, key string, def, lo, hi int) (int, error) {
+	v, ok := c.GetQuery(key)
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%s must be between %d and %d", key, lo, hi)
+	}
+	return n, nil
+}
+
+func renderANSI(data []byte, cols, colors int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	rows := cols * src.Bounds().Dy() / src.Bounds().Dx()
+	rows += rows % 2
+	img := resize.Resize(uint(cols), uint(rows), src, resize.Bilinear)
+	pal := extractPalette(img, colors)
+
+	at := func(x, y int) color.RGBA {
+		px := color.RGBAModel.Convert(img.At(x, y))
+		if len(pal) > 0 {
+			px = color.RGBAModel.Convert(pal.Convert(px))
+		}
+		return px.(color.RGBA)
+	}
+
+	var buf bytes.Buffer
+	b := img.Bounds()
+	for y := b.Min.Y; y+1 < b.Max.Y; y += 2 {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			top, bottom := at(x, y), at(x, y+1)
+			fmt.Fprintf(&buf, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+		}
+		buf.WriteString("\x1b[0m\n")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// ?crop=WxH asks for an exact output size of any aspect ratio. With
+// fit=cover (the default) the source is cropped to that ratio around the
+// gravity; with fit=contain it is scaled to fit and padded transparently.
+const (
+	fitCover   = "cover"
+	fitContain = "contain"
+
+	gravityCenter = "center"
+	gravityTop    = "top"
+	gravitySmart  = "smart"
+
+	maxCropSide = 1024
+)
+
+var errContainGIF = errors.New("fit=contain is not supported for animated avatars")
+
+func parseCropSize(v string) ([2]int, error) {
+	ws, hs, ok := strings.Cut(strings.ToLower(v), "x")
+	w, errW := strconv.Atoi(ws)
+	h, errH := strconv.Atoi(hs)
+	if !ok || errW != nil || errH != nil || w < 1 || h < 1 || w > maxCropSide || h > maxCropSide {
+		return [2]int{}, fmt.Errorf("crop must be WxH with sides from 1 to %d, got %q", maxCropSide, v)
+	}
+	return [2]int{w, h}, nil
+}
+
+// gravityFocus resolves the gravity into a focal point for a w by h window.
+// Smart gravity prefers the focal point detected on upload when there is
+// one.
+func gravityFocus(img image.Image, gravity string, w, h int, stored *Focus) Focus {
+	switch gravity {
+	case gravityTop:
+		return Focus{0.5, 0}
+	case gravitySmart:
+		if stored != nil {
+			return *stored
+		}
+		return smartFocus(img, w, h)
+	default:
+		return centerFocus
+	}
+}
+
+// saliency scores a small thumbnail of img: edge detail, plus a bonus for
+// skin tones so faces win over busy backgrounds. It returns the thumbnail
+// size and one score per pixel, row by row.
+func saliency(img image.Image) (int, int, []int) {
+	thumb := toRGBA(resize.Thumbnail(64, 64, img, resize.Bilinear))
+	tb := thumb.Bounds()
+	tw, th := tb.Dx(), tb.Dy()
+	scores := make([]int, tw*th)
+	if tw < 3 || th < 3 {
+		return tw, th, scores
+	}
+
+	pixel := func(x, y int) (int, int, int) {
+		o := thumb.PixOffset(tb.Min.X+x, tb.Min.Y+y)
+		return int(thumb.Pix[o]), int(thumb.Pix[o+1]), int(thumb.Pix[o+2])
+	}
+	luma := func(x, y int) int {
+		r, g, b := pixel(x, y)
+		return (299*r + 587*g + 114*b) / 1000
+	}
+	for y := 1; y < th-1; y++ {
+		for x := 1; x < tw-1; x++ {
+			score := abs(luma(x+1, y)-luma(x-1, y)) + abs(luma(x, y+1)-luma(x, y-1))
+			if r, g, b := pixel(x, y); isSkinTone(r, g, b) {
+				score += 64
+			}
+			scores[y*tw+x] = score
+		}
+	}
+	return tw, th, scores
+}
+
+// isSkinTone is the classic RGB skin rule; crude, but cheap and enough to
+// pull a crop towards a face.
+func isSkinTone(r, g, b int) bool {
+	return r > 95 && g > 40 && b > 20 &&
+		max(r, g, b)-min(r, g, b) > 15 &&
+		abs(r-g) > 15 && r > g && r > b
+}
+
+// smartFocus centres the crop on the w:h window with the most salient
+// content.
+func smartFocus(img image.Image, w, h int) Focus {
+	tw, th, scores := saliency(img)
+	if tw < 3 || th < 3 {
+		return centerFocus
+	}
+	cols, rows := make([]int, tw), make([]int, th)
+	for i, score := range scores {
+		cols[i%tw] += score
+		rows[i/tw] += score
+	}
+
+	window := cropWindow(image.Rect(0, 0, tw, th), w, h, centerFocus)
+	focus := centerFocus
+	if window.Dx() < tw {
+		focus[0] = bestSpan(cols, window.Dx())
+	}
+	if window.Dy() < th {
+		focus[1] = bestSpan(rows, window.Dy())
+	}
+	return focus
+}
+
+// detectFocus returns the centroid of the above-average salient pixels, as
+// the subject's position independent of any crop shape.
+func detectFocus(img image.Image) Focus {
+	tw, th, scores := saliency(img)
+	total := 0
+	for _, score := range scores {
+		total += score
+	}
+	if total == 0 {
+		return centerFocus
+	}
+	mean := total / len(scores)
+	var sx, sy, weight float64
+	for i, score := range scores {
+		if score <= mean {
+			continue
+		}
+		sx += float64(score) * (float64(i%tw) + 0.5)
+		sy += float64(score) * (float64(i/tw) + 0.5)
+		weight += float64(score)
+	}
+	if weight == 0 {
+		return centerFocus
+	}
+	return Focus{sx / weight / float64(tw), sy / weight / float64(th)}
+}
+
+// focusInWindow maps a focal point in b to the same point inside window,
+// clamped to it, for recording where the subject ended up after a crop.
+func focusInWindow(focus Focus, b, window image.Rectangle) Focus {
+	x := float64(b.Min.X) + focus[0]*float64(b.Dx())
+	y := float64(b.Min.Y) + focus[1]*float64(b.Dy())
+	fx := (x - float64(window.Min.X)) / float64(window.Dx())
+	fy := (y - float64(window.Min.Y)) / float64(window.Dy())
+	return Focus{max(0, min(fx, 1)), max(0, min(fy, 1))}
+}
+
+// bestSpan returns the centre, as a fraction of len(energy), of the run of
+// n entries with the largest sum.
+func bestSpan(energy []int, n int) float64 {
+	sum := 0
+	for _, e := range energy[:n] {
+		sum += e
+	}
+	best, bestStart := sum, 0
+	for start := 1; start+n <= len(energy); start++ {
+		sum += energy[start+n-1] - energy[start-1]
+		if sum > best {
+			best, bestStart = sum, start
+		}
+	}
+	return (float64(bestStart) + float64(n)/2) / float64(len(energy))
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// fitImage produces exactly w by h from img according to fit and gravity.
+func fitImage(img image.Image, w, h int, fit, gravity string, stored *Focus) image.Image {
+	if fit != fitContain {
+		return cropImage(img, cropWindow(img.Bounds(), w, h, gravityFocus(img, gravity, w, h, stored)), w, h)
+	}
+	b := img.Bounds()
+	sw, sh := w, b.Dy()*w/b.Dx()
+	if sh > h {
+		sw, sh = b.Dx()*h/b.Dy(), h
+	}
+	scaled := resize.Resize(uint(max(sw, 1)), uint(max(sh, 1)), progressiveDownscale(img, uint(max(sw, 1)), uint(max(sh, 1))), resize.Lanczos3)
+	canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+	at := image.Pt((w-scaled.Bounds().Dx())/2, (h-scaled.Bounds().Dy())/2)
+	draw.Draw(canvas, scaled.Bounds().Sub(scaled.Bounds().Min).Add(at), scaled, scaled.Bounds().Min, draw.Src)
+	return canvas
+}
+
+// fitFrames is fitImage for the frames of one animation, with the focal
+// point judged once on the first frame so the window doesn't jump.
+func fitFrames(frames []image.Image, w, h int, fit, gravity string, stored *Focus) []image.Image {
+	out := make([]image.Image, len(frames))
+	if len(frames) == 0 {
+		return out
+	}
+	focus := gravityFocus(frames[0], gravity, w, h, stored)
+	for i, frame := range frames {
+		if fit == fitContain {
+			out[i] = fitImage(frame, w, h, fit, gravity, stored)
+		} else {
+			out[i] = cropImage(frame, cropWindow(frame.Bounds(), w, h, focus), w, h)
+		}
+	}
+	return out
+}
+
+// fitGIF is fitImage for animated avatars; only cover is supported, and
+// smart gravity is judged on the first frame.
+func fitGIF(data []byte, w, h int, fit, gravity string, stored *Focus) ([]byte, error) {
+	if fit == fitContain {
+		return nil, errContainGIF
+	}
+	focus := centerFocus
+	if gravity == gravitySmart && stored != nil {
+		focus = *stored
+	} else if gravity != gravityCenter && gravity != "" {
+		first, err := gif.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		focus = gravityFocus(first, gravity, w, h, nil)
+	}
+	out, _, err := cropGIFReader(bytes.NewReader(data), w, h, focus)
+	return out, err
+}
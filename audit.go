@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Asset     string    `json:"asset"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash,omitempty"`
+	Status    int       `json:"status"`
+	Result    string    `json:"result"`
+}
+
+var auditMutex sync.Mutex
+
+// Client metadata (IP and user agent) is personal data: each can be switched
+// off with AUDIT_RECORD_IP / AUDIT_RECORD_USER_AGENT, and it is scrubbed from
+// entries older than AUDIT_CLIENT_RETENTION_DAYS (0 keeps it) and on request
+// for a single user. The rest of each entry is kept.
+var (
+	auditRecordIP        = true
+	auditRecordUserAgent = false
+	auditClientRetention time.Duration
+)
+
+func auditLogPath() string {
+	return filepath.Join(storageRoot(), "audit.jsonl")
+}
+
+// recordAudit appends an entry to the audit log. Entries are only ever
+// rewritten to scrub client metadata.
+func recordAudit(entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	if entry.Result == "" {
+		entry.Result = "success"
+		if entry.Status >= 300 {
+			entry.Result = "failed"
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("[audit] failed to encode entry: %v", err)
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	os.MkdirAll(filepath.Dir(auditLogPath()), 0755)
+	f, err := os.OpenFile(auditLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[audit] failed to open log: %v", err)
+		return
+	}
+	f.Write(append(line, '\n'))
+	f.Close()
+	backupStateFile(auditLogPath())
+}
+
+// auditRequest records the outcome of an upload/delete handler once it has
+// written its response. Use with defer so every return path is captured.
+func auditRequest(c *gin.Context, entry *AuditEntry) {
+	if auditRecordIP {
+		entry.IP = c.ClientIP()
+	}
+	if auditRecordUserAgent {
+		entry.UserAgent = c.Request.UserAgent()
+	}
+	entry.Status = c.Writer.Status()
+	recordAudit(*entry)
+}
+
+// fileDigest hashes f from the start and rewinds it.
+func fileDigest(f *os.File) string {
+	defer f.Seek(0, io.SeekStart)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// readAuditEntries returns up to limit entries, newest first, optionally
+// filtered to one user.
+func readAuditEntries(username string, limit int) ([]AuditEntry, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	entries := []AuditEntry{}
+	f, err := os.Open(auditLogPath())
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if username != "" && entry.Username != username {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	// newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func auditHandler(c *gin.Context) {
+	username := strings.ToLower(c.Query("username"))
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	entries, err := readAuditEntries(username, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// scrubClientInfo removes IP and user agent from the entries matching fn,
+// rewriting the log in place, and returns how many entries changed.
+func scrubClientInfo(match func(AuditEntry) bool) (int, error) {
+	return rewriteAuditLog(func(entry *AuditEntry) (bool, bool) {
+		if (entry.IP == "" && entry.UserAgent == "") || !match(*entry) {
+			return true, false
+		}
+		entry.IP, entry.UserAgent = "", ""
+		return true, true
+	})
+}
+
+// removeAuditEntries deletes every entry of a user from the log.
+func removeAuditEntries(username string) (int, error) {
+	return rewriteAuditLog(func(entry *AuditEntry) (bool, bool) {
+		return entry.Username != username, false
+	})
+}
+
+// rewriteAuditLog passes every entry to edit, which reports whether to keep
+// it and whether it changed it, and replaces the log when anything did. It
+// returns the number of entries dropped or changed.
+func rewriteAuditLog(edit func(*AuditEntry) (keep, changed bool)) (int, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	data, err := os.ReadFile(auditLogPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var out []byte
+	touched := 0
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err == nil {
+			keep, changed := edit(&entry)
+			if !keep {
+				touched++
+				continue
+			}
+			if rewritten, err := json.Marshal(entry); err == nil && changed {
+				line = string(rewritten) + "\n"
+				touched++
+			}
+		}
+		out = append(out, line...)
+	}
+	if touched == 0 {
+		return 0, nil
+	}
+	return touched, writeStateFile(auditLogPath(), out)
+}
+
+// startAuditRetention scrubs expired client metadata once a day.
+func startAuditRetention() {
+	if auditClientRetention <= 0 {
+		return
+	}
+	go func() {
+		for {
+			cutoff := time.Now().Add(-auditClientRetention)
+			n, err := scrubClientInfo(func(e AuditEntry) bool { return e.Time.Before(cutoff) })
+			if err != nil {
+				log.Printf("[audit] retention sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("[audit] scrubbed client metadata from %d expired entries", n)
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+// auditPurgeHandler scrubs the recorded IPs and user agents of one user,
+// for privacy requests.
+func auditPurgeHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+	n, err := scrubClientInfo(func(e AuditEntry) bool { return e.Username == username })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error rewriting audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"username": username, "scrubbed": n})
+}
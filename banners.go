@@ -2,56 +2,58 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/gif"
-	"image/jpeg"
 	"image/png"
+	"io"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/nfnt/resize"
 )
 
 func deleteBanners(username string) error {
-	bannerDir := filepath.Join(documentPath, "rotur", "banners")
 	base := strings.ToLower(username)
 
 	extensions := []string{".gif", ".jpg"}
 	for _, ext := range extensions {
-		filePath := filepath.Join(bannerDir, base+ext)
-		err := os.Remove(filePath)
-		if err != nil {
+		err := os.Remove(assetPath("banner", base, ext))
+		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
+	unindexAsset("banner", base)
 	return nil
 }
 
 func loadDefaultBanner() {
-	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
-
-	var buf bytes.Buffer
-	png.Encode(&buf, img)
-	defaultBannerContent = buf.Bytes()
+	defaultBannerContent = fallbackAsset("banner", themeLight).Data
+	darkDefaultBanner = fallbackAsset("banner", themeDark).Data
 }
 
 func getBannerPath(username string) (string, string, string, time.Time, error) {
-	bannerPath := filepath.Join(documentPath, "rotur", "banners", username+".gif")
+	if meta, ok, ready := lookupAsset("banner", username); ready {
+		if !ok {
+			return "", "", "", time.Time{}, os.ErrNotExist
+		}
+		return meta.Path, meta.ContentType(), meta.Etag(), meta.UpdatedAt, nil
+	}
+
+	bannerPath := assetPath("banner", username, ".gif")
 	fi, err := os.Stat(bannerPath)
 	if err == nil {
 		contentType := "image/gif"
 		etag := fmt.Sprintf("%s-%d", username, time.Now().Unix())
 		return bannerPath, contentType, etag, fi.ModTime(), nil
 	}
-	bannerPath = filepath.Join(documentPath, "rotur", "banners", username+".jpg")
+	bannerPath = assetPath("banner", username, ".jpg")
 	fi, err = os.Stat(bannerPath)
 	if err == nil {
 		contentType := "image/jpeg"
@@ -64,30 +66,74 @@ func getBannerPath(username string) (string, string, string, time.Time, error) {
 
 func bannerHandler(c *gin.Context) {
 	username, _ := strings.CutSuffix(strings.ToLower(c.Param("username")), ".gif")
-	radius := c.Query("radius")
-	radiusInt, parseErr := strconv.Atoi(strings.TrimSuffix(radius, "px"))
-	needRounding := radius != "" && parseErr == nil && radiusInt > 0
+	slot, err := parseBannerSlot(c.Param("slot"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	username, ok := resolveAlias(c, "banner", username)
+	if !ok {
+		return
+	}
+	if c.Param("slot") == "" && redirectToRotation(c, username) {
+		return
+	}
+	username = bannerKey(username, slot)
+	spec, err := parseTransformSpec(c, "banner")
+	if err != nil {
+		invalidTransform(c, err)
+		return
+	}
+	if presetOnly && !spec.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Transforms are disabled on this server"})
+		return
+	}
+	needRounding := !spec.IsZero()
+	if redirectToCanonical(c, spec) {
+		return
+	}
+	startPipeline(c)
 
 	bannerPath, contentType, etag, modTime, err := getBannerPath(username)
+	if err != nil && hasReadThrough() && fetchFromOrigin("banner", username) == nil {
+		bannerPath, contentType, etag, modTime, err = getBannerPath(username)
+	}
 	var imageData []byte
 	if err != nil {
-		imageData = defaultBannerContent
+		if errorPlaceholders {
+			setCachePolicy(c, cacheNegative)
+			c.Data(http.StatusNotFound, "image/jpeg", defaultBanner(requestTheme(c)))
+			return
+		}
+		imageData = defaultBanner(requestTheme(c))
 		contentType = "image/jpeg"
 		needRounding = false
+	} else {
+		setAltTextHeader(c, "banner", username)
+		if meta, ok, _ := lookupAsset("banner", username); ok {
+			setPipelineSource(c, meta.Width, meta.Height)
+		}
+		if !negotiateFormat(c, &spec, contentType) {
+			return
+		}
+		needRounding = !spec.IsZero()
 	}
 
 	if !needRounding {
-		c.Header("Content-Type", contentType)
 		if etag != "" {
-			c.Header("ETag", etag)
+			if notModified(c, fmt.Sprintf(`"%s"`, etag)) {
+				return
+			}
+			c.Header("ETag", fmt.Sprintf(`"%s"`, etag))
 		}
+		c.Header("Content-Type", contentType)
 		if !modTime.IsZero() {
 			c.Header("Last-Modified", modTime.Format(http.TimeFormat))
 		}
-		if contentType == "image/gif" {
-			c.Header("Cache-Control", "public, max-age=86400, must-revalidate")
+		if bannerPath == "" {
+			setCachePolicy(c, cacheDefault)
 		} else {
-			c.Header("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+			setCachePolicy(c, cacheOriginal)
 		}
 		if c.Request.Method == http.MethodHead {
 			c.Status(200)
@@ -109,57 +155,190 @@ func bannerHandler(c *gin.Context) {
 
 	// Load image data only if rounding is needed
 	if bannerPath != "" {
+		_, sp := startSpan(c.Request.Context(), "storage.read")
 		imageData, err = os.ReadFile(bannerPath)
+		sp.SetAttr("bytes", len(imageData))
+		sp.RecordError(err)
+		sp.End()
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading banner file"})
 			return
 		}
 	}
 
-	if contentType == "image/gif" {
-		src, err := gif.DecodeAll(bytes.NewReader(imageData))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error decoding GIF"})
+	cacheKey := spec.Key(fmt.Sprintf("banner-%s-%d", username, modTime.Unix()))
+	sourceHash := etag
+	if meta, ok, _ := lookupAsset("banner", username); ok {
+		sourceHash = meta.Hash
+	}
+	variantEtag := transformETag(spec, sourceHash)
+	if bannerPath != "" {
+		bannerCache.recordHot(username, spec)
+	}
+
+	sourceData, sourceType := imageData, contentType
+	generate := func() (CachedImage, error) {
+		return renderBanner(context.Background(), sourceData, sourceType, spec)
+	}
+
+	cached, ok := bannerCache.Get(cacheKey)
+	if ok {
+		status := bannerCache.Status(cached)
+		if status == cacheHit || bannerCache.swr {
+			if status == cacheStale {
+				queueTransform(bannerCache, cacheKey, c.Request.URL.RequestURI(), generate)
+			}
+			if notModified(c, variantEtag) {
+				return
+			}
+			c.Header("ETag", variantEtag)
+			setCachePolicy(c, cacheTransform)
+			setCacheStatus(c, status, cached.Timestamp)
+			setPipelineHeaders(c)
+			c.Data(http.StatusOK, cached.ContentType, cached.Data)
 			return
 		}
-		rounded, err := roundGIF(src, radiusInt)
+	}
+
+	if shedTransform(c, imageData, contentType) {
+		return
+	}
+	variant, done := takeTransformResult(cacheKey)
+	if !done && asyncTransforms && contentType == "image/gif" {
+		id := queueTransform(bannerCache, cacheKey, c.Request.URL.RequestURI(), generate)
+		respondPending(c, id)
+		return
+	}
+
+	if !done {
+		var err error
+		variant, err = bannerCache.Render(cacheKey, func() (CachedImage, error) {
+			return renderBanner(c.Request.Context(), imageData, contentType, spec)
+		})
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error rounding GIF"})
-			fmt.Println("Error rounding gif: " + err.Error())
+			transformFailed(c, imageData, contentType, err)
 			return
 		}
-		buf := bytes.NewBuffer(nil)
-		err = gif.EncodeAll(buf, rounded)
+	}
+
+	if notModified(c, variantEtag) {
+		return
+	}
+
+	c.Header("Content-Type", variant.ContentType)
+	c.Header("ETag", variantEtag)
+	setCachePolicy(c, cacheTransform)
+	setCacheStatus(c, cacheMiss, time.Time{})
+	setPipelineHeaders(c)
+	c.Data(http.StatusOK, variant.ContentType, variant.Data)
+}
+
+// renderBanner applies the size (a centre crop when the aspect ratio
+// differs) and radius to a banner. Rounded still banners become PNG.
+func renderBanner(ctx context.Context, data []byte, contentType string, spec TransformSpec) (CachedImage, error) {
+	if contentType == "image/gif" && spec.Format == "" {
+		if spec.Crop != [2]int{} {
+			_, sp := startSpan(ctx, "crop")
+			cropped, err := fitGIF(data, spec.Crop[0], spec.Crop[1], fitCover, "", nil)
+			sp.RecordError(err)
+			sp.End()
+			if err != nil {
+				return CachedImage{}, fmt.Errorf("cropping gif: %w", err)
+			}
+			data = cropped
+		}
+		if !spec.Radius.IsZero() {
+			rounded, err := roundBannerGIF(ctx, data, spec.Radius)
+			if err != nil {
+				return CachedImage{}, err
+			}
+			data = rounded
+		}
+		data, err := limitGIFOutput(ctx, data)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encoding GIF"})
-			fmt.Println("Error encoding gif: " + err.Error())
-			return
+			return CachedImage{}, err
 		}
-		imageData = buf.Bytes()
-		c.Header("Content-Type", "image/gif")
-		c.Header("Cache-Control", "public, max-age=86400, must-revalidate")
-		c.Data(http.StatusOK, "image/gif", imageData)
-		return
+		return CachedImage{ContentType: "image/gif", Data: data, Timestamp: time.Now()}, nil
 	}
 
-	// For non-GIF with rounding
-	rounded, newContentType, err := roundCorners(imageData, radiusInt)
+	_, sp := startSpan(ctx, "decode")
+	img, _, err := decodeImage(bytes.NewReader(data))
+	sp.RecordError(err)
+	sp.End()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error rounding image"})
-		return
+		return CachedImage{}, err
 	}
-	imageData = rounded
-	contentType = newContentType
-	c.Header("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-	c.Data(http.StatusOK, contentType, imageData)
+	if spec.Crop != [2]int{} {
+		_, sp = startSpan(ctx, "crop")
+		img = fitImage(img, spec.Crop[0], spec.Crop[1], fitCover, "", nil)
+		sp.End()
+	}
+	if !spec.Radius.IsZero() {
+		_, sp = startSpan(ctx, "round")
+		sp.SetAttr("radius", spec.Radius.String())
+		rgba := toRGBA(img)
+		applyRoundedMask(rgba, spec.Radius)
+		img = rgba
+		sp.End()
+	}
+
+	_, sp = startSpan(ctx, "encode")
+	var buf bytes.Buffer
+	contentType = "image/jpeg"
+	if spec.Format == formatPNG || (!spec.Radius.IsZero() && spec.Format == "") {
+		contentType = "image/png"
+		err = png.Encode(&buf, img)
+	} else if !spec.Radius.IsZero() {
+		err = encodeJPEG(&buf, flattenImage(img))
+	} else {
+		err = encodeJPEG(&buf, img)
+	}
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return CachedImage{}, err
+	}
+	return CachedImage{ContentType: contentType, Data: buf.Bytes(), Timestamp: time.Now()}, nil
+}
+
+func roundBannerGIF(ctx context.Context, imageData []byte, radius Radius) ([]byte, error) {
+	_, sp := startSpan(ctx, "decode")
+	src, err := gif.DecodeAll(bytes.NewReader(imageData))
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return nil, fmt.Errorf("decoding gif: %w", err)
+	}
+
+	roundCtx, sp := startSpan(ctx, "round")
+	sp.SetAttr("radius", radius.String())
+	rounded, err := roundGIF(roundCtx, src, radius)
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return nil, err
+	}
+
+	_, sp = startSpan(ctx, "encode")
+	buf := bytes.NewBuffer(nil)
+	err = gif.EncodeAll(buf, rounded)
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return nil, fmt.Errorf("encoding gif: %w", err)
+	}
+	return buf.Bytes(), nil
 }
 
 func uploadBannerHandler(c *gin.Context) {
+	audit := AuditEntry{Action: "upload", Asset: "banner"}
+	defer auditRequest(c, &audit)
+
 	var req UploadRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+	if !bindUploadJSON(c, &req) {
 		return
 	}
+	defer req.discardImage()
 
 	usersFile, err := os.ReadFile("users.json")
 	if err != nil {
@@ -185,49 +364,97 @@ func uploadBannerHandler(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid token"})
 		return
 	}
+	audit.Username = strings.ToLower(user.Username)
+	if !checkUploadPolicy(c, *user, "banner") {
+		return
+	}
 
-	if req.Image == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing image"})
+	tier := strings.ToLower(toString(user.GetSubscription()))
+	slot, err := parseBannerSlot(req.Slot)
+	if err == nil {
+		err = checkBannerSlot(audit.Username, tier, slot)
+	}
+	switch {
+	case errors.Is(err, errInvalidSlot):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
+	case err != nil:
+		countFeature(statSlotRejected, "", tier)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "limit": maxBannerSlots})
+		return
+	}
+	key := bannerKey(audit.Username, slot)
+	focus, err := parseFocus(req.Focus)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var altText string
+	if req.Alt != nil {
+		altText, err = normalizeAltText(*req.Alt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Alt text must be at most 300 characters"})
+			return
+		}
 	}
 
-	parts := strings.Split(req.Image, ",")
-	if len(parts) != 2 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image format"})
+	if req.Image == nil {
+		if req.Alt != nil {
+			audit.Action = "alt"
+			setAltText("banner", key, altText)
+			c.JSON(http.StatusOK, gin.H{"status": "Success", "message": "Alt text updated"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing image"})
 		return
 	}
-	mimeHeader := parts[0]
 
-	imageData, err := base64.StdEncoding.DecodeString(parts[1])
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image format"})
+	if req.Image.size > uploadLimit(*user) {
+		rejectOversized(c, "banner", *user)
 		return
 	}
 
-	if len(imageData) > 10*1024*1024 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Image size exceeds 10MB limit"})
+	mem := newMemTracker()
+	mimeHeader, upload, size, err := req.Image.open()
+	if err != nil {
+		rejectUpload(c, err)
 		return
 	}
+	audit.Size = size
+	audit.Hash = fileDigest(upload)
+	mem.sample()
 
-	img, _, err := image.Decode(bytes.NewReader(imageData))
+	cfg, _, err := image.DecodeConfig(upload)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding image"})
 		return
 	}
+	if !checkSourceDimensions(cfg) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image dimensions too large"})
+		return
+	}
+	if _, err := upload.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading upload"})
+		return
+	}
 
-	tier := strings.ToLower(toString(user.GetSubscription()))
-	isPro := strings.EqualFold(tier, "pro") || strings.EqualFold(tier, "max")
+	isPro := slices.Contains(animatedBannerTiers, tier)
 
 	var ext, contentType string
+	var downgraded bool
 	switch {
 	case strings.Contains(mimeHeader, "image/gif"):
 		if isPro {
 			ext = ".gif"
 			contentType = "image/gif"
+			countFeature(statGIFAccepted, "banner", tier)
 		} else {
 			// downgrade to jpg if not pro
 			ext = ".jpg"
 			contentType = "image/jpeg"
+			downgraded = true
+			countFeature(statGIFDowngraded, "banner", tier)
 		}
 	case strings.Contains(mimeHeader, "image/png"):
 		ext = ".png"
@@ -238,46 +465,77 @@ func uploadBannerHandler(c *gin.Context) {
 	}
 
 	username := strings.ToLower(user.Username)
-	bannerDir := filepath.Join(documentPath, "rotur", "banners")
-	filePath := filepath.Join(bannerDir, username+ext)
-
-	deleteBanners(username)
-
+	var filePath string
+	var crop image.Rectangle
+	var safeArea *SafeArea
+	dims := assetDimensions["banner"]
 	if contentType == "image/gif" {
 		// Pro users only
-		resizedData, err := resizeGIF(imageData, 900, 300)
+		var resizedData []byte
+		resizedData, crop, err = cropGIFReader(upload, dims[0], dims[1], focus)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error resizing GIF"})
 			return
 		}
 
-		err = os.WriteFile(filePath, resizedData, 0644)
+		filePath, err = storeAsset("banner", key, ext, resizedData)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving GIF"})
 			return
 		}
+		if first, err := gif.Decode(bytes.NewReader(resizedData)); err == nil {
+			safeArea = detectSafeArea(first)
+		}
 	} else {
-		resized := resize.Resize(900, 300, img, resize.Lanczos3)
-
-		os.MkdirAll(bannerDir, 0755)
-
-		filePath = filepath.Join(bannerDir, username+".jpg")
-		file, err := os.Create(filePath)
+		img, err := decodeStill(upload, downgraded)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving banner"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding image"})
 			return
 		}
-		defer file.Close()
+		mem.sample()
+
+		crop = cropWindow(img.Bounds(), dims[0], dims[1], focus)
+		resized := cropImage(img, crop, dims[0], dims[1])
+		safeArea = detectSafeArea(resized)
 
-		err = jpeg.Encode(file, resized, &jpeg.Options{Quality: 85})
+		var buf bytes.Buffer
+		err = encodeJPEG(&buf, resized)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encoding banner"})
 			return
 		}
+		filePath, err = storeAsset("banner", key, ".jpg", buf.Bytes())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving banner"})
+			return
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":  "Success",
-		"message": "Banner uploaded successfully",
+	indexAssetWith("banner", key, filePath, func(meta *AssetMeta) {
+		meta.SafeArea = safeArea
 	})
+	if req.Alt != nil {
+		setAltText("banner", key, altText)
+	}
+	mem.report("banner", username)
+	notifyPeers("banner", key)
+
+	resp := gin.H{
+		"status":     "Success",
+		"message":    "Banner uploaded successfully",
+		"downgraded": downgraded,
+		"url":        publicURL(c, "/.banners/"+username),
+		"crop":       cropJSON(crop),
+		"safe_area":  safeArea,
+	}
+	if slot != "" {
+		resp["slot"] = slot
+		resp["url"] = publicURL(c, "/.banners/"+username+"/"+slot)
+	}
+	setUploadValidators(c, "banner", key)
+	if downgraded {
+		resp["reason"] = "tier"
+		emitEvent(Event{Type: "upload.downgraded", Asset: "banner", Username: username, Reason: "tier", Tier: tier})
+	}
+	c.JSON(http.StatusOK, resp)
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Named banner slots are stored as separate banner assets keyed
+// "username@slot", so storage, the index, alt text and the banner cache all
+// treat each slot as its own asset. The unnamed slot is the plain username.
+const defaultBannerSlot = "default"
+
+var (
+	maxBannerSlots = 5
+	bannerSlotName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+	errInvalidSlot   = errors.New("slot names are 1-32 characters of a-z, 0-9, _ and -")
+	errSlotsTierOnly = errors.New("named banners require a Pro subscription")
+	errTooManySlots  = errors.New("banner slot limit reached")
+)
+
+// bannerKey returns the asset username for a slot.
+func bannerKey(username, slot string) string {
+	username = strings.ToLower(username)
+	if slot == "" || slot == defaultBannerSlot {
+		return username
+	}
+	return username + "@" + slot
+}
+
+// splitBannerKey is the inverse of bannerKey.
+func splitBannerKey(key string) (username, slot string) {
+	username, slot, _ = strings.Cut(key, "@")
+	return username, slot
+}
+
+func parseBannerSlot(slot string) (string, error) {
+	slot = strings.ToLower(slot)
+	if slot == "" || slot == defaultBannerSlot {
+		return "", nil
+	}
+	if !bannerSlotName.MatchString(slot) {
+		return "", errInvalidSlot
+	}
+	return slot, nil
+}
+
+// bannerSlots lists a user's named slots, not counting the default one.
+func bannerSlots(username string) []string {
+	prefix := assetKey("banner", username) + "@"
+	var slots []string
+	indexMutex.RLock()
+	for key := range assetIndex {
+		if slot, ok := strings.CutPrefix(key, prefix); ok {
+			slots = append(slots, slot)
+		}
+	}
+	indexMutex.RUnlock()
+	slices.Sort(slots)
+	return slots
+}
+
+// checkBannerSlot reports whether a user on tier may upload to slot.
+// Replacing an existing slot never counts against the limit.
+func checkBannerSlot(username, tier, slot string) error {
+	if slot == "" {
+		return nil
+	}
+	if !slices.Contains(animatedBannerTiers, tier) {
+		return errSlotsTierOnly
+	}
+	slots := bannerSlots(username)
+	if !slices.Contains(slots, slot) && len(slots) >= maxBannerSlots {
+		return errTooManySlots
+	}
+	return nil
+}
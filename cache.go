@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	cacheHit   = "HIT"
+	cacheMiss  = "MISS"
+	cacheStale = "STALE"
+)
+
+// variantCache holds transformed variants for one asset kind, keyed by the
+// transform signature and evicted least-recently-used once the byte budget
+// is spent. Avatars and banners get separate instances so a few large
+// banners cannot evict dozens of avatars.
+type variantCache struct {
+	name   string
+	budget int64
+	ttl    time.Duration
+	// swr serves expired entries immediately and regenerates them in the
+	// background instead of blocking the request.
+	swr bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	bytes   int64
+	// diskKeys maps the file names of disk entries written or read since
+	// startup to their keys, so Invalidate can find a user's hashed files.
+	diskKeys map[string]string
+	// sourcePrefix starts the source part of every key; see ownedBy.
+	sourcePrefix string
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	bypassed      atomic.Int64
+	bypassedBytes atomic.Int64
+	evicted       atomic.Int64
+	expired       atomic.Int64
+	expiredBytes  atomic.Int64
+
+	// flights and hot guard against stampedes; see stampede.go.
+	flightMu     sync.Mutex
+	flights      map[string]*flight
+	hot          map[string]*hotVariant
+	regenerate   func(username string, spec TransformSpec) error
+	prewarmUntil time.Time
+}
+
+func newVariantCache(name string, budget int64, ttl time.Duration) *variantCache {
+	return &variantCache{
+		name:     name,
+		budget:   budget,
+		ttl:      ttl,
+		swr:      true,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		diskKeys: make(map[string]string),
+		flights:  make(map[string]*flight),
+		hot:      make(map[string]*hotVariant),
+	}
+}
+
+type cacheEntry struct {
+	key string
+	img CachedImage
+}
+
+var (
+	avatarCache = newVariantCache("avatars", 64*1024*1024, time.Duration(cacheTimeout)*time.Second)
+	bannerCache = func() *variantCache {
+		vc := newVariantCache("banners", 128*1024*1024, time.Duration(cacheTimeout)*time.Second)
+		vc.sourcePrefix = "banner-"
+		return vc
+	}()
+
+	// Results larger than maxCacheEntryBytes skip the memory cache and go to
+	// the disk cache when diskCacheDir is set, or are not cached at all.
+	maxCacheEntryBytes int64 = 2 * 1024 * 1024
+	diskCacheDir       string
+	// diskCacheCompression is "gzip" or "none".
+	diskCacheCompression = "gzip"
+
+	cacheJanitorInterval = 5 * time.Minute
+)
+
+func (vc *variantCache) Get(key string) (CachedImage, bool) {
+	vc.mu.Lock()
+	elem, ok := vc.entries[key]
+	if ok {
+		vc.lru.MoveToFront(elem)
+	}
+	vc.mu.Unlock()
+	if ok {
+		vc.hits.Add(1)
+		return elem.Value.(*cacheEntry).img, true
+	}
+	cached, ok := vc.diskGet(key)
+	if ok {
+		vc.hits.Add(1)
+	} else {
+		vc.misses.Add(1)
+	}
+	return cached, ok
+}
+
+// Put caches img under key, reporting whether it was kept in memory or on
+// disk.
+func (vc *variantCache) Put(key string, img CachedImage) bool {
+	size := int64(len(img.Data))
+	if size > maxCacheEntryBytes || size > vc.budget {
+		vc.bypassed.Add(1)
+		vc.bypassedBytes.Add(size)
+		return vc.diskPut(key, img)
+	}
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if elem, ok := vc.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		vc.bytes -= int64(len(entry.img.Data))
+		entry.img = img
+		vc.lru.MoveToFront(elem)
+	} else {
+		vc.entries[key] = vc.lru.PushFront(&cacheEntry{key: key, img: img})
+	}
+	vc.bytes += size
+	for vc.bytes > vc.budget {
+		vc.evictLeastRecent()
+	}
+	return true
+}
+
+// evictLeastRecent drops the least recently used entry. Callers hold vc.mu.
+func (vc *variantCache) evictLeastRecent() {
+	elem := vc.lru.Back()
+	if elem == nil {
+		vc.bytes = 0
+		return
+	}
+	entry := vc.lru.Remove(elem).(*cacheEntry)
+	delete(vc.entries, entry.key)
+	vc.bytes -= int64(len(entry.img.Data))
+	vc.evicted.Add(1)
+}
+
+// Invalidate drops one user's cached variants, in memory and on disk, then
+// starts regenerating that user's hot ones. A banner key ("user@slot") drops
+// just that slot; a bare username drops every slot. Disk entries written
+// before a restart aren't known by key and are left to the janitor; their
+// keys carry the old modification time, so they are never read again.
+func (vc *variantCache) Invalidate(username string) {
+	vc.mu.Lock()
+	for key, elem := range vc.entries {
+		if !vc.ownedBy(key, username) {
+			continue
+		}
+		vc.lru.Remove(elem)
+		delete(vc.entries, key)
+		vc.bytes -= int64(len(elem.Value.(*cacheEntry).img.Data))
+	}
+	var stale []string
+	for name, key := range vc.diskKeys {
+		if vc.ownedBy(key, username) {
+			stale = append(stale, name)
+			delete(vc.diskKeys, name)
+		}
+	}
+	vc.mu.Unlock()
+	for _, name := range stale {
+		os.Remove(filepath.Join(diskCacheDir, vc.name, name))
+	}
+	vc.prewarmUser(username)
+}
+
+// ownedBy reports whether key caches a variant of username's asset. Keys
+// start with the transform version and the source, which is the cache's
+// source prefix, the username or banner key and the asset's modification
+// time: "v2-alice-1700000000-size=64". Usernames may contain dashes and
+// digits, so the time must be followed by the end of the key or a segment
+// that isn't a number: user "alice-5" is "v2-alice-5-1700000000".
+func (vc *variantCache) ownedBy(key, username string) bool {
+	rest, ok := strings.CutPrefix(key, fmt.Sprintf("v%d-%s%s", transformKeyVersion, vc.sourcePrefix, username))
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(rest, "@") && !strings.Contains(username, "@") {
+		return true
+	}
+	rest, ok = strings.CutPrefix(rest, "-")
+	if !ok {
+		return false
+	}
+	modTime, rest, _ := strings.Cut(rest, "-")
+	if !isDigits(modTime) {
+		return false
+	}
+	next, _, _ := strings.Cut(rest, "-")
+	return rest == "" || !isDigits(next)
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// maxAge is how long an entry is worth keeping. With stale-while-revalidate
+// an expired entry is still served once more while it regenerates, so it is
+// kept for a second TTL.
+func (vc *variantCache) maxAge() time.Duration {
+	if vc.swr {
+		return 2 * vc.ttl
+	}
+	return vc.ttl
+}
+
+// sweep removes entries older than maxAge from memory and disk and returns
+// how many entries and bytes it reclaimed.
+func (vc *variantCache) sweep() (int, int64) {
+	cutoff := time.Now().Add(-vc.maxAge())
+	var count int
+	var reclaimed int64
+
+	vc.mu.Lock()
+	for key, elem := range vc.entries {
+		entry := elem.Value.(*cacheEntry)
+		if entry.img.Timestamp.IsZero() || entry.img.Timestamp.After(cutoff) {
+			continue
+		}
+		vc.lru.Remove(elem)
+		delete(vc.entries, key)
+		size := int64(len(entry.img.Data))
+		vc.bytes -= size
+		reclaimed += size
+		count++
+	}
+	vc.mu.Unlock()
+
+	if diskCacheDir != "" {
+		files, _ := os.ReadDir(filepath.Join(diskCacheDir, vc.name))
+		for _, f := range files {
+			info, err := f.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			if os.Remove(filepath.Join(diskCacheDir, vc.name, f.Name())) == nil {
+				vc.mu.Lock()
+				delete(vc.diskKeys, f.Name())
+				vc.mu.Unlock()
+				reclaimed += info.Size()
+				count++
+			}
+		}
+	}
+
+	vc.expired.Add(int64(count))
+	vc.expiredBytes.Add(reclaimed)
+	return count, reclaimed
+}
+
+// startCacheJanitor periodically sweeps expired entries from every cache,
+// since reads only skip them.
+func startCacheJanitor() {
+	if cacheJanitorInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cacheJanitorInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, vc := range []*variantCache{avatarCache, bannerCache} {
+				if count, reclaimed := vc.sweep(); count > 0 {
+					log.Printf("[cache] janitor removed %d expired %s entries, reclaimed %d bytes", count, vc.name, reclaimed)
+				}
+			}
+		}
+	}()
+}
+
+// Status reports whether a cached entry is still within the cache's TTL.
+func (vc *variantCache) Status(img CachedImage) string {
+	if !img.Timestamp.IsZero() && time.Since(img.Timestamp) > vc.ttl {
+		return cacheStale
+	}
+	return cacheHit
+}
+
+func (vc *variantCache) Stats() gin.H {
+	vc.mu.Lock()
+	entries, size := len(vc.entries), vc.bytes
+	vc.mu.Unlock()
+	return gin.H{
+		"entries":        entries,
+		"hits":           vc.hits.Load(),
+		"misses":         vc.misses.Load(),
+		"bytes":          size,
+		"budget_bytes":   vc.budget,
+		"ttl_seconds":    int(vc.ttl.Seconds()),
+		"evicted":        vc.evicted.Load(),
+		"expired":        vc.expired.Load(),
+		"expired_bytes":  vc.expiredBytes.Load(),
+		"bypassed":       vc.bypassed.Load(),
+		"bypassed_bytes": vc.bypassedBytes.Load(),
+	}
+}
+
+func (vc *variantCache) diskPath(key string) string {
+	return filepath.Join(diskCacheDir, vc.name, fmt.Sprintf("%x", sha256.Sum256([]byte(key))))
+}
+
+// Disk entries are a header line, "<content type>[ gzip]", followed by the
+// data; the file's mtime is the entry timestamp. Already-compressed formats
+// (JPEG, GIF) are stored as-is.
+func (vc *variantCache) diskGet(key string) (CachedImage, bool) {
+	if diskCacheDir == "" {
+		return CachedImage{}, false
+	}
+	f, err := os.Open(vc.diskPath(key))
+	if err != nil {
+		return CachedImage{}, false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return CachedImage{}, false
+	}
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return CachedImage{}, false
+	}
+	contentType, encoding, _ := strings.Cut(strings.TrimSuffix(header, "\n"), " ")
+
+	var body io.Reader = r
+	if encoding == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return CachedImage{}, false
+		}
+		defer zr.Close()
+		body = zr
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return CachedImage{}, false
+	}
+	vc.trackDiskKey(key)
+	return CachedImage{
+		Data:        data,
+		ContentType: contentType,
+		Timestamp:   info.ModTime(),
+	}, true
+}
+
+func (vc *variantCache) diskPut(key string, img CachedImage) bool {
+	if diskCacheDir == "" {
+		return false
+	}
+
+	header, body := img.ContentType, img.Data
+	if diskCacheCompression == "gzip" && img.ContentType != "image/jpeg" && img.ContentType != "image/gif" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(img.Data)
+		if err := zw.Close(); err == nil && buf.Len() < len(img.Data) {
+			header, body = img.ContentType+" gzip", buf.Bytes()
+		}
+	}
+
+	data := append([]byte(header+"\n"), body...)
+	if err := writeAssetFile(vc.diskPath(key), data); err != nil {
+		log.Printf("[cache] failed to write %s disk entry: %v", vc.name, err)
+		return false
+	}
+	vc.trackDiskKey(key)
+	return true
+}
+
+func (vc *variantCache) trackDiskKey(key string) {
+	vc.mu.Lock()
+	vc.diskKeys[filepath.Base(vc.diskPath(key))] = key
+	vc.mu.Unlock()
+}
+
+// configure applies <PREFIX>_CACHE_MB or <PREFIX>_CACHE_BYTES,
+// <PREFIX>_CACHE_TTL (seconds) and SWR_<PREFIX>S, where prefix is the
+// singular kind: AVATAR_CACHE_MB, AVATAR_CACHE_TTL and SWR_AVATARS for
+// avatarCache, the BANNER_ variables and SWR_BANNERS for bannerCache.
+func (vc *variantCache) configure(prefix string) {
+	if n, err := strconv.ParseInt(os.Getenv(prefix+"_CACHE_MB"), 10, 64); err == nil && n > 0 {
+		vc.budget = n * 1024 * 1024
+	}
+	if n, err := strconv.ParseInt(os.Getenv(prefix+"_CACHE_BYTES"), 10, 64); err == nil && n > 0 {
+		vc.budget = n
+	}
+	if n, err := strconv.Atoi(os.Getenv(prefix + "_CACHE_TTL")); err == nil && n > 0 {
+		vc.ttl = time.Duration(n) * time.Second
+	}
+	vc.swr = mustEnv("SWR_"+prefix+"S", "true") == "true"
+}
+
+func cacheStatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"avatars":         avatarCache.Stats(),
+		"banners":         bannerCache.Stats(),
+		"max_entry_bytes": maxCacheEntryBytes,
+		"disk_cache":      diskCacheDir != "",
+		"load_shedding":   loadSheddingStats(),
+	})
+}
+
+// setCacheStatus emits X-Cache and Age so CDN and origin caching can be told
+// apart from the browser dev tools.
+func setCacheStatus(c *gin.Context, status string, stored time.Time) {
+	age := 0
+	if !stored.IsZero() {
+		age = int(time.Since(stored).Seconds())
+	}
+	c.Header("X-Cache", status)
+	c.Header("Age", strconv.Itoa(age))
+}
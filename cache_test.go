@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvalidateDropsOnlyThatUser(t *testing.T) {
+	oldDir := diskCacheDir
+	diskCacheDir = t.TempDir()
+	t.Cleanup(func() { diskCacheDir = oldDir })
+
+	avatars := newVariantCache("avatars", 1<<20, time.Hour)
+	banners := newVariantCache("banners", 1<<20, time.Hour)
+	banners.sourcePrefix = "banner-"
+	img := CachedImage{Data: []byte("x"), ContentType: "image/png", Timestamp: time.Now()}
+	spec := TransformSpec{Size: 64}
+
+	avatarKeys := map[string]bool{
+		spec.Key("alice-1700000000"):                  true,
+		TransformSpec{}.Key("alice-1700000001"):       true,
+		spec.Key("alice-5-1700000000"):                false,
+		TransformSpec{}.Key("alice-5-1700000000"):     false,
+		spec.Key("alicia-1700000000"):                 false,
+		spec.Key("default-1700000000"):                false,
+		TransformSpec{Size: 64}.Key("bob-1700000000"): false,
+	}
+	for key := range avatarKeys {
+		avatars.Put(key, img)
+	}
+	onDisk := spec.Key("alice-1699999999")
+	avatars.diskPut(onDisk, img)
+	avatarKeys[onDisk] = true
+
+	bannerKeys := map[string]bool{
+		spec.Key("banner-alice-1700000000"):      true,
+		spec.Key("banner-alice@wide-1700000000"): true,
+		spec.Key("banner-alice-5-1700000000"):    false,
+	}
+	for key := range bannerKeys {
+		banners.Put(key, img)
+	}
+
+	avatars.Invalidate("alice")
+	banners.Invalidate("alice")
+	for _, c := range []struct {
+		vc   *variantCache
+		keys map[string]bool
+	}{{avatars, avatarKeys}, {banners, bannerKeys}} {
+		for key, dropped := range c.keys {
+			if _, ok := c.vc.Get(key); ok == dropped {
+				t.Errorf("%s %q cached = %t after Invalidate(alice), want %t", c.vc.name, key, ok, !dropped)
+			}
+		}
+	}
+
+	banners.Put(spec.Key("banner-alice-1700000000"), img)
+	banners.Put(spec.Key("banner-alice@wide-1700000000"), img)
+	banners.Invalidate("alice@wide")
+	if _, ok := banners.Get(spec.Key("banner-alice@wide-1700000000")); ok {
+		t.Error("Invalidate(alice@wide) kept the slot's variant")
+	}
+	if _, ok := banners.Get(spec.Key("banner-alice-1700000000")); !ok {
+		t.Error("Invalidate(alice@wide) dropped the main banner's variant")
+	}
+}
+
+func TestConfigureEnvNames(t *testing.T) {
+	t.Setenv("BANNER_CACHE_MB", "3")
+	t.Setenv("BANNER_CACHE_TTL", "90")
+	t.Setenv("SWR_BANNERS", "false")
+	vc := newVariantCache("banners", 1, time.Second)
+	vc.configure("BANNER")
+	if vc.budget != 3*1024*1024 || vc.ttl != 90*time.Second || vc.swr {
+		t.Errorf("configure(BANNER) = budget %d, ttl %s, swr %t", vc.budget, vc.ttl, vc.swr)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache classes decide the browser/CDN TTL of a response, each overridable
+// with CACHE_TTL_<CLASS> in seconds. Originals and stale-able variants keep
+// a zero max-age because their URLs do not change on re-upload; they are
+// revalidated against the ETag instead.
+const (
+	cacheOriginal  = "original"
+	cacheTransform = "transform"
+	cacheDefault   = "default"
+	cacheNegative  = "negative"
+)
+
+var cacheTTLs = map[string]int{
+	cacheOriginal:  0,
+	cacheTransform: 86400,
+	cacheDefault:   86400,
+	cacheNegative:  60,
+}
+
+func configureCacheTTLs() {
+	for class := range cacheTTLs {
+		if n, err := strconv.Atoi(os.Getenv("CACHE_TTL_" + strings.ToUpper(class))); err == nil && n >= 0 {
+			cacheTTLs[class] = n
+		}
+	}
+}
+
+// cacheControl is the Cache-Control value for a class. Negative results
+// (placeholders, failed transforms) are never revalidated, just refetched.
+func cacheControl(class string) string {
+	if class == cacheNegative {
+		return fmt.Sprintf("public, max-age=%d", cacheTTLs[class])
+	}
+	return fmt.Sprintf("public, max-age=%d, must-revalidate", cacheTTLs[class])
+}
+
+func setCachePolicy(c *gin.Context, class string) {
+	c.Header("Cache-Control", cacheControl(class))
+}
+
+// avatarVariantClass picks the class of a rendered avatar variant. Animated
+// variants follow the original so a new GIF shows up as soon as it does.
+func avatarVariantClass(contentType string, metaErr error) string {
+	switch {
+	case metaErr != nil:
+		return cacheDefault
+	case contentType == "image/gif":
+		return cacheOriginal
+	default:
+		return cacheTransform
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxChipLength = 12
+
+var (
+	chipBackground = color.RGBA{0, 0, 0, 170}
+	chipForeground = color.White
+)
+
+// parseChip validates the ?chip= text. An empty chip is no chip.
+func parseChip(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if utf8.RuneCountInString(v) > maxChipLength {
+		return "", fmt.Errorf("chip text must be at most %d characters", maxChipLength)
+	}
+	if err := checkRenderable(v); err != nil {
+		return "", fmt.Errorf("chip text: %w", err)
+	}
+	return v, nil
+}
+
+// chipLayout centres the chip along the bottom of canvas, inset far enough
+// that a fully rounded avatar does not clip it. The text shrinks until the
+// chip fits within 80% of the width.
+func chipLayout(canvas image.Rectangle, text string) (chip image.Rectangle, textAt image.Point, lineHeight int) {
+	w, h := canvas.Dx(), canvas.Dy()
+
+	lineHeight = max(h/10, 8)
+	for lineHeight > 6 && textWidth(text, lineHeight)+lineHeight > w*8/10 {
+		lineHeight--
+	}
+
+	padX, padY := lineHeight/2, lineHeight/4
+	cw := textWidth(text, lineHeight) + 2*padX
+	ch := lineHeight + 2*padY
+
+	chip = image.Rect(0, 0, cw, ch).Add(image.Pt(canvas.Min.X+(w-cw)/2, canvas.Max.Y-ch-h/12))
+	return chip, chip.Min.Add(image.Pt(padX, padY)), lineHeight
+}
+
+// drawChip composites a pill with text onto dst, laid out against canvas.
+// dst may cover only part of the canvas, as GIF frames do.
+func drawChip(dst draw.Image, canvas image.Rectangle, text string) {
+	chip, textAt, lineHeight := chipLayout(canvas, text)
+
+	pill := image.NewAlpha(image.Rect(0, 0, chip.Dx(), chip.Dy()))
+	mask := newRoundedMask(chip.Dx(), chip.Dy(), Radius{Value: 50, Percent: true})
+	for y := 0; y < chip.Dy(); y++ {
+		for x := 0; x < chip.Dx(); x++ {
+			if mask.Contains(x, y) {
+				pill.SetAlpha(x, y, color.Alpha{A: 255})
+			}
+		}
+	}
+
+	draw.DrawMask(dst, chip, image.NewUniform(chipBackground), image.Point{}, pill, image.Point{}, draw.Over)
+	drawText(dst, textAt, text, lineHeight, chipForeground)
+}
+
+// chipImage returns a copy of img with the chip drawn on it.
+func chipImage(img image.Image, text string) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	drawChip(dst, bounds, text)
+	return dst
+}
+
+// chipGIF draws the chip onto every frame in place. Frames are paletted, so
+// the pill blends to the nearest palette colours.
+func chipGIF(g *gif.GIF, text string) {
+	canvas := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, frame := range g.Image {
+		drawChip(frame, canvas, text)
+	}
+}
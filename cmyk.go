@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"strings"
+)
+
+// adobeCMYKMarker is an APP14 segment declaring plain (untransformed) CMYK.
+var adobeCMYKMarker = []byte{
+	0xff, 0xee, 0x00, 0x0e,
+	'A', 'd', 'o', 'b', 'e',
+	0x00, 0x64, 0x00, 0x00, 0x00, 0x00,
+	0x00,
+}
+
+// decodeImage is image.Decode for uploaded images. CMYK JPEGs, as
+// exported by Photoshop and print tools, come back converted to RGB so the
+// resize and encode paths only ever see RGB. 4-component JPEGs without the
+// Adobe APP14 segment, which the standard decoder refuses, are decoded as
+// plain CMYK.
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	var unsupported jpeg.UnsupportedError
+	if format == "jpeg" && errors.As(err, &unsupported) && strings.Contains(string(unsupported), "Adobe APP14") {
+		img, err = decodeBareCMYK(data)
+	}
+	if err != nil {
+		return nil, format, err
+	}
+	if cmyk, ok := img.(*image.CMYK); ok {
+		img = toRGBA(cmyk)
+	}
+	return img, format, nil
+}
+
+// decodeBareCMYK decodes a 4-component JPEG that lacks APP14 by adding
+// one. The decoder then applies Adobe's inverted-ink convention, which
+// files without the marker don't use, so the channels are flipped back.
+func decodeBareCMYK(data []byte) (image.Image, error) {
+	if len(data) < 2 {
+		return nil, jpeg.FormatError("missing SOI marker")
+	}
+	patched := make([]byte, 0, len(data)+len(adobeCMYKMarker))
+	patched = append(patched, data[:2]...)
+	patched = append(patched, adobeCMYKMarker...)
+	patched = append(patched, data[2:]...)
+
+	img, err := jpeg.Decode(bytes.NewReader(patched))
+	if err != nil {
+		return nil, err
+	}
+	cmyk, ok := img.(*image.CMYK)
+	if !ok {
+		return img, nil
+	}
+	for i := range cmyk.Pix {
+		cmyk.Pix[i] = 255 - cmyk.Pix[i]
+	}
+	return cmyk, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runCommand handles maintenance subcommands such as `avatars migrate-layout`.
+// It returns false when args do not name a command and the server should start.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case "migrate-shards":
+		err = migrateLayout(layoutSharded)
+	case "migrate-layout":
+		fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+		to := fs.String("to", layoutUser, "target layout: flat, sharded or user")
+		fs.Parse(args[1:])
+		err = migrateLayout(*to)
+	case "import-legacy":
+		fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+		dir := fs.String("dir", "", "directory containing the legacy avatar dump")
+		fs.Parse(args[1:])
+		if *dir == "" {
+			fmt.Fprintln(os.Stderr, "import-legacy: --dir is required")
+			os.Exit(2)
+		}
+		loadAssetIndex()
+		err = importLegacy(*dir)
+	default:
+		return false
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// Overlay compositing. Both the avatar and the overlay are reduced to a
+// timeline of fully composited frames; a still image is a single frame with
+// no duration. When both are animated the result loops over the least
+// common multiple of the two loop lengths (capped), so neither animation
+// jumps at the seam.
+
+const (
+	// maxComposeDuration caps the merged loop, in 1/100 s.
+	maxComposeDuration = 2000
+	maxComposeFrames   = 200
+	// defaultFrameDelay is what browsers use for GIF delays below 2.
+	defaultFrameDelay = 10
+)
+
+type frameTimeline struct {
+	frames []image.Image
+	delays []int // 1/100 s; nil for stills
+}
+
+func (t frameTimeline) duration() int {
+	total := 0
+	for _, d := range t.delays {
+		total += d
+	}
+	return total
+}
+
+// at returns the frame shown at time cs into the loop.
+func (t frameTimeline) at(cs int) image.Image {
+	if len(t.delays) == 0 {
+		return t.frames[0]
+	}
+	cs %= t.duration()
+	for i, d := range t.delays {
+		if cs < d {
+			return t.frames[i]
+		}
+		cs -= d
+	}
+	return t.frames[len(t.frames)-1]
+}
+
+func decodeTimeline(data []byte) (frameTimeline, error) {
+	if !bytes.HasPrefix(data, []byte("GIF8")) {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return frameTimeline{}, err
+		}
+		return frameTimeline{frames: []image.Image{img}}, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return frameTimeline{}, fmt.Errorf("decoding gif: %w", err)
+	}
+	var t frameTimeline
+	walkComposited(g, func(i int, canvas *image.RGBA) {
+		t.frames = append(t.frames, cloneRGBA(canvas))
+		delay := defaultFrameDelay
+		if i < len(g.Delay) && g.Delay[i] >= 2 {
+			delay = g.Delay[i]
+		}
+		t.delays = append(t.delays, delay)
+	})
+	if len(t.frames) == 1 {
+		t.delays = nil
+	}
+	return t, nil
+}
+
+// still keeps only the first frame.
+func (t frameTimeline) still() frameTimeline {
+	return frameTimeline{frames: t.frames[:1]}
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// mergeTimelines returns the cut points where either timeline changes frame,
+// as (start, delay) pairs covering one loop of the combined animation.
+func mergeTimelines(a, b frameTimeline) (starts, delays []int) {
+	da, db := a.duration(), b.duration()
+	total := max(da, db)
+	if da > 0 && db > 0 {
+		total = min(da/gcd(da, db)*db, max(maxComposeDuration, da, db))
+	}
+	if total == 0 {
+		return []int{0}, nil
+	}
+
+	cuts := map[int]bool{0: true}
+	for _, t := range []frameTimeline{a, b} {
+		if len(t.delays) == 0 {
+			continue
+		}
+		for loop := 0; loop < total; loop += t.duration() {
+			at := loop
+			for _, d := range t.delays {
+				if at < total {
+					cuts[at] = true
+				}
+				at += d
+			}
+		}
+	}
+
+	for cs := 0; cs < total; cs++ {
+		if cuts[cs] {
+			starts = append(starts, cs)
+		}
+	}
+	for i, s := range starts {
+		end := total
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		delays = append(delays, end-s)
+	}
+	if len(starts) > maxComposeFrames {
+		starts, delays = starts[:maxComposeFrames], delays[:maxComposeFrames]
+	}
+	return starts, delays
+}
+
+var (
+	overlayAssets     = make(map[string]frameTimeline)
+	overlayAssetMutex sync.Mutex
+)
+
+func loadOverlayAsset(o Overlay) (frameTimeline, error) {
+	overlayAssetMutex.Lock()
+	defer overlayAssetMutex.Unlock()
+	if t, ok := overlayAssets[o.Name]; ok {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(overlayDir, o.Name))
+	if err != nil {
+		return frameTimeline{}, err
+	}
+	t, err := decodeTimeline(data)
+	if err != nil {
+		return frameTimeline{}, err
+	}
+	overlayAssets[o.Name] = t
+	return t, nil
+}
+
+// renderComposite applies spec to an avatar with an overlay. Crop is
+// applied to the avatar before the overlay goes on; size, chip and radius
+// apply to every output frame. The result is a GIF when either side
+// animates (unless spec.OverlayStill), else PNG with a radius or JPEG.
+func renderComposite(ctx context.Context, data []byte, spec TransformSpec) (CachedImage, error) {
+	o, ok := findOverlay(spec.Overlay)
+	if !ok {
+		return CachedImage{}, fmt.Errorf("unknown overlay %q", spec.Overlay)
+	}
+
+	_, sp := startSpan(ctx, "decode")
+	avatar, err := decodeTimeline(data)
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return CachedImage{}, err
+	}
+
+	overlay, err := loadOverlayAsset(o)
+	if err != nil {
+		return CachedImage{}, fmt.Errorf("loading overlay %s: %w", o.Name, err)
+	}
+	if spec.OverlayStill {
+		avatar, overlay = avatar.still(), overlay.still()
+	}
+	if spec.Crop != [2]int{} {
+		_, sp = startSpan(ctx, "crop")
+		avatar.frames = fitFrames(avatar.frames, spec.Crop[0], spec.Crop[1], spec.Fit, spec.Gravity, spec.focus)
+		sp.End()
+	}
+
+	data, err = composeFrames(ctx, avatar, overlay, o, spec)
+	if err != nil {
+		return CachedImage{}, err
+	}
+
+	contentType := "image/jpeg"
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		contentType = "image/gif"
+		if data, err = limitGIFOutput(ctx, data); err != nil {
+			return CachedImage{}, err
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		contentType = "image/png"
+	}
+	return CachedImage{ContentType: contentType, Data: data, Timestamp: time.Now()}, nil
+}
+
+func composeFrames(ctx context.Context, avatar, overlay frameTimeline, o Overlay, spec TransformSpec) ([]byte, error) {
+	starts, delays := mergeTimelines(avatar, overlay)
+
+	base := avatar.frames[0].Bounds()
+	width := base.Dx()
+	if spec.Size > 0 && spec.Crop == [2]int{} {
+		width = spec.Size
+	}
+	height := base.Dy() * width / base.Dx()
+	scale := float64(width) / float64(avatarSize())
+	ow, oh := int(float64(o.Size[0])*scale), int(float64(o.Size[1])*scale)
+	at := image.Pt(int(float64(o.Offset[0])*scale), int(float64(o.Offset[1])*scale))
+
+	_, sp := startSpan(ctx, "overlay")
+	sp.SetAttr("frames", len(starts))
+	frames := make([]*image.RGBA, len(starts))
+	for i, cs := range starts {
+		frame := image.NewRGBA(image.Rect(0, 0, width, height))
+		src := resize.Resize(uint(width), uint(height), avatar.at(cs), resize.Lanczos3)
+		draw.Draw(frame, frame.Bounds(), src, src.Bounds().Min, draw.Src)
+
+		layer := resize.Resize(uint(ow), uint(oh), overlay.at(cs), resize.Bilinear)
+		draw.Draw(frame, layer.Bounds().Sub(layer.Bounds().Min).Add(at), layer, layer.Bounds().Min, draw.Over)
+
+		if spec.Chip != "" {
+			drawChip(frame, frame.Bounds(), spec.Chip)
+		}
+		applyRoundedMask(frame, spec.Radius)
+		frames[i] = frame
+	}
+	sp.End()
+
+	_, sp = startSpan(ctx, "encode")
+	defer sp.End()
+	var buf bytes.Buffer
+	var err error
+	switch {
+	case len(frames) > 1:
+		g := &gif.GIF{Delay: delays}
+		for _, frame := range frames {
+			g.Image = append(g.Image, quantizeFrame(frame, 255))
+			g.Disposal = append(g.Disposal, gif.DisposalNone)
+		}
+		err = gif.EncodeAll(&buf, g)
+	case !spec.Radius.IsZero():
+		err = png.Encode(&buf, frames[0])
+	default:
+		err = encodeJPEG(&buf, frames[0])
+	}
+	sp.RecordError(err)
+	return buf.Bytes(), err
+}
+
+// quantizeFrame reduces a frame to its own palette of up to n colours plus
+// a transparent entry for masked pixels, so n is at most 255.
+func quantizeFrame(frame *image.RGBA, n int) *image.Paletted {
+	colors := extractPalette(frame, n)
+	if len(colors) == 0 {
+		colors = palette.WebSafe
+	}
+	pal := append(slices.Clone(colors), color.Transparent)
+	transparent := uint8(len(pal) - 1)
+
+	paletted := image.NewPaletted(frame.Bounds(), pal[:transparent])
+	draw.FloydSteinberg.Draw(paletted, frame.Bounds(), frame, image.Point{})
+	paletted.Palette = pal
+
+	b := frame.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if frame.RGBAAt(x, y).A == 0 {
+				paletted.SetColorIndex(x, y, transparent)
+			}
+		}
+	}
+	return paletted
+}
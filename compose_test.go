@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestCropAppliesWithOverlayAndStrip(t *testing.T) {
+	oldOverlays := overlays
+	t.Cleanup(func() {
+		overlays = oldOverlays
+		overlayAssetMutex.Lock()
+		delete(overlayAssets, "test-frame.png")
+		overlayAssetMutex.Unlock()
+	})
+	overlays = []Overlay{{Name: "test-frame.png", Size: [2]int{avatarSize(), avatarSize()}}}
+	overlayAssetMutex.Lock()
+	overlayAssets["test-frame.png"] = frameTimeline{frames: []image.Image{image.NewRGBA(image.Rect(0, 0, 32, 32))}}
+	overlayAssetMutex.Unlock()
+
+	var src bytes.Buffer
+	jpeg.Encode(&src, image.NewRGBA(image.Rect(0, 0, 256, 256)), nil)
+
+	tests := []struct {
+		name string
+		spec TransformSpec
+		w, h int
+	}{
+		{"overlay", TransformSpec{Overlay: "test-frame.png", Crop: [2]int{120, 60}}, 120, 60},
+		{"overlay contain", TransformSpec{Overlay: "test-frame.png", Crop: [2]int{60, 120}, Fit: fitContain}, 60, 120},
+		{"overlay crop wins over size", TransformSpec{Overlay: "test-frame.png", Crop: [2]int{50, 50}, Size: 128}, 50, 50},
+		{"strip", TransformSpec{Strip: 3, Crop: [2]int{40, 20}}, 120, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variant, err := renderAvatarData(context.Background(), src.Bytes(), "image/jpeg", tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(variant.Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.w || cfg.Height != tt.h {
+				t.Errorf("got %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.w, tt.h)
+			}
+		})
+	}
+}
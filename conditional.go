@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseETags splits an If-None-Match value into its entity tags, keeping the
+// W/ prefix and quotes. Entity tags may contain commas, so this walks the
+// quoted strings rather than splitting on ','.
+func parseETags(header string) []string {
+	var tags []string
+	for i := 0; i < len(header); {
+		switch header[i] {
+		case ' ', '\t', ',':
+			i++
+			continue
+		}
+
+		start := i
+		if strings.HasPrefix(header[i:], "W/") {
+			i += 2
+		}
+		if i >= len(header) || header[i] != '"' {
+			// not an entity tag; skip to the next list element
+			for i < len(header) && header[i] != ',' {
+				i++
+			}
+			continue
+		}
+		end := strings.IndexByte(header[i+1:], '"')
+		if end < 0 {
+			break
+		}
+		i += end + 2
+		tags = append(tags, header[start:i])
+	}
+	return tags
+}
+
+// etagMatches applies the weak comparison RFC 9110 requires for
+// If-None-Match: "*" matches any current representation, and W/ prefixes
+// are ignored on both sides.
+func etagMatches(header, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range parseETags(header) {
+		if strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether the request's If-None-Match matches etag, a
+// quoted entity tag, and if so responds 304.
+func notModified(c *gin.Context, etag string) bool {
+	if !etagMatches(c.GetHeader("If-None-Match"), etag) {
+		return false
+	}
+	c.Header("ETag", etag)
+	c.Status(304)
+	return true
+}
+
+// setUploadValidators sets the ETag and Last-Modified a plain GET of the
+// just-stored asset will return, so clients can seed their cache from the
+// upload response. Avatars with a saved overlay are rendered on GET and
+// get no ETag here.
+func setUploadValidators(c *gin.Context, kind, key string) {
+	meta, ok, _ := lookupAsset(kind, key)
+	if !ok {
+		return
+	}
+	if _, overlaid := findOverlay(meta.Overlay); !overlaid || kind != "avatar" {
+		c.Header("ETag", fmt.Sprintf(`"%s"`, meta.Etag()))
+	}
+	c.Header("Last-Modified", meta.UpdatedAt.UTC().Format(http.TimeFormat))
+}
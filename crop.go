@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nfnt/resize"
+)
+
+var errInvalidFocus = errors.New("focus must be two fractions between 0 and 1")
+
+// Focus is a focal point as fractions of the source width and height.
+// Crops are centred on it as far as the image edges allow.
+type Focus [2]float64
+
+var centerFocus = Focus{0.5, 0.5}
+
+func parseFocus(f *Focus) (Focus, error) {
+	if f == nil {
+		return centerFocus, nil
+	}
+	for _, v := range f {
+		if v < 0 || v > 1 {
+			return Focus{}, errInvalidFocus
+		}
+	}
+	return *f, nil
+}
+
+// cropWindow returns the largest rectangle inside b with the aspect ratio
+// w:h, placed around focus.
+func cropWindow(b image.Rectangle, w, h int, focus Focus) image.Rectangle {
+	cw, ch := b.Dx(), b.Dx()*h/w
+	if ch > b.Dy() {
+		cw, ch = b.Dy()*w/h, b.Dy()
+	}
+	cw, ch = max(cw, 1), max(ch, 1)
+	x := b.Min.X + int(focus[0]*float64(b.Dx())) - cw/2
+	y := b.Min.Y + int(focus[1]*float64(b.Dy())) - ch/2
+	x = max(b.Min.X, min(x, b.Max.X-cw))
+	y = max(b.Min.Y, min(y, b.Max.Y-ch))
+	return image.Rect(x, y, x+cw, y+ch)
+}
+
+func cropJSON(r image.Rectangle) gin.H {
+	return gin.H{"x": r.Min.X, "y": r.Min.Y, "width": r.Dx(), "height": r.Dy()}
+}
+
+// cropImage crops img to r and scales the result to w by h.
+func cropImage(img image.Image, r image.Rectangle, w, h int) image.Image {
+	var cropped image.Image
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		cropped = sub.SubImage(r)
+	} else {
+		cropped = toRGBA(img).SubImage(r)
+	}
+	return resize.Resize(uint(w), uint(h), progressiveDownscale(cropped, uint(w), uint(h)), resize.Lanczos3)
+}
+
+// squareCrop centre-crops img to a square at its shorter side.
+func squareCrop(img image.Image) image.Image {
+	b := img.Bounds()
+	if b.Dx() == b.Dy() {
+		return img
+	}
+	side := min(b.Dx(), b.Dy())
+	return cropImage(img, cropWindow(b, side, side, centerFocus), side, side)
+}
+
+// squareCropGIF centre-crops an animated image to a square, returning it
+// unchanged when it already is one.
+func squareCropGIF(data []byte) ([]byte, error) {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width == cfg.Height {
+		return data, nil
+	}
+	side := min(cfg.Width, cfg.Height)
+	cropped, _, err := cropGIFReader(bytes.NewReader(data), side, side, centerFocus)
+	return cropped, err
+}
+
+// cropGIFReader crops an animated upload to w:h around focus and scales it
+// to w by h. GIFs that already have the right shape keep the plain resize;
+// others are composited frame by frame, since a crop can cut away a frame's
+// whole sub-rectangle.
+func cropGIFReader(r io.Reader, w, h int, focus Focus) ([]byte, image.Rectangle, error) {
+	src, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	bounds := image.Rect(0, 0, src.Config.Width, src.Config.Height)
+	window := cropWindow(bounds, w, h, focus)
+	if window == bounds {
+		data, err := resizeDecodedGIF(src, w, h)
+		return data, window, err
+	}
+
+	out := &gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(src.Image)),
+		Delay:     src.Delay,
+		LoopCount: src.LoopCount,
+		Config:    image.Config{Width: w, Height: h},
+	}
+	walkComposited(src, func(i int, canvas *image.RGBA) {
+		out.Image = append(out.Image, quantizeFrame(toRGBA(cropImage(canvas, window, w, h)), 255))
+	})
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	return buf.Bytes(), window, nil
+}
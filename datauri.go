@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dataURIHandler serves the (transformed) avatar as a data: URI in a plain
+// text body, for Scratch-based clients that cannot load cross-origin images
+// but can fetch text.
+func dataURIHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+
+	spec, err := parseTransformSpec(c, "avatar")
+	if err != nil {
+		invalidTransform(c, err)
+		return
+	}
+
+	variant, etag, err := avatarVariant(c.Request.Context(), username, spec)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error transforming image"})
+		return
+	}
+
+	etag = strings.TrimSuffix(etag, `"`) + `-datauri"`
+	if notModified(c, etag) {
+		return
+	}
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age=0, must-revalidate")
+	c.String(http.StatusOK, "data:%s;base64,%s", variant.ContentType, base64.StdEncoding.EncodeToString(variant.Data))
+}
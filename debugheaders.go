@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Debug headers describe how a transformed response was produced. They are
+// sent when DEBUG_HEADERS is set, or per request with the admin token in
+// ?ADMIN_TOKEN= or X-Admin-Token.
+
+var debugHeaders bool
+
+type pipelineKey struct{}
+
+type pipeline struct {
+	mu            sync.Mutex
+	start         time.Time
+	steps         []string
+	width, height int
+}
+
+func wantsDebugHeaders(c *gin.Context) bool {
+	if debugHeaders {
+		return true
+	}
+	if ADMIN_TOKEN == "" {
+		return false
+	}
+	return c.GetHeader("X-Admin-Token") == ADMIN_TOKEN || c.Query("ADMIN_TOKEN") == ADMIN_TOKEN
+}
+
+// startPipeline attaches a step recorder to the request context when debug
+// headers were asked for. Every span started from that context is recorded.
+func startPipeline(c *gin.Context) {
+	if !wantsDebugHeaders(c) {
+		return
+	}
+	ctx := context.WithValue(c.Request.Context(), pipelineKey{}, &pipeline{start: time.Now()})
+	c.Request = c.Request.WithContext(ctx)
+}
+
+func recordPipelineStep(ctx context.Context, name string) {
+	p, ok := ctx.Value(pipelineKey{}).(*pipeline)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	// per-frame steps collapse into one entry
+	if len(p.steps) == 0 || p.steps[len(p.steps)-1] != name {
+		p.steps = append(p.steps, name)
+	}
+	p.mu.Unlock()
+}
+
+// setPipelineSource records the source dimensions for X-Source-Dimensions.
+func setPipelineSource(c *gin.Context, width, height int) {
+	if p, ok := c.Request.Context().Value(pipelineKey{}).(*pipeline); ok {
+		p.mu.Lock()
+		p.width, p.height = width, height
+		p.mu.Unlock()
+	}
+}
+
+// setPipelineHeaders writes the debug headers; call it before the body.
+func setPipelineHeaders(c *gin.Context) {
+	p, ok := c.Request.Context().Value(pipelineKey{}).(*pipeline)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c.Header("X-Transform-Time", fmt.Sprintf("%.2fms", float64(time.Since(p.start).Microseconds())/1000))
+	c.Header("X-Pipeline", strings.Join(p.steps, ","))
+	if p.width > 0 && p.height > 0 {
+		c.Header("X-Source-Dimensions", fmt.Sprintf("%dx%d", p.width, p.height))
+	}
+}
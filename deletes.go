@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authorizeOwner allows a request with ADMIN_TOKEN or the owner's own user
+// token, responding with an error and returning false otherwise.
+func authorizeOwner(c *gin.Context, username string) bool {
+	if ADMIN_TOKEN != "" && c.Query("ADMIN_TOKEN") == ADMIN_TOKEN {
+		return true
+	}
+	user := tokenUser(c)
+	if user == nil {
+		return false
+	}
+	if !strings.EqualFold(user.Username, username) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token does not belong to this user"})
+		return false
+	}
+	return true
+}
+
+// deleteAvatarHandler removes a user's avatar and everything derived from
+// it, so the default is served again.
+func deleteAvatarHandler(c *gin.Context) {
+	username, _ := strings.CutSuffix(strings.ToLower(c.Param("username")), ".gif")
+	audit := AuditEntry{Action: "delete", Asset: "avatar", Username: username}
+	defer auditRequest(c, &audit)
+
+	if !authorizeOwner(c, username) {
+		return
+	}
+	if _, _, _, err := getAvatarMetadata(username); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No avatar to delete"})
+		return
+	}
+
+	// kept in the history, so a deleted avatar can be reverted to
+	archiveAvatar(username)
+	deleteAvatars(username)
+	removeDeletedAsset("avatar", username)
+	avatarCache.Invalidate(username)
+	c.Status(http.StatusNoContent)
+}
+
+// deleteBannerHandler removes a user's banner, or one named slot.
+func deleteBannerHandler(c *gin.Context) {
+	username, _ := strings.CutSuffix(strings.ToLower(c.Param("username")), ".gif")
+	slot, err := parseBannerSlot(c.Param("slot"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	key := bannerKey(username, slot)
+	audit := AuditEntry{Action: "delete", Asset: "banner", Username: key}
+	defer auditRequest(c, &audit)
+
+	if !authorizeOwner(c, username) {
+		return
+	}
+	if _, _, _, _, err := getBannerPath(key); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No banner to delete"})
+		return
+	}
+
+	if err := deleteBanners(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting banner"})
+		return
+	}
+	removeDeletedAsset("banner", key)
+	bannerCache.Invalidate(key)
+	c.Status(http.StatusNoContent)
+}
+
+// removeDeletedAsset clears what outlives a deleted asset's files: its alt
+// text, the backend and dual-write copies and the peers' caches.
+func removeDeletedAsset(kind, key string) {
+	setAltText(kind, key, "")
+	removeBackendFormats(kind, key, "")
+	if secondaryStore != nil {
+		for _, ext := range []string{".gif", ".jpg"} {
+			secondaryStore.Delete(kind, key, ext)
+		}
+	}
+	notifyPeers(kind, key)
+}
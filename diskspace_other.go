@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func volumeSpace(path string) (total, free uint64, err error) {
+	return 0, 0, errors.New("volume size is not available on this platform")
+}
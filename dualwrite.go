@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"log"
+	"os"
+	"time"
+)
+
+// AssetStore is a place assets are kept: the local storage root, the
+// dual-write target, or the authoritative STORAGE_BACKEND. Get and Stat
+// return os.ErrNotExist for missing assets.
+type AssetStore interface {
+	Name() string
+	Put(kind, username, ext string, data []byte) error
+	Get(kind, username, ext string) ([]byte, error)
+	Stat(kind, username, ext string) (StoredObject, error)
+	Delete(kind, username, ext string) error
+}
+
+// StoredObject describes an asset held by an AssetStore.
+type StoredObject struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// dirStore keeps assets under another root directory and layout.
+type dirStore struct {
+	root   string
+	layout string
+}
+
+func (d dirStore) Name() string {
+	return "dir:" + d.root
+}
+
+func (d dirStore) path(kind, username, ext string) string {
+	return assetPathAt(d.root, d.layout, kind, username, ext)
+}
+
+func (d dirStore) Put(kind, username, ext string, data []byte) error {
+	if !validUsername(username) {
+		return errInvalidUsername
+	}
+	return writeAssetFile(d.path(kind, username, ext), data)
+}
+
+func (d dirStore) Get(kind, username, ext string) ([]byte, error) {
+	return os.ReadFile(d.path(kind, username, ext))
+}
+
+func (d dirStore) Stat(kind, username, ext string) (StoredObject, error) {
+	info, err := os.Stat(d.path(kind, username, ext))
+	if err != nil {
+		return StoredObject{}, err
+	}
+	return StoredObject{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d dirStore) Delete(kind, username, ext string) error {
+	err := os.Remove(d.path(kind, username, ext))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// localStore is the local storage root, following the data directory and
+// STORAGE_LAYOUT as configured.
+type localStore struct{}
+
+func (localStore) dir() dirStore {
+	return dirStore{root: storageRoot(), layout: storageLayout}
+}
+
+func (l localStore) Name() string {
+	return "local"
+}
+
+func (l localStore) Put(kind, username, ext string, data []byte) error {
+	return l.dir().Put(kind, username, ext, data)
+}
+
+func (l localStore) Get(kind, username, ext string) ([]byte, error) {
+	return l.dir().Get(kind, username, ext)
+}
+
+func (l localStore) Stat(kind, username, ext string) (StoredObject, error) {
+	return l.dir().Stat(kind, username, ext)
+}
+
+func (l localStore) Delete(kind, username, ext string) error {
+	return l.dir().Delete(kind, username, ext)
+}
+
+// primaryStore holds the working copy every asset is served from.
+var primaryStore AssetStore = localStore{}
+
+var secondaryStore AssetStore
+
+// mirrorAsset copies a freshly stored asset to the secondary store and reads
+// it back, logging any discrepancy. Failures never fail the upload: primary
+// storage stays authoritative until reads are cut over.
+func mirrorAsset(kind, username, ext string, data []byte) {
+	if secondaryStore == nil {
+		return
+	}
+	key := assetKey(kind, username) + ext
+
+	for _, other := range []string{".gif", ".jpg"} {
+		if other != ext {
+			if err := secondaryStore.Delete(kind, username, other); err != nil {
+				log.Printf("[dual-write] %s: failed to delete %s copy on %s: %v", key, other, secondaryStore.Name(), err)
+			}
+		}
+	}
+
+	if err := secondaryStore.Put(kind, username, ext, data); err != nil {
+		log.Printf("[dual-write] %s: write to %s failed: %v", key, secondaryStore.Name(), err)
+		return
+	}
+
+	mirrored, err := secondaryStore.Get(kind, username, ext)
+	if err != nil {
+		log.Printf("[dual-write] %s: read-back from %s failed: %v", key, secondaryStore.Name(), err)
+		return
+	}
+	if sha256.Sum256(mirrored) != sha256.Sum256(data) {
+		log.Printf("[dual-write] %s: discrepancy on %s: primary %d bytes, secondary %d bytes", key, secondaryStore.Name(), len(data), len(mirrored))
+	}
+}
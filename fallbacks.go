@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/md5"
+	"embed"
+	"fmt"
+	"log"
+)
+
+// The fallback avatar and banner are built into the binary, in a light and
+// dark variant, so a fresh install without network access to the remote
+// default still serves something designed rather than a flat square.
+//
+//go:embed fallbacks/*.jpg
+var fallbackFiles embed.FS
+
+// fallbackAsset returns the embedded default for kind ("avatar" or
+// "banner") in a theme; an unknown theme gets the light one.
+func fallbackAsset(kind, theme string) CachedImage {
+	if theme != themeDark {
+		theme = themeLight
+	}
+	data, err := fallbackFiles.ReadFile("fallbacks/" + kind + "-" + theme + ".jpg")
+	if err != nil {
+		log.Printf("[fallbacks] missing embedded %s %s: %v", theme, kind, err)
+		return CachedImage{}
+	}
+	return CachedImage{Data: data, ContentType: "image/jpeg", Etag: fmt.Sprintf("%x", md5.Sum(data))}
+}
+
+// defaultBanner returns the default banner for a theme.
+func defaultBanner(theme string) []byte {
+	if theme == themeDark {
+		return darkDefaultBanner
+	}
+	return defaultBannerContent
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Feature stats count how often tier gates and paid features are hit, per
+// tier, so the gates can be tuned. They live in memory and reset on restart.
+const (
+	statGIFAccepted     = "gif_upload.accepted"
+	statGIFDowngraded   = "gif_upload.downgraded"
+	statSlotRejected    = "banner_slot.rejected"
+	statOverlayRejected = "overlay.rejected"
+	statOversized       = "upload.oversized"
+	statAnimatedServed  = "animated_avatar.served"
+)
+
+var (
+	featureCounts = make(map[string]map[string]int64)
+	featureSince  = time.Now()
+	featureMutex  sync.Mutex
+)
+
+// countFeature records one event. Tier is empty when it isn't known.
+func countFeature(event, kind, tier string) {
+	if kind != "" {
+		event = kind + "." + event
+	}
+	if tier == "" {
+		tier = "unknown"
+	}
+	featureMutex.Lock()
+	if featureCounts[event] == nil {
+		featureCounts[event] = make(map[string]int64)
+	}
+	featureCounts[event][tier]++
+	featureMutex.Unlock()
+}
+
+func countAnimatedServe(contentType string) {
+	if contentType == "image/gif" {
+		countFeature(statAnimatedServed, "", "")
+	}
+}
+
+func featureStatsHandler(c *gin.Context) {
+	featureMutex.Lock()
+	counts := make(map[string]map[string]int64, len(featureCounts))
+	for event, tiers := range featureCounts {
+		counts[event] = make(map[string]int64, len(tiers))
+		for tier, n := range tiers {
+			counts[event][tier] = n
+		}
+	}
+	featureMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"since": featureSince, "counts": counts})
+}
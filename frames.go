@@ -0,0 +1,110 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+)
+
+// maxScoredFrames bounds the work spent choosing a still from long GIFs.
+const maxScoredFrames = 32
+
+// decodeStill decodes an upload as a single image. Animated GIFs being
+// downgraded use their most representative frame rather than the first,
+// which is often a blank or intro frame.
+func decodeStill(r io.Reader, animated bool) (image.Image, error) {
+	if !animated {
+		img, _, err := decodeImage(r)
+		return img, err
+	}
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return representativeFrame(g), nil
+}
+
+// walkComposited calls fn with the fully composited canvas after each
+// frame, honouring disposal. The canvas is reused; copy it to keep it.
+func walkComposited(g *gif.GIF, fn func(i int, canvas *image.RGBA)) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(bounds)
+
+	for i, frame := range g.Image {
+		var prev *image.RGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			prev = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		fn(i, canvas)
+
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				draw.Draw(canvas, bounds, prev, image.Point{}, draw.Src)
+			}
+		}
+	}
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	copy(dst.Pix, img.Pix)
+	return dst
+}
+
+// representativeFrame returns the composited frame with the highest
+// luminance entropy, sampling at most maxScoredFrames frames. Ties go to the
+// earlier frame.
+func representativeFrame(g *gif.GIF) image.Image {
+	step := max(len(g.Image)/maxScoredFrames, 1)
+	var best *image.RGBA
+	bestScore := -1.0
+
+	walkComposited(g, func(i int, canvas *image.RGBA) {
+		if i%step != 0 {
+			return
+		}
+		if score := lumaEntropy(canvas); score > bestScore {
+			bestScore = score
+			best = cloneRGBA(canvas)
+		}
+	})
+
+	if best == nil {
+		return image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	}
+	return best
+}
+
+// lumaEntropy is the Shannon entropy of the luminance histogram, sampled on
+// a grid of roughly 64x64 points.
+func lumaEntropy(img *image.RGBA) float64 {
+	b := img.Bounds()
+	stepX, stepY := max(b.Dx()/64, 1), max(b.Dy()/64, 1)
+
+	var hist [256]int
+	total := 0
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			hist[color.GrayModel.Convert(img.RGBAAt(x, y)).(color.Gray).Y]++
+			total++
+		}
+	}
+
+	var entropy float64
+	for _, n := range hist {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
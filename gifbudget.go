@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+)
+
+// maxGIFOutputBytes caps the size of a transformed GIF, from MAX_GIF_OUTPUT;
+// zero disables the guard. Rounding and compositing can make a GIF several
+// times larger than its source, and such variants are re-encoded with
+// fewer colours and frames until they fit.
+var maxGIFOutputBytes int64 = 4 * 1024 * 1024
+
+// gifStepDowns are tried in order: a smaller palette first, then dropping
+// frames (keeping every nth) while stretching delays to keep the timing.
+var gifStepDowns = []struct {
+	colors    int
+	frameStep int
+}{
+	{64, 1},
+	{64, 2},
+	{32, 3},
+}
+
+var errGIFTooLarge = errors.New("transformed gif exceeds the output size limit")
+
+// limitGIFOutput returns data unchanged when it fits maxGIFOutputBytes and
+// otherwise the first step-down that does. When none fits it returns
+// errGIFTooLarge, so the caller falls back to the original.
+func limitGIFOutput(ctx context.Context, data []byte) ([]byte, error) {
+	if maxGIFOutputBytes <= 0 || int64(len(data)) <= maxGIFOutputBytes {
+		return data, nil
+	}
+	_, sp := startSpan(ctx, "gif.stepdown")
+	defer sp.End()
+	sp.SetAttr("bytes", len(data))
+
+	src, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		sp.RecordError(err)
+		return nil, fmt.Errorf("decoding gif: %w", err)
+	}
+	for _, step := range gifStepDowns {
+		out, err := encodeGIFStepDown(src, step.colors, step.frameStep)
+		if err != nil {
+			sp.RecordError(err)
+			return nil, err
+		}
+		if int64(len(out)) <= maxGIFOutputBytes {
+			sp.SetAttr("colors", step.colors)
+			sp.SetAttr("frame_step", step.frameStep)
+			requestLogger(ctx).Info("gif stepped down",
+				"bytes", len(data), "output_bytes", len(out), "colors", step.colors, "frame_step", step.frameStep)
+			return out, nil
+		}
+	}
+	sp.RecordError(errGIFTooLarge)
+	return nil, fmt.Errorf("%w: %d bytes", errGIFTooLarge, len(data))
+}
+
+// encodeGIFStepDown re-encodes every frameStep-th composited frame with a
+// palette of at most colors entries.
+func encodeGIFStepDown(src *gif.GIF, colors, frameStep int) ([]byte, error) {
+	out := &gif.GIF{
+		LoopCount: src.LoopCount,
+		Config:    image.Config{Width: src.Config.Width, Height: src.Config.Height},
+	}
+	walkComposited(src, func(i int, canvas *image.RGBA) {
+		delay := 0
+		if i < len(src.Delay) {
+			delay = src.Delay[i]
+		}
+		if i%frameStep != 0 {
+			out.Delay[len(out.Delay)-1] += delay
+			return
+		}
+		out.Image = append(out.Image, quantizeFrame(canvas, colors))
+		out.Delay = append(out.Delay, delay)
+		// every frame is a full canvas, so clear it rather than draw over
+		// the last one, which would keep pixels that turned transparent
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	})
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, fmt.Errorf("encoding gif: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// avatarHistory is how many replaced avatars are kept per user, from
+// AVATAR_HISTORY; zero turns history off. Versions are stored as
+// <unix millis>.<ext> in the user's history directory: avatars/history/<user>
+// in the flat and sharded layouts, users/<user>/history in the user layout.
+var avatarHistory = 5
+
+// HistoryEntry is one stored version of an avatar. ID is its timestamp.
+type HistoryEntry struct {
+	ID         string    `json:"id"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	Format     string    `json:"format"`
+	Size       int64     `json:"size"`
+	URL        string    `json:"url,omitempty"`
+	path       string
+}
+
+func historyDir(username string) string {
+	return historyDirAt(storageRoot(), storageLayout, username)
+}
+
+func historyDirAt(root, layout, username string) string {
+	username = strings.ToLower(username)
+	if layout == layoutUser {
+		return filepath.Join(root, "users", username, "history")
+	}
+	return filepath.Join(root, "avatars", "history", username)
+}
+
+// migrateHistory moves every user's history directory to where layout keeps
+// it, backend copies included. A user with history in both places is left
+// for an operator to merge.
+func migrateHistory(layout string) (moved, failed int) {
+	root := storageRoot()
+	found := make(map[string]string)
+	if dirs, err := os.ReadDir(filepath.Join(root, "avatars", "history")); err == nil {
+		for _, d := range dirs {
+			if d.IsDir() {
+				found[filepath.Join(root, "avatars", "history", d.Name())] = d.Name()
+			}
+		}
+	}
+	if users, err := os.ReadDir(filepath.Join(root, "users")); err == nil {
+		for _, u := range users {
+			dir := filepath.Join(root, "users", u.Name(), "history")
+			if info, err := os.Stat(dir); err == nil && info.IsDir() {
+				found[dir] = u.Name()
+			}
+		}
+	}
+	for dir, username := range found {
+		dest := historyDirAt(root, layout, username)
+		if dir == dest {
+			continue
+		}
+		if _, err := os.Stat(dest); err == nil {
+			log.Printf("[migrate] %s: %s already exists", dir, dest)
+			failed++
+			continue
+		}
+		if err := moveStateDir(dir, dest); err != nil {
+			log.Printf("[migrate] %s: %v", dir, err)
+			failed++
+			continue
+		}
+		moved++
+	}
+	return moved, failed
+}
+
+// avatarVersions lists a user's stored versions, newest first.
+func avatarVersions(username string) []HistoryEntry {
+	files, err := os.ReadDir(historyDir(username))
+	if err != nil {
+		return nil
+	}
+	var versions []HistoryEntry
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		id := strings.TrimSuffix(f.Name(), ext)
+		ms, err := strconv.ParseInt(id, 10, 64)
+		info, statErr := f.Info()
+		if err != nil || statErr != nil || (ext != ".gif" && ext != ".jpg") {
+			continue
+		}
+		versions = append(versions, HistoryEntry{
+			ID:         id,
+			UploadedAt: time.UnixMilli(ms).UTC(),
+			Format:     strings.TrimPrefix(ext, "."),
+			Size:       info.Size(),
+			path:       filepath.Join(historyDir(username), f.Name()),
+		})
+	}
+	slices.SortFunc(versions, func(a, b HistoryEntry) int {
+		return b.UploadedAt.Compare(a.UploadedAt)
+	})
+	return versions
+}
+
+func findAvatarVersion(username, id string) (HistoryEntry, bool) {
+	for _, v := range avatarVersions(username) {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+// archiveAvatar copies the user's current avatar into their history before
+// it is replaced, unless it is already the newest version, and prunes the
+// history to avatarHistory entries.
+func archiveAvatar(username string) {
+	if avatarHistory <= 0 {
+		return
+	}
+	path, _, _, err := getAvatarMetadata(username)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("[history] failed to read %s: %v", path, err)
+		return
+	}
+	versions := avatarVersions(username)
+	if len(versions) > 0 {
+		if newest, err := os.ReadFile(versions[0].path); err == nil && sha256.Sum256(newest) == sha256.Sum256(data) {
+			return
+		}
+	}
+
+	id := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := writeStateFile(filepath.Join(historyDir(username), id+filepath.Ext(path)), data); err != nil {
+		log.Printf("[history] failed to archive %s: %v", username, err)
+		return
+	}
+	versions = avatarVersions(username)
+	for _, old := range versions[min(avatarHistory, len(versions)):] {
+		removeStateFile(old.path)
+	}
+}
+
+// avatarHistoryHandler lists a user's previous avatars, newest first. Only
+// the owner and admins may see them, since a replaced avatar is often one
+// the user wanted gone.
+func avatarHistoryHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+	if !authorizeOwner(c, username) {
+		return
+	}
+	versions := avatarVersions(username)
+	for i := range versions {
+		versions[i].URL = publicURL(c, "/"+username+"/history/"+versions[i].ID)
+	}
+	c.Header("Cache-Control", "private, no-store")
+	c.JSON(http.StatusOK, gin.H{"username": username, "limit": avatarHistory, "history": versions})
+}
+
+// avatarVersionHandler serves one stored version, for previews before a
+// revert.
+func avatarVersionHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+	if !authorizeOwner(c, username) {
+		return
+	}
+	version, ok := findAvatarVersion(username, c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	contentType := "image/jpeg"
+	if version.Format == "gif" {
+		contentType = "image/gif"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "private, max-age=86400, immutable")
+	c.File(version.path)
+}
+
+// revertAvatarHandler restores a stored version, the newest by default, as
+// the current avatar. The replaced avatar is archived, so a revert can be
+// undone the same way.
+func revertAvatarHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+	audit := AuditEntry{Action: "revert", Asset: "avatar", Username: username}
+	defer auditRequest(c, &audit)
+
+	if !authorizeOwner(c, username) {
+		return
+	}
+	var req struct {
+		Version string `json:"version"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	versions := avatarVersions(username)
+	if len(versions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No previous avatars"})
+		return
+	}
+	version := versions[0]
+	if req.Version != "" {
+		var ok bool
+		if version, ok = findAvatarVersion(username, req.Version); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+			return
+		}
+	}
+
+	user, err := findUserByName(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading users file"})
+		return
+	}
+	if user != nil {
+		if !checkUploadPolicy(c, *user, "avatar") {
+			return
+		}
+		tier := strings.ToLower(user.GetSubscription())
+		if version.Format == "gif" && !slices.Contains(animatedAvatarTiers, tier) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Animated avatars require a paid subscription"})
+			return
+		}
+	}
+
+	data, err := os.ReadFile(version.path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading version"})
+		return
+	}
+	audit.Size = int64(len(data))
+	audit.Hash = fmt.Sprintf("%x", sha256.Sum256(data))
+
+	archiveAvatar(username)
+	ext := filepath.Ext(version.path)
+	filePath, err := storeAsset("avatar", username, ext, data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving image"})
+		return
+	}
+	removeStateFile(version.path)
+
+	var focus *Focus
+	if img, _, err := image.Decode(bytes.NewReader(data)); err == nil {
+		detected := detectFocus(img)
+		focus = &detected
+	}
+	indexAssetWith("avatar", username, filePath, func(meta *AssetMeta) {
+		if focus != nil {
+			meta.Focus = focus
+		}
+	})
+	deletePresets(username)
+	contentType := "image/jpeg"
+	if ext == ".gif" {
+		contentType = "image/gif"
+	}
+	generateAvatarPresets(username, filePath, contentType)
+
+	avatarCache.Invalidate(username)
+	notifyPeers("avatar", username)
+
+	setUploadValidators(c, "avatar", username)
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "Success",
+		"message": "Avatar reverted",
+		"version": version.ID,
+		"url":     publicURL(c, "/"+username),
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateLayoutMovesHistory(t *testing.T) {
+	withTempState(t)
+	oldLayout := storageLayout
+	t.Cleanup(func() { storageLayout = oldLayout })
+	storageLayout = layoutFlat
+
+	if _, err := storeAsset("avatar", "alice", ".jpg", testJPEG()); err != nil {
+		t.Fatal(err)
+	}
+	version := filepath.Join(historyDir("alice"), "1700000000000.jpg")
+	if err := writeStateFile(version, testJPEG()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateLayout(layoutUser); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(storageRoot(), "users", "alice", "history")
+	if historyDir("alice") != want {
+		t.Fatalf("historyDir = %s, want %s", historyDir("alice"), want)
+	}
+	if versions := avatarVersions("alice"); len(versions) != 1 || versions[0].ID != "1700000000000" {
+		t.Fatalf("versions after migrating to the user layout = %+v", versions)
+	}
+	if _, err := os.Stat(filepath.Dir(version)); !os.IsNotExist(err) {
+		t.Errorf("flat history directory still there: %v", err)
+	}
+
+	if err := migrateLayout(layoutSharded); err != nil {
+		t.Fatal(err)
+	}
+	if versions := avatarVersions("alice"); len(versions) != 1 {
+		t.Fatalf("versions after migrating back = %+v", versions)
+	}
+	if _, err := os.Stat(want); !os.IsNotExist(err) {
+		t.Errorf("user layout history directory still there: %v", err)
+	}
+}
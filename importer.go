@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// normalizeAsset runs a legacy file through the same resize/encode steps as
+// an upload, returning the stored bytes and extension.
+func normalizeAsset(kind string, data []byte) ([]byte, string, error) {
+	dims := assetDimensions[kind]
+
+	if http.DetectContentType(data) == "image/gif" {
+		resized, err := resizeGIF(data, dims[0], dims[1])
+		if err != nil {
+			return nil, "", fmt.Errorf("resizing gif: %w", err)
+		}
+		return resized, ".gif", nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding image: %w", err)
+	}
+	if !checkSourceDimensions(cfg) {
+		return nil, "", fmt.Errorf("image dimensions too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+	img, _, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding image: %w", err)
+	}
+
+	w, h := uint(dims[0]), uint(dims[1])
+	resized := resize.Resize(w, h, progressiveDownscale(img, w, h), resize.Lanczos3)
+	var buf bytes.Buffer
+	if err := encodeJPEG(&buf, resized); err != nil {
+		return nil, "", fmt.Errorf("encoding jpeg: %w", err)
+	}
+	return buf.Bytes(), ".jpg", nil
+}
+
+// importLegacy ingests a dump of the old avatar service. The dump either has
+// avatars/ and banners/ subdirectories or is a flat directory of avatars;
+// file names are usernames in any case with any image extension.
+func importLegacy(dir string) error {
+	sources := map[string]string{}
+	for _, kind := range []string{"avatar", "banner"} {
+		sub := filepath.Join(dir, kind+"s")
+		if info, err := os.Stat(sub); err == nil && info.IsDir() {
+			sources[kind] = sub
+		}
+	}
+	if len(sources) == 0 {
+		sources["avatar"] = dir
+	}
+
+	imported, failed := 0, 0
+	for kind, src := range sources {
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[string]string)
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			name := entry.Name()
+			username := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+
+			if prev, ok := seen[username]; ok {
+				fmt.Printf("FAIL %s %s: duplicate of %s\n", kind, name, prev)
+				failed++
+				continue
+			}
+			seen[username] = name
+
+			data, err := os.ReadFile(filepath.Join(src, name))
+			if err == nil {
+				var ext string
+				data, ext, err = normalizeAsset(kind, data)
+				if err == nil {
+					var filePath string
+					filePath, err = storeAsset(kind, username, ext, data)
+					if err == nil {
+						indexAsset(kind, username, filePath)
+					}
+				}
+			}
+			if err != nil {
+				fmt.Printf("FAIL %s %s: %v\n", kind, name, err)
+				failed++
+				continue
+			}
+			fmt.Printf("ok   %s %s -> %s\n", kind, name, username)
+			imported++
+		}
+	}
+
+	fmt.Printf("imported %d, failed %d\n", imported, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files failed to import", failed)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AssetMeta describes one stored asset. The index is kept in sync on
+// upload/delete so lookups never have to probe the filesystem.
+type AssetMeta struct {
+	Username  string    `json:"username"`
+	Kind      string    `json:"kind"`
+	Path      string    `json:"path"`
+	Format    string    `json:"format"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash"`
+	Animated  bool      `json:"animated"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Overlay is the user's chosen persistent overlay. It is not derived
+	// from the file, so reindexing and re-uploads carry it over.
+	Overlay string `json:"overlay,omitempty"`
+	// Focus is the subject's position in the stored image, detected on
+	// upload, and is carried over the same way.
+	Focus *Focus `json:"focus,omitempty"`
+	// SafeArea is where text can go on a banner, detected on upload.
+	SafeArea *SafeArea `json:"safe_area,omitempty"`
+}
+
+func (m AssetMeta) ContentType() string {
+	if m.Format == "gif" {
+		return "image/gif"
+	}
+	return "image/jpeg"
+}
+
+func (m AssetMeta) Etag() string {
+	return fmt.Sprintf("%s-%d", m.Username, m.UpdatedAt.Unix())
+}
+
+var (
+	assetIndex      = make(map[string]AssetMeta)
+	assetIndexReady bool
+	indexMutex      sync.RWMutex
+
+	indexSaveMutex   sync.Mutex
+	indexSavePending atomic.Bool
+
+	// detachedMeta holds index entries restored from STORAGE_BACKEND whose
+	// files have not been pulled back to local disk yet, so their overlay,
+	// focus and safe area survive until they are. It shares indexMutex.
+	detachedMeta = make(map[string]AssetMeta)
+)
+
+// indexFile is the on-disk index snapshot; see indexjournal.go for the
+// changes made since. Aliases are not derived from the files, so rebuilding
+// the index keeps them.
+type indexFile struct {
+	Generation int64                `json:"generation,omitempty"`
+	Assets     map[string]AssetMeta `json:"assets"`
+	Aliases    map[string]Alias     `json:"aliases,omitempty"`
+}
+
+func assetIndexPath() string {
+	return filepath.Join(storageRoot(), "index.json")
+}
+
+func assetKey(kind, username string) string {
+	return kind + ":" + strings.ToLower(username)
+}
+
+// loadAssetIndex reads the index snapshot and replays its journal,
+// rebuilding the index from the asset directories when it does not exist
+// yet.
+func loadAssetIndex() {
+	data, err := os.ReadFile(assetIndexPath())
+	if err == nil {
+		var file indexFile
+		err = json.Unmarshal(data, &file)
+		if err == nil && file.Assets == nil {
+			// indexes written before aliases are a bare asset map
+			err = json.Unmarshal(data, &file.Assets)
+		}
+		if err == nil {
+			journalMutex.Lock()
+			indexGeneration = file.Generation
+			journalRecords = replayIndexJournal(file.Assets, file.Generation)
+			journalMutex.Unlock()
+			detached := make(map[string]AssetMeta)
+			if assetBackend != nil {
+				for key, meta := range file.Assets {
+					if _, err := os.Stat(meta.Path); err != nil {
+						detached[key] = meta
+						delete(file.Assets, key)
+					}
+				}
+			}
+			indexMutex.Lock()
+			assetIndex = file.Assets
+			detachedMeta = detached
+			if file.Aliases != nil {
+				userAliases = file.Aliases
+			}
+			assetIndexReady = true
+			indexMutex.Unlock()
+			return
+		}
+		log.Printf("[index] failed to parse %s, rebuilding: %v", assetIndexPath(), err)
+	}
+	rebuildAssetIndex()
+}
+
+func rebuildAssetIndex() int {
+	index := make(map[string]AssetMeta)
+	for _, kind := range []string{"avatar", "banner"} {
+		walkAssets(kind, func(username, ext, path string) {
+			meta, err := describeAsset(kind, username, path)
+			if err != nil {
+				log.Printf("[index] skipping %s: %v", path, err)
+				return
+			}
+			key := assetKey(kind, username)
+			// gif wins over jpg, matching the old probing order
+			if existing, ok := index[key]; ok && existing.Format == "gif" {
+				return
+			}
+			indexMutex.RLock()
+			prev := previousMeta(key)
+			indexMutex.RUnlock()
+			meta.Overlay, meta.Focus, meta.SafeArea = prev.Overlay, prev.Focus, prev.SafeArea
+			index[key] = meta
+		})
+	}
+
+	indexMutex.Lock()
+	assetIndex = index
+	assetIndexReady = true
+	indexMutex.Unlock()
+	saveAssetIndex()
+
+	log.Printf("[index] indexed %d assets", len(index))
+	return len(index)
+}
+
+// saveAssetIndex writes a new snapshot of the whole index and empties the
+// journal. Changes to one entry go through journalAsset instead. Saves are
+// serialized, and the ones requested while another is running fold into a
+// single follow-up write of the latest state.
+func saveAssetIndex() {
+	indexSavePending.Store(true)
+	indexSaveMutex.Lock()
+	defer indexSaveMutex.Unlock()
+	if !indexSavePending.Swap(false) {
+		// a save that started after our change already wrote it
+		return
+	}
+
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	generation := nextIndexGeneration()
+	indexMutex.RLock()
+	assets := assetIndex
+	if len(detachedMeta) > 0 {
+		assets = make(map[string]AssetMeta, len(assetIndex)+len(detachedMeta))
+		maps.Copy(assets, detachedMeta)
+		maps.Copy(assets, assetIndex)
+	}
+	data, err := json.Marshal(indexFile{Generation: generation, Assets: assets, Aliases: userAliases})
+	indexMutex.RUnlock()
+	if err != nil {
+		log.Printf("[index] failed to encode index: %v", err)
+		return
+	}
+	if err := writeStateFile(assetIndexPath(), data); err != nil {
+		log.Printf("[index] failed to write index: %v", err)
+		return
+	}
+	startIndexGeneration(generation)
+}
+
+func describeAsset(kind, username, path string) (AssetMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AssetMeta{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return AssetMeta{}, err
+	}
+
+	meta := AssetMeta{
+		Username:  strings.ToLower(username),
+		Kind:      kind,
+		Path:      path,
+		Format:    strings.TrimPrefix(filepath.Ext(path), "."),
+		Size:      info.Size(),
+		Hash:      fmt.Sprintf("%x", sha256.Sum256(data)),
+		UpdatedAt: info.ModTime(),
+	}
+
+	if meta.Format == "gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return AssetMeta{}, err
+		}
+		meta.Width, meta.Height = g.Config.Width, g.Config.Height
+		meta.Animated = len(g.Image) > 1
+		return meta, nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return AssetMeta{}, err
+	}
+	meta.Width, meta.Height = cfg.Width, cfg.Height
+	return meta, nil
+}
+
+// indexAsset records a freshly written asset.
+func indexAsset(kind, username, path string) {
+	indexAssetWith(kind, username, path, nil)
+}
+
+// previousMeta is the entry an asset had before it is reindexed, which may
+// still be detached. It must be called with indexMutex held.
+func previousMeta(key string) AssetMeta {
+	if meta, ok := assetIndex[key]; ok {
+		return meta
+	}
+	return detachedMeta[key]
+}
+
+// indexAssetWith is indexAsset with a final edit of the entry, such as the
+// focus detected on upload, saved together with it.
+func indexAssetWith(kind, username, path string, edit func(*AssetMeta)) {
+	meta, err := describeAsset(kind, username, path)
+	if err != nil {
+		log.Printf("[index] failed to index %s: %v", path, err)
+		return
+	}
+	indexMutex.Lock()
+	prev := previousMeta(assetKey(kind, username))
+	meta.Overlay, meta.Focus, meta.SafeArea = prev.Overlay, prev.Focus, prev.SafeArea
+	delete(detachedMeta, assetKey(kind, username))
+	if edit != nil {
+		edit(&meta)
+	}
+	assetIndex[assetKey(kind, username)] = meta
+	indexMutex.Unlock()
+	journalAsset(assetKey(kind, username))
+}
+
+// setAssetOverlay stores the persistent overlay for an indexed asset. It
+// returns false when the asset is not indexed.
+func setAssetOverlay(kind, username, overlay string) bool {
+	indexMutex.Lock()
+	meta, ok := assetIndex[assetKey(kind, username)]
+	if ok {
+		meta.Overlay = overlay
+		assetIndex[assetKey(kind, username)] = meta
+	}
+	indexMutex.Unlock()
+	if ok {
+		journalAsset(assetKey(kind, username))
+	}
+	return ok
+}
+
+// setAssetFocus records the detected focal point of an indexed asset.
+func setAssetFocus(kind, username string, focus Focus) {
+	indexMutex.Lock()
+	meta, ok := assetIndex[assetKey(kind, username)]
+	if ok {
+		meta.Focus = &focus
+		assetIndex[assetKey(kind, username)] = meta
+	}
+	indexMutex.Unlock()
+	if ok {
+		journalAsset(assetKey(kind, username))
+	}
+}
+
+// setAssetSafeArea records the detected safe area of an indexed banner; nil
+// clears it.
+func setAssetSafeArea(kind, username string, area *SafeArea) {
+	indexMutex.Lock()
+	meta, ok := assetIndex[assetKey(kind, username)]
+	if ok {
+		meta.SafeArea = area
+		assetIndex[assetKey(kind, username)] = meta
+	}
+	indexMutex.Unlock()
+	if ok {
+		journalAsset(assetKey(kind, username))
+	}
+}
+
+func unindexAsset(kind, username string) {
+	indexMutex.Lock()
+	delete(assetIndex, assetKey(kind, username))
+	delete(detachedMeta, assetKey(kind, username))
+	indexMutex.Unlock()
+	journalAsset(assetKey(kind, username))
+}
+
+// lookupAsset returns the indexed asset. The second result is false when the
+// asset does not exist; the third is false when the index is not loaded and
+// the caller has to probe the filesystem itself.
+func lookupAsset(kind, username string) (AssetMeta, bool, bool) {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+	meta, ok := assetIndex[assetKey(kind, username)]
+	return meta, ok, assetIndexReady
+}
+
+func reindexHandler(c *gin.Context) {
+	count := rebuildAssetIndex()
+	c.JSON(http.StatusOK, gin.H{"status": "Success", "assets": count})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestSaveAssetIndexConcurrent(t *testing.T) {
+	oldPath, oldIndex, oldAliases := documentPath, assetIndex, userAliases
+	t.Cleanup(func() {
+		documentPath, assetIndex, userAliases = oldPath, oldIndex, oldAliases
+	})
+	documentPath = t.TempDir()
+	assetIndex = make(map[string]AssetMeta)
+	userAliases = map[string]Alias{"old": {Target: "new", Redirect: true}}
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("user%d", i)
+			indexMutex.Lock()
+			assetIndex[assetKey("avatar", name)] = AssetMeta{Username: name, Kind: "avatar", Format: "jpg"}
+			indexMutex.Unlock()
+			saveAssetIndex()
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(assetIndexPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file indexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("index.json is corrupt: %v", err)
+	}
+	if len(file.Assets) != 50 {
+		t.Errorf("saved %d assets, want 50", len(file.Assets))
+	}
+	if file.Aliases["old"].Target != "new" {
+		t.Errorf("aliases lost: %v", file.Aliases)
+	}
+}
+
+func TestIndexJournal(t *testing.T) {
+	oldPath, oldIndex, oldDetached, oldMin := documentPath, assetIndex, detachedMeta, indexJournalMin
+	t.Cleanup(func() {
+		documentPath, assetIndex, detachedMeta, indexJournalMin = oldPath, oldIndex, oldDetached, oldMin
+	})
+	documentPath = t.TempDir()
+	os.MkdirAll(storageRoot(), 0755)
+	indexJournalMin = 4
+	assetIndex = map[string]AssetMeta{
+		assetKey("avatar", "alice"): {Username: "alice", Kind: "avatar", Format: "jpg"},
+		assetKey("avatar", "bob"):   {Username: "bob", Kind: "avatar", Format: "jpg"},
+	}
+	detachedMeta = make(map[string]AssetMeta)
+	saveAssetIndex()
+	snapshot, _ := os.ReadFile(assetIndexPath())
+
+	setAssetOverlay("avatar", "alice", "halo")
+	unindexAsset("avatar", "bob")
+	if data, _ := os.ReadFile(assetIndexPath()); string(data) != string(snapshot) {
+		t.Fatal("a single-entry change rewrote index.json")
+	}
+	if journalRecords != 2 {
+		t.Fatalf("journal has %d records, want 2", journalRecords)
+	}
+
+	loadAssetIndex()
+	if meta, ok, _ := lookupAsset("avatar", "alice"); !ok || meta.Overlay != "halo" {
+		t.Errorf("alice after replay = %+v, %t", meta, ok)
+	}
+	if _, ok, _ := lookupAsset("avatar", "bob"); ok {
+		t.Error("bob came back after replay")
+	}
+
+	// a stale record, as left by a compaction interrupted after the
+	// snapshot, is skipped
+	appendIndexRecord(indexRecord{Generation: indexGeneration - 1, Key: assetKey("avatar", "alice")})
+	loadAssetIndex()
+	if _, ok, _ := lookupAsset("avatar", "alice"); !ok {
+		t.Error("a record from an older generation was replayed")
+	}
+
+	for range indexJournalMin - journalRecords {
+		setAssetOverlay("avatar", "alice", "ring")
+	}
+	if journalRecords != 0 {
+		t.Errorf("journal has %d records after passing indexJournalMin, want it compacted", journalRecords)
+	}
+	var file indexFile
+	data, _ := os.ReadFile(assetIndexPath())
+	if err := json.Unmarshal(data, &file); err != nil || file.Assets[assetKey("avatar", "alice")].Overlay != "ring" {
+		t.Errorf("compacted snapshot = %s, %v", data, err)
+	}
+}
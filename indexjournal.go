@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The index is a snapshot, index.json, plus a journal of the entries changed
+// since, one JSON record per line, so an upload appends one line instead of
+// rewriting every entry. Once the journal outgrows a quarter of the index it
+// is compacted into a new snapshot. An embedded store such as bbolt or
+// SQLite would do the same, but neither is a dependency of this module, and
+// two flat files keep the index readable and restorable from the backend
+// like the other state files.
+//
+// Each snapshot gets a new generation and journal records carry the one
+// they follow, so records left behind by a compaction that was interrupted,
+// or a journal restored from the backend older than its snapshot, are
+// skipped rather than replayed over newer entries.
+
+// indexJournalMin is the journal length below which it is never compacted.
+var indexJournalMin = 1024
+
+type indexRecord struct {
+	Generation int64  `json:"gen"`
+	Key        string `json:"key"`
+	// Meta is the entry's new value; nil removes it.
+	Meta *AssetMeta `json:"meta,omitempty"`
+}
+
+var (
+	// journalMutex orders appends and compactions. It is taken before
+	// indexMutex.
+	journalMutex    sync.Mutex
+	indexGeneration int64
+	journalRecords  int
+)
+
+func indexJournalPath() string {
+	return filepath.Join(storageRoot(), "index.journal")
+}
+
+// journalAsset appends the current entry for key to the journal, compacting
+// it when it has grown too long. The entry is read under journalMutex, so
+// of two concurrent changes to a key the later append has the later value.
+func journalAsset(key string) {
+	journalMutex.Lock()
+	indexMutex.RLock()
+	record := indexRecord{Generation: indexGeneration, Key: key}
+	if meta, ok := assetIndex[key]; ok {
+		record.Meta = &meta
+	} else if meta, ok := detachedMeta[key]; ok {
+		record.Meta = &meta
+	}
+	size := len(assetIndex) + len(detachedMeta)
+	indexMutex.RUnlock()
+
+	err := appendIndexRecord(record)
+	if err == nil {
+		journalRecords++
+	}
+	compact := journalRecords >= max(indexJournalMin, size/4)
+	journalMutex.Unlock()
+
+	if err != nil {
+		log.Printf("[index] failed to append to journal, saving the whole index: %v", err)
+		saveAssetIndex()
+		return
+	}
+	backupStateFile(indexJournalPath())
+	if compact {
+		saveAssetIndex()
+	}
+}
+
+func appendIndexRecord(record indexRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(indexJournalPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replayIndexJournal applies the journal records of generation to assets
+// and returns how many it applied. A torn last line, from a crash mid-append,
+// ends the replay.
+func replayIndexJournal(assets map[string]AssetMeta, generation int64) int {
+	f, err := os.Open(indexJournalPath())
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	applied := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var record indexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("[index] stopping journal replay at a bad record: %v", err)
+			break
+		}
+		if record.Generation != generation {
+			continue
+		}
+		if record.Meta == nil {
+			delete(assets, record.Key)
+		} else {
+			assets[record.Key] = *record.Meta
+		}
+		applied++
+	}
+	return applied
+}
+
+// startIndexGeneration begins a new snapshot generation and empties the
+// journal, once the snapshot for it is written. Callers hold journalMutex.
+func startIndexGeneration(generation int64) {
+	indexGeneration = generation
+	journalRecords = 0
+	if err := os.WriteFile(indexJournalPath(), nil, 0644); err != nil {
+		// the old records are skipped anyway, being of another generation
+		log.Printf("[index] failed to truncate journal: %v", err)
+	}
+	backupStateFile(indexJournalPath())
+}
+
+func nextIndexGeneration() int64 {
+	return max(time.Now().UnixNano(), indexGeneration+1)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The index stores a SHA-256 of every asset when it is written. A daily job
+// re-hashes a rolling slice of the index so every file is checked once per
+// cycle; a mismatch means bit-rot or the file was changed behind our back.
+var (
+	integrityCycleDays = 7
+
+	integrityCursor string
+	integrityMutex  sync.Mutex
+
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+func startIntegrityChecks() {
+	if integrityCycleDays <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			checked, bad := verifyIntegrityBatch()
+			log.Printf("[integrity] verified %d assets, %d failed", checked, bad)
+		}
+	}()
+}
+
+// verifyIntegrityBatch checks the next 1/integrityCycleDays of the index,
+// wrapping around at the end.
+func verifyIntegrityBatch() (checked, bad int) {
+	integrityMutex.Lock()
+	defer integrityMutex.Unlock()
+
+	indexMutex.RLock()
+	keys := make([]string, 0, len(assetIndex))
+	for key := range assetIndex {
+		keys = append(keys, key)
+	}
+	indexMutex.RUnlock()
+	if len(keys) == 0 {
+		return 0, 0
+	}
+	slices.Sort(keys)
+
+	batch := (len(keys) + integrityCycleDays - 1) / integrityCycleDays
+	start, _ := slices.BinarySearch(keys, integrityCursor)
+	if start < len(keys) && keys[start] == integrityCursor {
+		start++
+	}
+	for i := 0; i < batch; i++ {
+		key := keys[(start+i)%len(keys)]
+		integrityCursor = key
+		indexMutex.RLock()
+		meta, ok := assetIndex[key]
+		indexMutex.RUnlock()
+		if !ok {
+			continue
+		}
+		checked++
+		if err := verifyAsset(meta); err != nil {
+			reportIntegrityFailure(meta, err)
+			bad++
+		}
+	}
+	return checked, bad
+}
+
+func verifyAsset(meta AssetMeta) error {
+	data, err := os.ReadFile(meta.Path)
+	if err != nil {
+		return err
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(data)); sum != meta.Hash {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+func reportIntegrityFailure(meta AssetMeta, err error) {
+	log.Printf("[integrity] %s %s (%s): %v", meta.Kind, meta.Username, meta.Path, err)
+	emitEvent(Event{Type: "asset.integrity_failed", Asset: meta.Kind, Username: meta.Username, Reason: err.Error()})
+}
+
+// verifyUserHandler re-verifies every asset a user has, including banner
+// slots, and reports the result for each.
+func verifyUserHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+
+	metas := userAssets(username)
+	if len(metas) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User has no stored assets"})
+		return
+	}
+
+	results := make([]gin.H, 0, len(metas))
+	ok := true
+	for _, meta := range metas {
+		result := gin.H{"kind": meta.Kind, "key": meta.Username, "ok": true}
+		if err := verifyAsset(meta); err != nil {
+			reportIntegrityFailure(meta, err)
+			result["ok"] = false
+			result["error"] = err.Error()
+			ok = false
+		}
+		results = append(results, result)
+	}
+	c.JSON(http.StatusOK, gin.H{"username": username, "ok": ok, "assets": results})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type transformJob struct {
+	Status  string
+	Error   string
+	URL     string
+	Started time.Time
+	// result holds a finished variant the cache would not keep, until the
+	// requester comes back for it.
+	result *CachedImage
+}
+
+var (
+	asyncTransforms bool
+	transformJobs   = make(map[string]*transformJob)
+	jobsMutex       sync.Mutex
+)
+
+func transformJobID(cacheKey string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(cacheKey)))
+}
+
+// queueTransform generates the variant for cacheKey in the background and
+// caches it once done. Returns the job id to poll.
+func queueTransform(cache *variantCache, cacheKey, url string, generate func() (CachedImage, error)) string {
+	id := transformJobID(cacheKey)
+
+	jobsMutex.Lock()
+	for jobID, job := range transformJobs {
+		if job.Status != "pending" && time.Since(job.Started) > time.Duration(cacheTimeout)*time.Second {
+			delete(transformJobs, jobID)
+		}
+	}
+	if job, exists := transformJobs[id]; exists && job.Status == "pending" {
+		jobsMutex.Unlock()
+		return id
+	}
+	job := &transformJob{Status: "pending", URL: url, Started: time.Now()}
+	transformJobs[id] = job
+	jobsMutex.Unlock()
+
+	go func() {
+		result, err := generate()
+		recordTransformLatency(time.Since(job.Started))
+
+		kept := false
+		if err == nil {
+			result.Timestamp = time.Now()
+			kept = cache.Put(cacheKey, result)
+		}
+
+		jobsMutex.Lock()
+		defer jobsMutex.Unlock()
+		if err != nil {
+			job.Status = "failed"
+			job.Error = err.Error()
+			return
+		}
+		if !kept {
+			job.result = &result
+		}
+		job.Status = "done"
+	}()
+
+	return id
+}
+
+// takeTransformResult hands over a finished variant for cacheKey that was
+// too large to cache, so the requester gets it instead of a new job.
+func takeTransformResult(cacheKey string) (CachedImage, bool) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	job, ok := transformJobs[transformJobID(cacheKey)]
+	if !ok || job.result == nil {
+		return CachedImage{}, false
+	}
+	result := *job.result
+	job.result = nil
+	return result, true
+}
+
+func respondPending(c *gin.Context, id string) {
+	statusURL := publicURL(c, "/.transforms/"+id)
+	c.Header("Location", statusURL)
+	c.Header("Retry-After", "1")
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":     "pending",
+		"status_url": statusURL,
+	})
+}
+
+func transformStatusHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	jobsMutex.Lock()
+	job, exists := transformJobs[id]
+	var status, errMsg, url string
+	if exists {
+		status, errMsg, url = job.Status, job.Error, job.URL
+	}
+	jobsMutex.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown transform"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	switch status {
+	case "done":
+		c.JSON(http.StatusOK, gin.H{"status": status, "url": url})
+	case "failed":
+		c.JSON(http.StatusOK, gin.H{"status": status, "error": errMsg})
+	default:
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusAccepted, gin.H{"status": status})
+	}
+}
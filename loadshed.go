@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Load shedding: while the host's CPU is saturated or transforms are slow,
+// cache misses are answered with the source image instead of rendering a
+// new variant. Cached variants are still served, so only new work is shed.
+var (
+	loadShedding     bool
+	shedCPUThreshold = 0.9
+	shedLatency      = 1500 * time.Millisecond
+
+	cpuBusy     atomic.Uint64 // math.Float64bits of the busy fraction
+	shedCount   atomic.Int64
+	latencyEWMA time.Duration
+	latencyAt   time.Time
+	latencyMu   sync.Mutex
+)
+
+// latencyHalfLife is how fast the transform latency average decays while no
+// renders complete. Shedding stops renders, so without the decay a slow
+// spell would keep shedding on for good.
+const latencyHalfLife = 10 * time.Second
+
+func configureLoadShedding() {
+	loadShedding = mustEnv("LOAD_SHEDDING", "false") == "true"
+	if v, err := strconv.ParseFloat(os.Getenv("SHED_CPU"), 64); err == nil && v > 0 {
+		shedCPUThreshold = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("SHED_LATENCY_MS")); err == nil && v > 0 {
+		shedLatency = time.Duration(v) * time.Millisecond
+	}
+}
+
+func startLoadMonitor() {
+	if !loadShedding {
+		return
+	}
+	go func() {
+		prevIdle, prevTotal, err := readCPUTimes()
+		if err != nil {
+			log.Printf("[shed] CPU pressure unavailable, shedding on latency only: %v", err)
+			return
+		}
+		for range time.Tick(time.Second) {
+			idle, total, err := readCPUTimes()
+			if err != nil || total == prevTotal {
+				continue
+			}
+			busy := 1 - float64(idle-prevIdle)/float64(total-prevTotal)
+			cpuBusy.Store(math.Float64bits(busy))
+			prevIdle, prevTotal = idle, total
+		}
+	}()
+}
+
+// readCPUTimes returns the idle and total jiffies from /proc/stat.
+func readCPUTimes() (idle, total uint64, err error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("unexpected /proc/stat line %q", line)
+	}
+	for i, field := range fields[1:] {
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += n
+		if i == 3 || i == 4 { // idle, iowait
+			idle += n
+		}
+	}
+	return idle, total, nil
+}
+
+// recordTransformLatency feeds how long a transform took, including any
+// time queued, into a moving average.
+func recordTransformLatency(d time.Duration) {
+	latencyMu.Lock()
+	now := time.Now()
+	latencyEWMA = (decayedLatency(now)*7 + d) / 8
+	latencyAt = now
+	latencyMu.Unlock()
+}
+
+// decayedLatency is the latency average halved for every latencyHalfLife
+// since the last sample. Callers hold latencyMu.
+func decayedLatency(now time.Time) time.Duration {
+	if latencyAt.IsZero() {
+		return latencyEWMA
+	}
+	halvings := float64(now.Sub(latencyAt)) / float64(latencyHalfLife)
+	return time.Duration(float64(latencyEWMA) * math.Pow(0.5, halvings))
+}
+
+func currentLatency() time.Duration {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	return decayedLatency(time.Now())
+}
+
+func shouldShed() bool {
+	if !loadShedding {
+		return false
+	}
+	return currentLatency() > shedLatency || math.Float64frombits(cpuBusy.Load()) > shedCPUThreshold
+}
+
+// shedTransform answers a cache miss with the untransformed source while
+// shedding, and reports whether it did. Strict clients get a 503 instead.
+func shedTransform(c *gin.Context, data []byte, contentType string) bool {
+	if !shouldShed() {
+		return false
+	}
+	shedCount.Add(1)
+	c.Header("X-Load-Shed", "1")
+	c.Header("Retry-After", "10")
+	if isStrict(c) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is busy, try again shortly"})
+		return true
+	}
+	c.Header("Cache-Control", "public, max-age=10")
+	c.Data(http.StatusOK, contentType, data)
+	return true
+}
+
+func loadSheddingStats() gin.H {
+	latency := currentLatency()
+	return gin.H{
+		"enabled":        loadShedding,
+		"shedding":       shouldShed(),
+		"shed":           shedCount.Load(),
+		"cpu_busy":       math.Float64frombits(cpuBusy.Load()),
+		"transform_ewma": latency.Milliseconds(),
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,10 +21,7 @@ var (
 	defaultImageContent  []byte
 	defaultImageEtag     string
 	defaultBannerContent []byte
-
-	roundedCache = make(map[string]CachedImage)
-	resizedCache = make(map[string]CachedImage)
-	cacheMutex   sync.RWMutex
+	darkDefaultBanner    []byte
 )
 
 type CachedImage struct {
@@ -36,10 +32,15 @@ type CachedImage struct {
 }
 
 type User struct {
-	Username     string `json:"username"`
-	Key          string `json:"key"`
-	MaxSize      any    `json:"max_size"`
-	Subscription any    `json:"sys.subscription"`
+	Username     string   `json:"username"`
+	Key          string   `json:"key"`
+	MaxSize      any      `json:"max_size"`
+	Subscription any      `json:"sys.subscription"`
+	Badges       []string `json:"badges"`
+	// ID is the immutable rotur user ID; see userid.go.
+	ID any `json:"id"`
+	// Uploads switches uploads off per asset kind; see policy.go.
+	Uploads map[string]bool `json:"sys.uploads"`
 }
 
 func (u User) GetSubscription() string {
@@ -59,8 +60,11 @@ func (u User) GetSubscription() string {
 }
 
 type UploadRequest struct {
-	Image string `json:"image"`
-	Token string `json:"token"`
+	Image *uploadImage `json:"-"`
+	Token string       `json:"token"`
+	Alt   *string      `json:"alt"`
+	Slot  string       `json:"slot"`
+	Focus *Focus       `json:"focus"`
 }
 
 func init() {
@@ -68,9 +72,11 @@ func init() {
 	loadDefaultBanner()
 }
 
+// requiresAdmin lets through requests carrying ADMIN_TOKEN. With no token
+// configured every admin request is refused, rather than every one allowed.
 func requiresAdmin(c *gin.Context) {
 	token := c.Query("ADMIN_TOKEN")
-	if token == ADMIN_TOKEN {
+	if ADMIN_TOKEN != "" && token == ADMIN_TOKEN {
 		c.Next()
 		return
 	}
@@ -80,20 +86,99 @@ func requiresAdmin(c *gin.Context) {
 
 func main() {
 	envOnce.Do(loadEnvFile)
+	configureLogging()
+	if err := ensureStorageTree(); err != nil {
+		log.Fatalf("[storage] cannot create storage under %s: %v", documentPath, err)
+	}
+	if runCommand(os.Args[1:]) {
+		return
+	}
+	if presetOnly {
+		generateDefaultPresets()
+	}
+	loadThemedDefaults()
+	overlays = loadOverlays()
+	loadPlaceholders()
+	restoreStateFiles()
+	loadAssetIndex()
+	loadAltTexts()
+	loadBannerRotations()
+	startTracing()
+	startIntegrityChecks()
+	startLoadMonitor()
+	startCacheJanitor()
+	startPrewarm()
+	startAuditRetention()
+	startReplication()
 	gin.SetMode(gin.ReleaseMode)
 
-	r := gin.Default()
+	r := gin.New()
 
+	r.Use(requestLogging())
+	r.Use(gin.Recovery())
+	r.Use(tracingMiddleware())
+	if w := openAccessLog(); w != nil {
+		r.Use(accessLogger(w, accessLogFormat != "common"))
+	}
+	r.Use(recoverWithDefaultImage())
+	r.Use(canonicalHost())
+	r.Use(readOnlyGuard())
+	r.Use(validateUsernameParams())
 	r.Use(enableCORS())
 
 	r.GET("/:username", avatarHandler)
 	r.HEAD("/:username", avatarHandler)
+	r.DELETE("/:username", deleteAvatarHandler)
+	r.GET("/:username/history", avatarHistoryHandler)
+	r.GET("/:username/history/:id", avatarVersionHandler)
+	r.POST("/:username/revert", revertAvatarHandler)
 
 	r.GET("/.banners/:username", bannerHandler)
 	r.HEAD("/.banners/:username", bannerHandler)
+	r.GET("/.banners/:username/:slot", bannerHandler)
+	r.HEAD("/.banners/:username/:slot", bannerHandler)
+	r.DELETE("/.banners/:username", deleteBannerHandler)
+	r.DELETE("/.banners/:username/:slot", deleteBannerHandler)
+
+	r.GET("/.transforms/:id", transformStatusHandler)
+	r.GET("/.id/:uid", avatarByIDHandler)
+	r.HEAD("/.id/:uid", avatarByIDHandler)
+	r.GET("/.meta/:username", metadataHandler)
+	r.GET("/.me", meHandler)
+	r.POST("/me/overlay", meOverlayHandler)
+	r.POST("/me/banner-rotation", bannerRotationHandler)
+	r.GET("/.overlays", overlaysHandler)
+	r.GET("/.overlays/:name", overlayPreviewHandler)
+	r.GET("/.datauri/:username", dataURIHandler)
+	r.GET("/.pixels/:username", pixelsHandler)
+	r.GET("/.ansi/:username", ansiHandler)
+	r.GET("/.theme/:username", profileHandler)
 
 	r.POST("/rotur-upload-pfp", requiresAdmin, uploadPfpHandler)
 	r.POST("/rotur-upload-banner", requiresAdmin, uploadBannerHandler)
+	r.POST("/upload/validate", validateUploadHandler)
+	r.POST("/upload/pfp", requiresSelfServe, uploadPfpHandler)
+	r.POST("/upload/banner", requiresSelfServe, uploadBannerHandler)
+
+	r.GET("/admin/audit", requiresAdmin, auditHandler)
+	r.POST("/admin/audit/purge/:username", requiresAdmin, auditPurgeHandler)
+	r.GET("/admin/users/:username/export", requiresAdmin, exportUserHandler)
+	r.DELETE("/admin/users/:username", requiresAdmin, eraseUserHandler)
+	r.POST("/admin/rename", requiresAdmin, renameUserHandler)
+	r.GET("/admin/aliases", requiresAdmin, listAliasesHandler)
+	r.PUT("/admin/aliases/:alias", requiresAdmin, putAliasHandler)
+	r.DELETE("/admin/aliases/:alias", requiresAdmin, deleteAliasHandler)
+	r.GET("/admin/assets", requiresAdmin, adminAssetsHandler)
+	r.GET("/admin/storage", requiresAdmin, storageReportHandler)
+	r.POST("/admin/reindex", requiresAdmin, reindexHandler)
+	r.POST("/admin/maintenance", requiresAdmin, maintenanceHandler)
+	r.POST("/admin/verify/:username", requiresAdmin, verifyUserHandler)
+	r.GET("/admin/cache/stats", requiresAdmin, cacheStatsHandler)
+	r.GET("/admin/stats/features", requiresAdmin, featureStatsHandler)
+	r.GET("/admin/replication", requiresAdmin, replicationStatusHandler)
+	r.POST("/admin/invalidate/:kind/:username", requiresAdmin, invalidateHandler)
+	r.PUT("/admin/replica/:kind/:key", requiresAdmin, replicaReceiveHandler)
+	r.DELETE("/admin/replica/:kind/:key", requiresAdmin, replicaReceiveHandler)
 
 	log.Printf("Avatar service starting on port %s", port)
 	r.Run(":" + port)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequiresAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := ADMIN_TOKEN
+	t.Cleanup(func() { ADMIN_TOKEN = old })
+
+	tests := []struct {
+		configured, sent string
+		want             int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"", "anything", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		ADMIN_TOKEN = tt.configured
+		r := gin.New()
+		r.DELETE("/admin/users/:username", requiresAdmin, func(c *gin.Context) { c.Status(http.StatusOK) })
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/users/bob?ADMIN_TOKEN="+tt.sent, nil))
+		if w.Code != tt.want {
+			t.Errorf("configured %q, sent %q: status %d, want %d", tt.configured, tt.sent, w.Code, tt.want)
+		}
+	}
+}
+
+func TestValidateUsernameParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(validateUsernameParams())
+	r.GET("/:username", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.PUT("/admin/replica/:kind/:key", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/alice", http.StatusOK},
+		{http.MethodGet, "/alice..bob", http.StatusOK},
+		{http.MethodGet, "/..", http.StatusBadRequest},
+		{http.MethodGet, "/%2e%2e", http.StatusBadRequest},
+		{http.MethodGet, `/..%5cetc`, http.StatusBadRequest},
+		{http.MethodPut, "/admin/replica/banner/alice@wide", http.StatusOK},
+		{http.MethodPut, "/admin/replica/avatar/..", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+
+	if _, err := storeAsset("avatar", "..", ".jpg", []byte("x")); err != errInvalidUsername {
+		t.Errorf("storeAsset(..) error = %v, want %v", err, errInvalidUsername)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMaintenanceMessage = "The service is in read-only maintenance mode, please try again later"
+
+// In maintenance mode every write is refused with 503 while reads keep
+// being served, so storage can be migrated safely. Admin writes are refused
+// too, since renames, erasures, aliases and replicas all touch storage; only
+// the maintenance switch itself stays open.
+var (
+	maintenance        bool
+	maintenanceMessage string
+	maintenanceMutex   sync.RWMutex
+)
+
+func readOnlyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if c.Request.URL.Path == "/admin/maintenance" {
+			c.Next()
+			return
+		}
+		maintenanceMutex.RLock()
+		on, msg := maintenance, maintenanceMessage
+		maintenanceMutex.RUnlock()
+		if !on {
+			c.Next()
+			return
+		}
+		c.Header("Retry-After", "300")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": msg, "maintenance": true})
+	}
+}
+
+// maintenanceHandler turns read-only mode on or off. The message is
+// optional.
+func maintenanceHandler(c *gin.Context) {
+	var req struct {
+		Enabled bool   `json:"enabled"`
+		Message string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Message == "" {
+		req.Message = defaultMaintenanceMessage
+	}
+
+	maintenanceMutex.Lock()
+	maintenance, maintenanceMessage = req.Enabled, req.Message
+	maintenanceMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"status": "Success", "maintenance": req.Enabled, "message": req.Message})
+}
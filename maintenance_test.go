@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadOnlyGuard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	maintenanceMutex.Lock()
+	oldOn, oldMsg := maintenance, maintenanceMessage
+	maintenance, maintenanceMessage = true, defaultMaintenanceMessage
+	maintenanceMutex.Unlock()
+	t.Cleanup(func() {
+		maintenanceMutex.Lock()
+		maintenance, maintenanceMessage = oldOn, oldMsg
+		maintenanceMutex.Unlock()
+	})
+
+	r := gin.New()
+	r.Use(readOnlyGuard())
+	r.Any("/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/someone", http.StatusOK},
+		{http.MethodHead, "/.banners/someone", http.StatusOK},
+		{http.MethodGet, "/admin/aliases", http.StatusOK},
+		{http.MethodPost, "/admin/maintenance", http.StatusOK},
+		{http.MethodPost, "/upload/pfp", http.StatusServiceUnavailable},
+		{http.MethodDelete, "/someone", http.StatusServiceUnavailable},
+		{http.MethodPut, "/admin/aliases/old", http.StatusServiceUnavailable},
+		{http.MethodDelete, "/admin/aliases/old", http.StatusServiceUnavailable},
+		{http.MethodPut, "/admin/replica/avatar/someone", http.StatusServiceUnavailable},
+		{http.MethodDelete, "/admin/replica/avatar/someone", http.StatusServiceUnavailable},
+		{http.MethodPost, "/admin/reindex", http.StatusServiceUnavailable},
+		{http.MethodDelete, "/admin/users/someone", http.StatusServiceUnavailable},
+		{http.MethodPost, "/admin/rename?from=a&to=b", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// roundedMask is the corner geometry shared by the static and GIF rounding
+// paths, so the same radius always produces the same shape regardless of
+// the source format.
+type roundedMask struct {
+	width, height int
+	radius        int
+}
+
+// newRoundedMask resolves r against the image size and clamps it to half of
+// the shorter side.
+func newRoundedMask(width, height int, r Radius) roundedMask {
+	radius := min(r.Pixels(width, height), width/2, height/2)
+	return roundedMask{width: width, height: height, radius: max(radius, 0)}
+}
+
+// Empty reports whether the mask leaves every pixel visible.
+func (m roundedMask) Empty() bool {
+	return m.radius == 0
+}
+
+// Contains reports whether the pixel at (x, y), relative to the image
+// origin, is inside the rounded rectangle.
+func (m roundedMask) Contains(x, y int) bool {
+	radius := m.radius
+	var cx, cy int
+
+	switch {
+	case x < radius && y < radius: // top-left
+		cx, cy = radius, radius
+	case x >= m.width-radius && y < radius: // top-right
+		cx, cy = m.width-radius-1, radius
+	case x < radius && y >= m.height-radius: // bottom-left
+		cx, cy = radius, m.height-radius-1
+	case x >= m.width-radius && y >= m.height-radius: // bottom-right
+		cx, cy = m.width-radius-1, m.height-radius-1
+	default:
+		return true
+	}
+
+	dx, dy := x-cx, y-cy
+	return dx*dx+dy*dy <= radius*radius
+}
+
+// applyRoundedMask clears the pixels of img outside the rounded rectangle.
+func applyRoundedMask(img *image.RGBA, r Radius) {
+	b := img.Bounds()
+	mask := newRoundedMask(b.Dx(), b.Dy(), r)
+	if mask.Empty() {
+		return
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !mask.Contains(x-b.Min.X, y-b.Min.Y) {
+				img.SetRGBA(x, y, color.RGBA{})
+			}
+		}
+	}
+}
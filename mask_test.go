@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"testing"
+)
+
+func TestNewRoundedMaskClamps(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		radius        Radius
+		want          int
+	}{
+		{"zero", 64, 64, Radius{}, 0},
+		{"within bounds", 64, 64, Radius{Value: 8}, 8},
+		{"wide clamps to height", 100, 50, Radius{Value: 40}, 25},
+		{"tall clamps to width", 50, 100, Radius{Value: 40}, 25},
+		{"oversized", 10, 10, Radius{Value: 100}, 5},
+		{"percent of shorter side", 200, 100, Radius{Value: 25, Percent: true}, 25},
+		{"circle", 64, 64, circleRadius, 32},
+		{"circle on wide", 300, 100, circleRadius, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newRoundedMask(tt.width, tt.height, tt.radius)
+			if m.radius != tt.want {
+				t.Errorf("radius = %d, want %d", m.radius, tt.want)
+			}
+			if m.Empty() != (tt.want == 0) {
+				t.Errorf("Empty() = %v with radius %d", m.Empty(), m.radius)
+			}
+		})
+	}
+}
+
+func TestRoundedMaskSymmetric(t *testing.T) {
+	for _, size := range [][2]int{{64, 64}, {90, 30}, {30, 90}, {7, 5}} {
+		w, h := size[0], size[1]
+		m := newRoundedMask(w, h, Radius{Value: 20})
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				in := m.Contains(x, y)
+				if m.Contains(w-1-x, y) != in || m.Contains(x, h-1-y) != in {
+					t.Fatalf("%dx%d mask not symmetric at (%d, %d)", w, h, x, y)
+				}
+			}
+		}
+		if m.Contains(0, 0) {
+			t.Errorf("%dx%d mask keeps the corner pixel", w, h)
+		}
+		if !m.Contains(w/2, h/2) {
+			t.Errorf("%dx%d mask clears the centre pixel", w, h)
+		}
+	}
+}
+
+// The static and GIF paths must cut exactly the same pixels for the same
+// radius, whatever the aspect ratio.
+func TestRoundGIFMatchesStatic(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	for _, tt := range []struct {
+		name          string
+		width, height int
+		radius        Radius
+	}{
+		{"square", 48, 48, Radius{Value: 12}},
+		{"wide", 60, 30, Radius{Value: 40}},
+		{"tall", 30, 60, Radius{Value: 40}},
+		{"percent", 60, 40, Radius{Value: 30, Percent: true}},
+		{"circle", 40, 40, circleRadius},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			bounds := image.Rect(0, 0, tt.width, tt.height)
+			still := image.NewRGBA(bounds)
+			draw.Draw(still, bounds, &image.Uniform{red}, image.Point{}, draw.Src)
+			applyRoundedMask(still, tt.radius)
+
+			frame := image.NewPaletted(bounds, color.Palette{red})
+			src := &gif.GIF{
+				Image:    []*image.Paletted{frame},
+				Delay:    []int{10},
+				Disposal: []byte{gif.DisposalNone},
+				Config:   image.Config{Width: tt.width, Height: tt.height},
+			}
+			rounded, err := roundGIF(context.Background(), src, tt.radius)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := rounded.Image[0]
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					_, _, _, gifA := out.At(x, y).RGBA()
+					stillA := still.RGBAAt(x, y).A
+					if (gifA == 0) != (stillA == 0) {
+						t.Fatalf("(%d, %d): gif alpha %d, static alpha %d", x, y, gifA, stillA)
+					}
+				}
+			}
+		})
+	}
+}
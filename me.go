@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tiers that keep animated uploads; everyone else is downgraded to JPEG.
+var (
+	animatedAvatarTiers = []string{"drive", "pro", "max"}
+	animatedBannerTiers = []string{"pro", "max"}
+)
+
+// findUser returns the first user in users.json matching, or nil.
+func findUser(match func(User) bool) (*User, error) {
+	usersFile, err := os.ReadFile("users.json")
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(usersFile, &users); err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if match(users[i]) {
+			return &users[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func findUserByToken(token string) (*User, error) {
+	return findUser(func(u User) bool { return u.Key == token })
+}
+
+func findUserByName(username string) (*User, error) {
+	return findUser(func(u User) bool { return strings.EqualFold(u.Username, username) })
+}
+
+// userToken reads the user token from ?token= or an Authorization bearer.
+func userToken(c *gin.Context) string {
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token
+}
+
+// tokenUser resolves the request's token to a user, responding with an
+// error and returning nil when it can't.
+func tokenUser(c *gin.Context) *User {
+	token := userToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
+		return nil
+	}
+	user, err := findUserByToken(token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading users file"})
+		return nil
+	}
+	if user == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid token"})
+		return nil
+	}
+	return user
+}
+
+func tierLimits(user User) gin.H {
+	tier := strings.ToLower(user.GetSubscription())
+	slots := 0
+	if slices.Contains(animatedBannerTiers, tier) {
+		slots = maxBannerSlots
+	}
+	return gin.H{
+		"banner_slots":    slots,
+		"animated_avatar": slices.Contains(animatedAvatarTiers, tier),
+		"animated_banner": slices.Contains(animatedBannerTiers, tier),
+		"avatar_size":     assetDimensions["avatar"],
+		"banner_size":     assetDimensions["banner"],
+		"upload_bytes":    uploadLimit(user),
+	}
+}
+
+// meHandler returns everything the settings app needs to show a user's
+// avatar and banner in one call.
+func meHandler(c *gin.Context) {
+	user := tokenUser(c)
+	if user == nil {
+		return
+	}
+
+	username := strings.ToLower(user.Username)
+	tier := strings.ToLower(user.GetSubscription())
+
+	var used int64
+	for _, kind := range []string{"avatar", "banner"} {
+		if meta, ok, _ := lookupAsset(kind, username); ok {
+			used += meta.Size
+		}
+	}
+	slots := gin.H{}
+	for _, slot := range bannerSlots(username) {
+		key := bannerKey(username, slot)
+		if meta, ok, _ := lookupAsset("banner", key); ok {
+			used += meta.Size
+		}
+		slots[slot] = assetMetadata(c, "banner", key, "/.banners/"+username+"/"+slot)
+	}
+
+	history, err := readAuditEntries(username, 50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading audit log"})
+		return
+	}
+	failed := []AuditEntry{}
+	for _, entry := range history {
+		if entry.Result == "failed" && len(failed) < 10 {
+			failed = append(failed, entry)
+		}
+	}
+
+	uploads := gin.H{
+		"avatar": uploadsEnabled(*user, "avatar"),
+		"banner": uploadsEnabled(*user, "banner"),
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"username":      username,
+		"tier":          tier,
+		"limits":        tierLimits(*user),
+		"avatar":        assetMetadata(c, "avatar", username, "/"+username),
+		"banner":        assetMetadata(c, "banner", username, "/.banners/"+username),
+		"banner_slots":  slots,
+		"rotation":      bannerRotation(username),
+		"overlay":       savedOverlay(username),
+		"uploads":       uploads,
+		"storage_bytes": used,
+		"history":       history,
+		"failed":        failed,
+	})
+}
+
+func savedOverlay(username string) string {
+	meta, _, _ := lookupAsset("avatar", username)
+	return meta.Overlay
+}
+
+// meOverlayHandler saves the overlay plain avatar requests are composited
+// with. An empty name clears it.
+func meOverlayHandler(c *gin.Context) {
+	user := tokenUser(c)
+	if user == nil {
+		return
+	}
+	var req struct {
+		Overlay string `json:"overlay"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	name := strings.TrimSpace(req.Overlay)
+	if name != "" {
+		o, ok := findOverlay(name)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown overlay"})
+			return
+		}
+		if !o.Allowed(*user) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Overlay is not available for this user"})
+			return
+		}
+	}
+
+	username := strings.ToLower(user.Username)
+	if !setAssetOverlay("avatar", username, name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload an avatar first"})
+		return
+	}
+	avatarCache.Invalidate(username)
+	notifyPeers("avatar", username)
+
+	c.JSON(http.StatusOK, gin.H{"status": "Success", "overlay": name})
+}
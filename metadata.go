@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// assetMetadata is the public view of an indexed asset; storage paths and
+// hashes stay internal.
+func assetMetadata(c *gin.Context, kind, username, url string) gin.H {
+	meta, ok, _ := lookupAsset(kind, username)
+	if !ok {
+		return nil
+	}
+	info := gin.H{
+		"url":        publicURL(c, url),
+		"format":     meta.Format,
+		"width":      meta.Width,
+		"height":     meta.Height,
+		"size":       meta.Size,
+		"animated":   meta.Animated,
+		"updated_at": meta.UpdatedAt,
+		"alt":        getAltText(kind, username),
+	}
+	if kind == "banner" {
+		info["safe_area"] = meta.SafeArea
+	}
+	return info
+}
+
+func metadataHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+
+	avatar := assetMetadata(c, "avatar", username, "/"+username)
+	banner := assetMetadata(c, "banner", username, "/.banners/"+username)
+	if avatar == nil && banner == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User has no avatar or banner"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=60")
+	c.JSON(http.StatusOK, gin.H{
+		"username": username,
+		"avatar":   avatar,
+		"banner":   banner,
+	})
+}
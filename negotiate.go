@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Accept negotiation, from ACCEPT_NEGOTIATION. We can produce JPEG, PNG and
+// GIF; a client that accepts only some of them gets a variant re-encoded to
+// one it does accept. For a client that accepts none (e.g. only
+// image/avif), fallback serves JPEG anyway and strict answers 406. Off by
+// default: many clients send a non-image Accept for <img>-less fetches, and
+// those would otherwise get animated avatars as still JPEGs.
+const (
+	negotiateOff      = "off"
+	negotiateFallback = "fallback"
+	negotiateStrict   = "strict"
+)
+
+var acceptNegotiation = negotiateOff
+
+// Output formats spec.Format can force.
+const (
+	formatJPEG = "jpeg"
+	formatPNG  = "png"
+)
+
+var producibleTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// acceptQuality returns the q-value the Accept header gives mediaType, using
+// the most specific matching range; 0 means not acceptable.
+func acceptQuality(accept, mediaType string) float64 {
+	major, _, _ := strings.Cut(mediaType, "/")
+	best, bestSpecificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		r := strings.ToLower(strings.TrimSpace(params[0]))
+		specificity := -1
+		switch {
+		case r == mediaType:
+			specificity = 2
+		case r == major+"/*":
+			specificity = 1
+		case r == "*/*":
+			specificity = 0
+		}
+		if specificity < bestSpecificity || specificity < 0 {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		best, bestSpecificity = q, specificity
+	}
+	return best
+}
+
+// negotiateFormat sets spec.Format when the client's Accept header rules
+// out sourceType or what the transforms would make of it. It returns false
+// when it has answered 406 in strict mode.
+func negotiateFormat(c *gin.Context, spec *TransformSpec, sourceType string) bool {
+	// a converted format is an on-the-fly transform too
+	if acceptNegotiation == negotiateOff || presetOnly {
+		return true
+	}
+	c.Writer.Header().Add("Vary", "Accept")
+	accept := c.GetHeader("Accept")
+	if accept == "" {
+		return true
+	}
+
+	accepted := 0
+	for _, t := range producibleTypes {
+		if acceptQuality(accept, t) > 0 {
+			accepted++
+		}
+	}
+	if accepted == len(producibleTypes) {
+		return true
+	}
+
+	jpegQ, pngQ := acceptQuality(accept, "image/jpeg"), acceptQuality(accept, "image/png")
+	switch {
+	case jpegQ > 0 && jpegQ >= pngQ:
+		spec.Format = formatJPEG
+	case pngQ > 0:
+		spec.Format = formatPNG
+	case acceptQuality(accept, "image/gif") > 0 && sourceType == "image/gif":
+		// a GIF-only client keeps the animation as long as there is one
+		return true
+	case acceptNegotiation == negotiateStrict:
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"error":     "None of the accepted formats can be produced",
+			"available": producibleTypes,
+		})
+		return false
+	default:
+		spec.Format = formatJPEG
+	}
+
+	// the source already is the format asked for and nothing else changes
+	plain := *spec
+	plain.Format = ""
+	if plain.IsZero() && sourceType == "image/"+spec.Format {
+		spec.Format = ""
+	}
+	return true
+}
+
+// flattenImage composites img onto white, for JPEG output of an image with
+// transparent corners or letterboxing.
+func flattenImage(img image.Image) image.Image {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+// convertVariant re-encodes a rendered variant into the forced format, for
+// render paths (strips, composites) that pick their own output format. GIFs
+// keep their first frame.
+func convertVariant(ctx context.Context, variant CachedImage, format string) (CachedImage, error) {
+	if format == "" || variant.ContentType == "image/"+format {
+		return variant, nil
+	}
+	_, sp := startSpan(ctx, "convert")
+	defer sp.End()
+	sp.SetAttr("format", format)
+	img, _, err := image.Decode(bytes.NewReader(variant.Data))
+	if err != nil {
+		sp.RecordError(err)
+		return CachedImage{}, err
+	}
+	var buf bytes.Buffer
+	if format == formatPNG {
+		err = png.Encode(&buf, img)
+	} else {
+		err = encodeJPEG(&buf, flattenImage(img))
+	}
+	if err != nil {
+		sp.RecordError(err)
+		return CachedImage{}, err
+	}
+	return CachedImage{ContentType: "image/" + format, Data: buf.Bytes(), Timestamp: time.Now()}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept, mediaType string
+		want              float64
+	}{
+		{"image/png", "image/png", 1},
+		{"image/png", "image/jpeg", 0},
+		{"image/*", "image/gif", 1},
+		{"*/*", "image/jpeg", 1},
+		{"image/png;q=0.5, image/jpeg;q=0.8", "image/png", 0.5},
+		{"image/png;q=0.5, image/jpeg;q=0.8", "image/jpeg", 0.8},
+		{"image/*;q=0.3, image/png", "image/png", 1},
+		{"image/*;q=0.3, image/png", "image/gif", 0.3},
+		{"image/png;q=0, */*", "image/png", 0},
+		{"IMAGE/PNG", "image/png", 1},
+		{"image/avif,image/webp", "image/jpeg", 0},
+		{"application/json", "image/jpeg", 0},
+		{"image/jpeg;q=bogus", "image/jpeg", 1},
+		{"", "image/jpeg", 0},
+	}
+	for _, tt := range tests {
+		if got := acceptQuality(tt.accept, tt.mediaType); got != tt.want {
+			t.Errorf("acceptQuality(%q, %q) = %v, want %v", tt.accept, tt.mediaType, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := acceptNegotiation
+	t.Cleanup(func() { acceptNegotiation = old })
+
+	tests := []struct {
+		mode, accept, source string
+		spec                 TransformSpec
+		wantFormat           string
+		wantStatus           int // 0 when negotiation lets the request through
+	}{
+		{negotiateOff, "image/png", "image/jpeg", TransformSpec{}, "", 0},
+		{negotiateOff, "application/json", "image/gif", TransformSpec{}, "", 0},
+		{negotiateFallback, "", "image/gif", TransformSpec{}, "", 0},
+		{negotiateFallback, "*/*", "image/gif", TransformSpec{}, "", 0},
+		{negotiateFallback, "image/*", "image/gif", TransformSpec{}, "", 0},
+		{negotiateFallback, "image/png", "image/jpeg", TransformSpec{}, formatPNG, 0},
+		{negotiateFallback, "image/jpeg", "image/jpeg", TransformSpec{}, "", 0},
+		{negotiateFallback, "image/jpeg", "image/jpeg", TransformSpec{Size: 64}, formatJPEG, 0},
+		{negotiateFallback, "image/png;q=0.4, image/jpeg", "image/gif", TransformSpec{}, formatJPEG, 0},
+		{negotiateFallback, "image/gif", "image/gif", TransformSpec{}, "", 0},
+		{negotiateFallback, "image/avif", "image/gif", TransformSpec{}, formatJPEG, 0},
+		{negotiateFallback, "application/json", "image/gif", TransformSpec{}, formatJPEG, 0},
+		{negotiateStrict, "image/png", "image/gif", TransformSpec{}, formatPNG, 0},
+		{negotiateStrict, "image/avif", "image/jpeg", TransformSpec{}, "", http.StatusNotAcceptable},
+		{negotiateStrict, "image/gif", "image/jpeg", TransformSpec{}, "", http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.accept+" "+tt.source, func(t *testing.T) {
+			acceptNegotiation = tt.mode
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/someone", nil)
+			if tt.accept != "" {
+				c.Request.Header.Set("Accept", tt.accept)
+			}
+
+			spec := tt.spec
+			ok := negotiateFormat(c, &spec, tt.source)
+			if ok != (tt.wantStatus == 0) {
+				t.Fatalf("negotiateFormat = %v, want %v", ok, tt.wantStatus == 0)
+			}
+			if !ok && w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if spec.Format != tt.wantFormat {
+				t.Errorf("Format = %q, want %q", spec.Format, tt.wantFormat)
+			}
+			if vary := w.Header().Get("Vary"); (vary == "Accept") != (tt.mode != negotiateOff) {
+				t.Errorf("Vary = %q in mode %s", vary, tt.mode)
+			}
+		})
+	}
+}
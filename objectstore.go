@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With STORAGE_BACKEND=s3 the bucket is authoritative and the local storage
+// root is only a working copy: uploads are written through before they are
+// acknowledged, deletions go to both, and a local miss is pulled back from
+// the bucket. That lets the service run on containers whose disk does not
+// survive a restart. State kept beside the assets (the index, alt text,
+// rotations, the audit log and avatar history) is written through under the
+// "state" kind and restored on startup.
+
+// assetBackend is the authoritative store, or nil when local disk is.
+var assetBackend AssetStore
+
+// assetLister is an AssetStore that can list the objects of a kind.
+type assetLister interface {
+	List(kind string) ([]string, error)
+}
+
+// stateFiles are the state files restored by name when the backend can't
+// list what it holds.
+var stateFiles = []func() string{assetIndexPath, indexJournalPath, altTextPath, rotationPath, auditLogPath}
+
+// s3Store keeps assets in an S3-compatible bucket using path-style requests
+// signed with AWS Signature Version 4.
+type s3Store struct {
+	endpoint  string
+	bucket    string
+	region    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Store() (*s3Store, error) {
+	s := &s3Store{
+		endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		bucket:    os.Getenv("S3_BUCKET"),
+		region:    mustEnv("S3_REGION", "us-east-1"),
+		prefix:    strings.Trim(os.Getenv("S3_PREFIX"), "/"),
+		accessKey: os.Getenv("S3_ACCESS_KEY"),
+		secretKey: os.Getenv("S3_SECRET_KEY"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if s.endpoint == "" || s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required")
+	}
+	return s, nil
+}
+
+func (s *s3Store) Name() string {
+	return "s3:" + s.bucket
+}
+
+func (s *s3Store) key(kind, username, ext string) string {
+	return path.Join(s.prefix, filepath.ToSlash(assetPathAt("", layoutFlat, kind, username, ext)))
+}
+
+func (s *s3Store) Put(kind, username, ext string, data []byte) error {
+	resp, err := s.do(http.MethodPut, s.key(kind, username, ext), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(kind, username, ext string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, s.key(kind, username, ext), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	}
+	return nil, fmt.Errorf("get returned %d", resp.StatusCode)
+}
+
+func (s *s3Store) Stat(kind, username, ext string) (StoredObject, error) {
+	resp, err := s.do(http.MethodHead, s.key(kind, username, ext), nil)
+	if err != nil {
+		return StoredObject{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		return StoredObject{Size: size, ModTime: modTime}, nil
+	case http.StatusNotFound:
+		return StoredObject{}, os.ErrNotExist
+	}
+	return StoredObject{}, fmt.Errorf("head returned %d", resp.StatusCode)
+}
+
+func (s *s3Store) Delete(kind, username, ext string) error {
+	resp, err := s.do(http.MethodDelete, s.key(kind, username, ext), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("delete returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// List returns the name and extension of every object of a kind, such as
+// "alt.json" for state, using ListObjectsV2.
+func (s *s3Store) List(kind string) ([]string, error) {
+	dir := path.Join(s.prefix, kind+"s") + "/"
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {dir}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.doQuery(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("list returned %d", resp.StatusCode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			names = append(names, strings.TrimPrefix(obj.Key, dir))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Store) do(method, key string, body []byte) (*http.Response, error) {
+	return s.doQuery(method, key, nil, body)
+}
+
+func (s *s3Store) doQuery(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	uri := "/" + s3Escape(s.bucket)
+	if key != "" {
+		uri += "/" + s3Escape(key)
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	target := s.endpoint + uri
+	if canonicalQuery != "" {
+		target += "?" + canonicalQuery
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, uri, canonicalQuery, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// s3CanonicalQuery encodes a query the way SigV4 signs it: sorted by name,
+// with everything but unreserved characters escaped.
+func s3CanonicalQuery(query url.Values) string {
+	var parts []string
+	for name, values := range query {
+		for _, v := range values {
+			parts = append(parts, s3QueryEscape(name)+"="+s3QueryEscape(v))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+func s3QueryEscape(s string) string {
+	return strings.ReplaceAll(s3Escape(s), "/", "%2F")
+}
+
+// sign adds a SigV4 Authorization header; query must already be in
+// canonical form.
+func (s *s3Store) sign(req *http.Request, uri, query string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		uri,
+		query,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		s.accessKey, scope, signedHeaders, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape percent-encodes everything but unreserved characters and slashes.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// pullFromBackend replaces the local working copy of an asset with the one
+// in the backend, returning os.ErrNotExist when the backend has none.
+func pullFromBackend(kind, username string) error {
+	for _, ext := range []string{".gif", ".jpg"} {
+		data, err := assetBackend.Get(kind, username, ext)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := primaryStore.Put(kind, username, ext, data); err != nil {
+			return err
+		}
+		filePath := assetPath(kind, username, ext)
+		removeOtherFormats(kind, username, ext)
+		indexAsset(kind, username, filePath)
+		log.Printf("[storage] pulled %s from %s (%d bytes)", assetKey(kind, username), assetBackend.Name(), len(data))
+		return nil
+	}
+	return os.ErrNotExist
+}
+
+// removeBackendFormats deletes an asset from the backend in every format
+// except keepExt.
+func removeBackendFormats(kind, username, keepExt string) {
+	if assetBackend == nil {
+		return
+	}
+	for _, ext := range []string{".gif", ".jpg"} {
+		if ext == keepExt {
+			continue
+		}
+		if err := assetBackend.Delete(kind, username, ext); err != nil {
+			log.Printf("[storage] %s: failed to delete %s copy from %s: %v", assetKey(kind, username), ext, assetBackend.Name(), err)
+		}
+	}
+}
+
+// stateFileParts maps a file under the storage root to the name (its path
+// relative to the root) and extension it is kept under as state.
+func stateFileParts(filePath string) (string, string) {
+	rel, err := filepath.Rel(storageRoot(), filePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(filePath)
+	}
+	ext := filepath.Ext(rel)
+	return filepath.ToSlash(strings.TrimSuffix(rel, ext)), ext
+}
+
+// restoreStateFiles fetches the state files missing from local disk, so
+// they can be loaded as usual. It runs before the index is loaded.
+func restoreStateFiles() {
+	if assetBackend == nil {
+		return
+	}
+	var files []string
+	if lister, ok := assetBackend.(assetLister); ok {
+		names, err := lister.List("state")
+		if err != nil {
+			log.Printf("[storage] failed to list state on %s: %v", assetBackend.Name(), err)
+		}
+		for _, name := range names {
+			files = append(files, filepath.Join(storageRoot(), filepath.FromSlash(name)))
+		}
+	} else {
+		for _, statePath := range stateFiles {
+			files = append(files, statePath())
+		}
+	}
+
+	restored := 0
+	for _, filePath := range files {
+		if _, err := os.Stat(filePath); err == nil {
+			continue
+		}
+		name, ext := stateFileParts(filePath)
+		data, err := assetBackend.Get("state", name, ext)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("[storage] failed to restore %s from %s: %v", name+ext, assetBackend.Name(), err)
+			}
+			continue
+		}
+		if err := writeAssetFile(filePath, data); err != nil {
+			log.Printf("[storage] failed to restore %s: %v", filePath, err)
+			continue
+		}
+		restored++
+	}
+	if restored > 0 {
+		log.Printf("[storage] restored %d state files from %s", restored, assetBackend.Name())
+	}
+}
+
+// writeStateFile writes a sidecar file locally and through to the backend.
+func writeStateFile(filePath string, data []byte) error {
+	if err := writeAssetFile(filePath, data); err != nil {
+		return err
+	}
+	if assetBackend == nil {
+		return nil
+	}
+	name, ext := stateFileParts(filePath)
+	if err := assetBackend.Put("state", name, ext, data); err != nil {
+		return fmt.Errorf("storing on %s: %w", assetBackend.Name(), err)
+	}
+	return nil
+}
+
+// removeStateFile deletes a state file locally and from the backend.
+func removeStateFile(filePath string) error {
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if assetBackend == nil {
+		return nil
+	}
+	name, ext := stateFileParts(filePath)
+	return assetBackend.Delete("state", name, ext)
+}
+
+// removeStateDir deletes a directory of state files, such as a user's
+// avatar history, locally and from the backend.
+func removeStateDir(dir string) error {
+	if assetBackend != nil {
+		files, _ := os.ReadDir(dir)
+		for _, f := range files {
+			if err := removeStateFile(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// moveStateDir renames a directory of state files and moves their backend
+// copies along.
+func moveStateDir(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if assetBackend == nil {
+		return nil
+	}
+	files, _ := os.ReadDir(to)
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(to, f.Name()))
+		if err == nil {
+			err = writeStateFile(filepath.Join(to, f.Name()), data)
+		}
+		if err == nil {
+			name, ext := stateFileParts(filepath.Join(from, f.Name()))
+			err = assetBackend.Delete("state", name, ext)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	stateBackupPending = make(map[string]bool)
+	stateBackupMutex   sync.Mutex
+)
+
+// backupStateFile copies a file that is appended to in place, such as the
+// audit log, to the backend in the background. Backups requested while one
+// is queued fold into it.
+func backupStateFile(filePath string) {
+	if assetBackend == nil {
+		return
+	}
+	stateBackupMutex.Lock()
+	defer stateBackupMutex.Unlock()
+	if stateBackupPending[filePath] {
+		return
+	}
+	stateBackupPending[filePath] = true
+	go func() {
+		stateBackupMutex.Lock()
+		delete(stateBackupPending, filePath)
+		stateBackupMutex.Unlock()
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return
+		}
+		name, ext := stateFileParts(filePath)
+		if err := assetBackend.Put("state", name, ext, data); err != nil {
+			log.Printf("[storage] failed to back up %s to %s: %v", name+ext, assetBackend.Name(), err)
+		}
+	}()
+}
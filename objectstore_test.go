@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory bucket speaking the handful of requests s3Store
+// makes.
+func fakeS3(t *testing.T) (*s3Store, map[string][]byte) {
+	objects := map[string][]byte{}
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/bucket":
+			type content struct{ Key string }
+			var result struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Contents []content
+			}
+			var keys []string
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				result.Contents = append(result.Contents, content{k})
+			}
+			xml.NewEncoder(w).Encode(result)
+		case r.Method == http.MethodPut:
+			objects[key], _ = io.ReadAll(r.Body)
+		case r.Method == http.MethodGet, r.Method == http.MethodHead:
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &s3Store{endpoint: srv.URL, bucket: "bucket", region: "us-east-1", accessKey: "a", secretKey: "s", client: srv.Client()}, objects
+}
+
+func TestStateFilesRoundTripThroughBackend(t *testing.T) {
+	store, objects := fakeS3(t)
+	oldBackend, oldPath := assetBackend, documentPath
+	t.Cleanup(func() { assetBackend, documentPath = oldBackend, oldPath })
+	assetBackend, documentPath = store, t.TempDir()
+
+	history := filepath.Join(historyDir("alice"), "1700000000000.jpg")
+	for path, data := range map[string]string{
+		assetIndexPath(): `{"assets":{}}`,
+		altTextPath():    `{"avatar:alice":"hi"}`,
+		history:          "jpeg bytes",
+	} {
+		if err := writeStateFile(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := objects["states/index.json"]; !ok {
+		t.Errorf("index not written through, bucket has %d objects", len(objects))
+	}
+
+	// a fresh container: nothing on local disk
+	documentPath = t.TempDir()
+	restoreStateFiles()
+	for _, path := range []string{assetIndexPath(), altTextPath(), filepath.Join(historyDir("alice"), "1700000000000.jpg")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s not restored: %v", path, err)
+		}
+	}
+
+	if err := removeStateDir(historyDir("alice")); err != nil {
+		t.Fatal(err)
+	}
+	for key := range objects {
+		if strings.Contains(key, "history") {
+			t.Errorf("%s left in the bucket", key)
+		}
+	}
+}
+
+func TestRestoredIndexKeepsMetadataOfUnpulledAssets(t *testing.T) {
+	store, _ := fakeS3(t)
+	oldBackend, oldPath, oldIndex, oldDetached := assetBackend, documentPath, assetIndex, detachedMeta
+	t.Cleanup(func() {
+		assetBackend, documentPath, assetIndex, detachedMeta = oldBackend, oldPath, oldIndex, oldDetached
+	})
+	assetBackend, documentPath = store, t.TempDir()
+
+	index := `{"assets":{"avatar:bob":{"username":"bob","kind":"avatar","path":"/gone/bob.jpg","format":"jpg","overlay":"halo","focus":[0.2,0.3]}}}`
+	if err := writeStateFile(assetIndexPath(), []byte(index)); err != nil {
+		t.Fatal(err)
+	}
+	loadAssetIndex()
+	if _, ok, _ := lookupAsset("avatar", "bob"); ok {
+		t.Fatal("an asset missing from local disk was indexed")
+	}
+
+	saveAssetIndex()
+	data, _ := os.ReadFile(assetIndexPath())
+	if !strings.Contains(string(data), `"overlay":"halo"`) {
+		t.Errorf("saving dropped the detached entry: %s", data)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read-through origin: when an asset is missing locally, fetch it from the
+// storage backend or the legacy host, store it, and serve it as if it had
+// been uploaded here.
+
+const originMissTTL = 10 * time.Minute
+
+var (
+	originURL    string
+	originClient = &http.Client{Timeout: 10 * time.Second}
+
+	originMisses   = make(map[string]time.Time)
+	originInflight = make(map[string]*sync.WaitGroup)
+	originMutex    sync.Mutex
+
+	// originDefaults holds the hashes of the images the origin answers
+	// unknown users with, per kind; probed records whether the origin has
+	// been asked for a user that can't exist yet.
+	originDefaults = map[string]map[string]bool{}
+	originProbed   = map[string]bool{}
+
+	// originPullLimit caps the pulls from the origin per minute, from
+	// ORIGIN_PULLS_PER_MINUTE, so anonymous requests for made-up names
+	// can't drive unbounded fetches.
+	originPullLimit   = 60
+	originPulls       int
+	originPullsWindow time.Time
+)
+
+var (
+	errOriginDefault   = errors.New("origin answered with its default image")
+	errOriginThrottled = errors.New("origin pull limit reached")
+	errOriginStatus    = errors.New("origin returned")
+)
+
+func originAssetURL(kind, username string) string {
+	base := strings.TrimSuffix(originURL, "/")
+	if kind == "banner" {
+		user, slot := splitBannerKey(username)
+		if slot != "" {
+			return base + "/.banners/" + url.PathEscape(user) + "/" + url.PathEscape(slot)
+		}
+		return base + "/.banners/" + url.PathEscape(username)
+	}
+	return base + "/" + url.PathEscape(username)
+}
+
+// hasReadThrough reports whether local misses can be fetched from elsewhere.
+func hasReadThrough() bool {
+	return originURL != "" || assetBackend != nil
+}
+
+// fetchFromOrigin pulls a missing asset from the storage backend or the
+// origin into local storage. Concurrent callers for the same asset share one
+// fetch, and misses are remembered for originMissTTL.
+func fetchFromOrigin(kind, username string) error {
+	if !hasReadThrough() {
+		return fmt.Errorf("no origin configured")
+	}
+	key := assetKey(kind, username)
+
+	originMutex.Lock()
+	if missed, ok := originMisses[key]; ok && time.Since(missed) < originMissTTL {
+		originMutex.Unlock()
+		return fmt.Errorf("%s not found on origin", key)
+	}
+	if wg, ok := originInflight[key]; ok {
+		originMutex.Unlock()
+		wg.Wait()
+		return nil
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	originInflight[key] = wg
+	originMutex.Unlock()
+
+	err := pullFromOrigin(kind, username)
+
+	originMutex.Lock()
+	delete(originInflight, key)
+	if err != nil && !errors.Is(err, errOriginThrottled) {
+		originMisses[key] = time.Now()
+	}
+	originMutex.Unlock()
+	wg.Done()
+
+	if err != nil {
+		log.Printf("[origin] %s: %v", key, err)
+	}
+	return err
+}
+
+// forgetOriginMiss drops a remembered miss, once the asset may exist.
+func forgetOriginMiss(kind, username string) {
+	originMutex.Lock()
+	delete(originMisses, assetKey(kind, username))
+	originMutex.Unlock()
+}
+
+func pullFromOrigin(kind, username string) error {
+	if assetBackend != nil {
+		if err := pullFromBackend(kind, username); !errors.Is(err, os.ErrNotExist) || originURL == "" {
+			return err
+		}
+	}
+	if !takeOriginPull() {
+		return errOriginThrottled
+	}
+	probeOriginDefault(kind)
+	data, err := getFromOrigin(originAssetURL(kind, username))
+	if err != nil {
+		return err
+	}
+	if isOriginDefault(kind, data) {
+		return errOriginDefault
+	}
+
+	ext := ".jpg"
+	switch http.DetectContentType(data) {
+	case "image/gif":
+		ext = ".gif"
+	case "image/jpeg":
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("decoding origin image: %w", err)
+		}
+		var buf bytes.Buffer
+		if err := encodeJPEG(&buf, img); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	filePath, err := storeAsset(kind, username, ext, data)
+	if err != nil {
+		return err
+	}
+	indexAsset(kind, username, filePath)
+	log.Printf("[origin] stored %s from origin (%d bytes)", assetKey(kind, username), len(data))
+	return nil
+}
+
+func getFromOrigin(target string) ([]byte, error) {
+	resp, err := originClient.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w %d", errOriginStatus, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+}
+
+// takeOriginPull counts a pull against the per-minute limit, reporting
+// false once it is used up.
+func takeOriginPull() bool {
+	if originPullLimit <= 0 {
+		return true
+	}
+	originMutex.Lock()
+	defer originMutex.Unlock()
+	if now := time.Now(); now.Sub(originPullsWindow) >= time.Minute {
+		originPullsWindow, originPulls = now, 0
+	}
+	if originPulls >= originPullLimit {
+		return false
+	}
+	originPulls++
+	return true
+}
+
+// probeOriginDefault learns what the origin serves for a user that doesn't
+// exist, once per kind. Legacy hosts answer unknown users with their
+// default image and a 200, which must not be stored as an upload.
+func probeOriginDefault(kind string) {
+	originMutex.Lock()
+	probed := originProbed[kind]
+	originMutex.Unlock()
+	if probed {
+		return
+	}
+
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	data, err := getFromOrigin(originAssetURL(kind, "avatars-probe-"+hex.EncodeToString(nonce)))
+
+	originMutex.Lock()
+	defer originMutex.Unlock()
+	// a 404 is the answer we want; only a failed request is retried
+	if err != nil && !errors.Is(err, errOriginStatus) {
+		return
+	}
+	originProbed[kind] = true
+	if err == nil {
+		addOriginDefault(kind, data)
+		log.Printf("[origin] origin serves a default %s for unknown users; it will not be stored", kind)
+	}
+}
+
+// addOriginDefault must be called with originMutex held.
+func addOriginDefault(kind string, data []byte) {
+	sum := sha256.Sum256(data)
+	if originDefaults[kind] == nil {
+		originDefaults[kind] = map[string]bool{}
+	}
+	originDefaults[kind][hex.EncodeToString(sum[:])] = true
+}
+
+// isOriginDefault reports whether data is the origin's default for kind,
+// or one of our own defaults, which a legacy host of this service serves
+// too.
+func isOriginDefault(kind string, data []byte) bool {
+	own := [][]byte{defaultImageContent}
+	if kind == "banner" {
+		own = [][]byte{defaultBanner(themeLight), defaultBanner(themeDark)}
+	}
+	for _, d := range own {
+		if len(d) > 0 && bytes.Equal(d, data) {
+			return true
+		}
+	}
+	sum := sha256.Sum256(data)
+	originMutex.Lock()
+	defer originMutex.Unlock()
+	return originDefaults[kind][hex.EncodeToString(sum[:])]
+}
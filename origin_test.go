@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPullFromOriginSkipsDefault(t *testing.T) {
+	var real, fallback bytes.Buffer
+	jpeg.Encode(&real, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+	jpeg.Encode(&fallback, image.NewGray(image.Rect(0, 0, 4, 4)), nil)
+	pulls := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pulls++
+		if r.URL.Path == "/alice" {
+			w.Write(real.Bytes())
+			return
+		}
+		w.Write(fallback.Bytes()) // legacy hosts answer unknown users with a 200
+	}))
+	defer origin.Close()
+
+	oldURL, oldPath, oldIndex, oldLimit := originURL, documentPath, assetIndex, originPullLimit
+	t.Cleanup(func() {
+		originURL, documentPath, assetIndex, originPullLimit = oldURL, oldPath, oldIndex, oldLimit
+		originDefaults, originProbed, originMisses = map[string]map[string]bool{}, map[string]bool{}, map[string]time.Time{}
+	})
+	originURL, documentPath = origin.URL, t.TempDir()
+	assetIndex = make(map[string]AssetMeta)
+	originPullLimit = 2
+
+	if err := pullFromOrigin("avatar", "nobody"); err != errOriginDefault {
+		t.Fatalf("pull of unknown user = %v, want errOriginDefault", err)
+	}
+	if _, ok, _ := lookupAsset("avatar", "nobody"); ok {
+		t.Error("origin default was indexed")
+	}
+	if err := pullFromOrigin("avatar", "alice"); err != nil {
+		t.Fatalf("pull of alice: %v", err)
+	}
+	if _, ok, _ := lookupAsset("avatar", "alice"); !ok {
+		t.Error("alice was not indexed")
+	}
+	if err := pullFromOrigin("avatar", "bob"); err != errOriginThrottled {
+		t.Errorf("pull over the limit = %v, want errOriginThrottled", err)
+	}
+	if pulls != 3 { // the probe plus two pulls
+		t.Errorf("origin saw %d requests, want 3", pulls)
+	}
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+
+	"github.com/gin-gonic/gin"
 )
 
 type Overlay struct {
@@ -11,25 +17,152 @@ type Overlay struct {
 	Requires string
 	Size     [2]int
 	Offset   [2]int
+
+	// Listing metadata for client UIs. Tier is the minimum tier shown to
+	// users and doubles as the requirement when Requires is empty; Price is
+	// in credits.
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	Preview     string `json:"preview"`
+	Tier        string `json:"tier"`
+	Price       int    `json:"price"`
+
+	require requirement
 }
 
-func loadOverlays() []Overlay {
-	overlaysPath := filepath.Join("./overlays", "-manifest.json")
+// Allowed reports whether user meets the overlay's requirement.
+func (o Overlay) Allowed(u User) bool {
+	return o.require == nil || o.require(userRequirementEnv(u))
+}
 
-	_, err := os.Stat(overlaysPath)
-	if err != nil {
-		return nil
+var (
+	overlayDir = "./overlays"
+	overlays   []Overlay
+)
+
+func findOverlay(name string) (Overlay, bool) {
+	for _, o := range overlays {
+		if o.Name == name {
+			return o, true
+		}
 	}
+	return Overlay{}, false
+}
+
+func loadOverlays() []Overlay {
+	overlaysPath := filepath.Join(overlayDir, "-manifest.json")
 
 	overlays, err := os.ReadFile(overlaysPath)
 	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[overlays] failed to read %s: %v", overlaysPath, err)
+		}
 		return nil
 	}
 
 	var overlaysData []Overlay
 	err = json.Unmarshal(overlays, &overlaysData)
 	if err != nil {
+		log.Printf("[overlays] malformed %s: %v", overlaysPath, err)
 		return nil
 	}
-	return overlaysData
+
+	valid := overlaysData[:0]
+	seen := make(map[string]bool)
+	for i, overlay := range overlaysData {
+		if err := validateOverlay(overlay, seen); err != nil {
+			log.Printf("[overlays] skipping entry %d (%q): %v", i, overlay.Name, err)
+			continue
+		}
+		requires := overlay.Requires
+		if requires == "" {
+			requires = overlay.Tier
+		}
+		req, err := compileRequirement(requires)
+		if err != nil {
+			log.Printf("[overlays] skipping %s: invalid requires %q: %v", overlay.Name, requires, err)
+			continue
+		}
+		overlay.require = req
+		seen[overlay.Name] = true
+		valid = append(valid, overlay)
+	}
+	return valid
+}
+
+func validateOverlay(o Overlay, seen map[string]bool) error {
+	switch {
+	case o.Name == "":
+		return errors.New("missing name")
+	case seen[o.Name]:
+		return errors.New("duplicate name")
+	case o.Size[0] <= 0 || o.Size[1] <= 0:
+		return fmt.Errorf("size must be positive, got %v", o.Size)
+	case o.Tier != "" && tierRank(o.Tier) < 0:
+		return fmt.Errorf("unknown tier %q, expected one of %v", o.Tier, tierOrder)
+	case o.Price < 0:
+		return fmt.Errorf("price must not be negative, got %d", o.Price)
+	}
+	if _, err := os.Stat(filepath.Join(overlayDir, o.Name)); err != nil {
+		return fmt.Errorf("image not found in %s", overlayDir)
+	}
+	if o.Preview != "" {
+		if _, err := os.Stat(filepath.Join(overlayDir, o.Preview)); err != nil {
+			return fmt.Errorf("preview %q not found in %s", o.Preview, overlayDir)
+		}
+	}
+	return nil
+}
+
+// overlaysHandler lists the loaded overlays. When the request carries a
+// token, each entry also says whether that user can use it.
+func overlaysHandler(c *gin.Context) {
+	var user *User
+	if token := userToken(c); token != "" {
+		user, _ = findUserByToken(token)
+	}
+
+	list := make([]gin.H, 0, len(overlays))
+	for _, o := range overlays {
+		displayName := o.DisplayName
+		if displayName == "" {
+			displayName = o.Name
+		}
+		entry := gin.H{
+			"name":         o.Name,
+			"display_name": displayName,
+			"description":  o.Description,
+			"preview":      publicURL(c, "/.overlays/"+o.Name),
+			"tier":         o.Tier,
+			"price":        o.Price,
+			"requires":     o.Requires,
+		}
+		if user != nil {
+			entry["available"] = o.Allowed(*user)
+		}
+		list = append(list, entry)
+	}
+
+	if user != nil {
+		c.Header("Cache-Control", "private, no-store")
+	} else {
+		c.Header("Cache-Control", "public, max-age=300")
+	}
+	c.JSON(http.StatusOK, gin.H{"overlays": list})
+}
+
+// overlayPreviewHandler serves an overlay's preview image, falling back to
+// the overlay itself.
+func overlayPreviewHandler(c *gin.Context) {
+	o, ok := findOverlay(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown overlay"})
+		return
+	}
+	file := o.Preview
+	if file == "" {
+		file = o.Name
+	}
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.File(filepath.Join(overlayDir, file))
 }
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/esimov/colorquant"
+)
+
+// extractPalette reduces img to at most n representative colours using
+// median-cut clustering.
+func extractPalette(img image.Image, n int) color.Palette {
+	if p, ok := (colorquant.Quant{}).Quantize(img, n).(*image.Paletted); ok {
+		return p.Palette
+	}
+	return nil
+}
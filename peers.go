@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Instances sharing a storage volume each keep their own asset index and
+// variant caches. The instance that handles a change tells every peer in
+// CACHE_PEERS to refresh that asset, so they stop serving the old one.
+var (
+	cachePeers []string
+	peerClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// invalidation carries what a peer can't read back from the asset file:
+// its index entry, its alt text and the aliases pointing at its user. Alt
+// and Aliases are left alone when the sender leaves them out.
+type invalidation struct {
+	Overlay  string           `json:"overlay"`
+	Focus    *Focus           `json:"focus,omitempty"`
+	SafeArea *SafeArea        `json:"safe_area,omitempty"`
+	Alt      *string          `json:"alt,omitempty"`
+	Aliases  map[string]Alias `json:"aliases"`
+}
+
+// assetState collects the invalidation payload for an asset as it is here.
+func assetState(kind, username string) invalidation {
+	alt := getAltText(kind, username)
+	owner, _ := splitBannerKey(username)
+	state := invalidation{Alt: &alt, Aliases: aliasesOf(owner)}
+	if meta, ok, _ := lookupAsset(kind, username); ok {
+		state.Overlay, state.Focus, state.SafeArea = meta.Overlay, meta.Focus, meta.SafeArea
+	}
+	return state
+}
+
+// applyAssetState indexes the asset file at path with the sender's entry,
+// alt text and aliases. Peers share the sender's state files and only
+// update memory; a standby keeps its own and saves them.
+func applyAssetState(kind, username, path string, state invalidation, save bool) {
+	if path != "" {
+		indexAssetWith(kind, username, path, func(meta *AssetMeta) {
+			meta.Overlay, meta.Focus, meta.SafeArea = state.Overlay, state.Focus, state.SafeArea
+		})
+	}
+	if state.Alt != nil {
+		if save {
+			setAltText(kind, username, *state.Alt)
+		} else {
+			cacheAltText(kind, username, *state.Alt)
+		}
+	}
+	if state.Aliases != nil {
+		owner, _ := splitBannerKey(username)
+		replaceAliasesOf(owner, state.Aliases)
+	}
+}
+
+func parsePeers(spec string) []string {
+	var peers []string
+	for _, peer := range strings.Split(spec, ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// notifyPeers fans an invalidation out to every peer in the background;
+// failures are only logged, as peers fall back to their cache TTL.
+func notifyPeers(kind, username string) {
+	if len(cachePeers) == 0 {
+		return
+	}
+	data, err := json.Marshal(assetState(kind, username))
+	if err != nil {
+		return
+	}
+	for _, peer := range cachePeers {
+		go func() {
+			if err := postInvalidation(peer, kind, username, data); err != nil {
+				log.Printf("[peers] failed to invalidate %s %s on %s: %v", kind, username, peer, err)
+			}
+		}()
+	}
+}
+
+func postInvalidation(peer, kind, username string, data []byte) error {
+	target := fmt.Sprintf("%s/admin/invalidate/%s/%s?ADMIN_TOKEN=%s",
+		peer, kind, url.PathEscape(username), url.QueryEscape(ADMIN_TOKEN))
+	resp, err := peerClient.Post(target, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("peer returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// invalidateHandler re-reads one asset from shared storage, applies the
+// sender's index entry, alt text and aliases, and drops the cached variants
+// of its kind. It does not fan out further.
+func invalidateHandler(c *gin.Context) {
+	kind, username := c.Param("kind"), strings.ToLower(c.Param("username"))
+	if kind != "avatar" && kind != "banner" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown asset kind"})
+		return
+	}
+	var req invalidation
+	c.ShouldBindJSON(&req)
+
+	// the local copy is only a working copy of the backend's
+	if assetBackend != nil {
+		if err := pullFromBackend(kind, username); errors.Is(err, os.ErrNotExist) {
+			removeOtherFormats(kind, username, "")
+		} else if err != nil {
+			log.Printf("[peers] failed to refresh %s from %s: %v", assetKey(kind, username), assetBackend.Name(), err)
+		}
+		forgetOriginMiss(kind, username)
+	}
+
+	found := false
+	for _, ext := range []string{".gif", ".jpg"} {
+		path := assetPath(kind, username, ext)
+		if _, err := os.Stat(path); err == nil {
+			applyAssetState(kind, username, path, req, false)
+			found = true
+			break
+		}
+	}
+	if !found {
+		unindexAsset(kind, username)
+		applyAssetState(kind, username, "", req, false)
+	}
+
+	if kind == "avatar" {
+		avatarCache.Invalidate(username)
+	} else {
+		bannerCache.Invalidate(username)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Success", "exists": found})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestInvalidationCarriesIndexEntry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldPath, oldIndex, oldAliases, oldAlt := documentPath, assetIndex, userAliases, altTexts
+	t.Cleanup(func() {
+		documentPath, assetIndex, userAliases, altTexts = oldPath, oldIndex, oldAliases, oldAlt
+	})
+	documentPath = t.TempDir()
+	assetIndex = make(map[string]AssetMeta)
+	userAliases = map[string]Alias{"stale": {Target: "bob"}, "other": {Target: "carol"}}
+	altTexts = make(map[string]string)
+
+	path := assetPath("avatar", "bob", ".jpg")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 16)), nil)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	alt := "A red fox"
+	body, _ := json.Marshal(invalidation{
+		Overlay:  "halo",
+		Focus:    &Focus{0.25, 0.75},
+		SafeArea: &SafeArea{X: 0.1, Width: 0.5, Height: 1},
+		Alt:      &alt,
+		Aliases:  map[string]Alias{"bobby": {Target: "bob", Redirect: true}},
+	})
+
+	r := gin.New()
+	r.POST("/admin/invalidate/:kind/:username", invalidateHandler)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/invalidate/avatar/bob", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	meta, ok, _ := lookupAsset("avatar", "bob")
+	if !ok {
+		t.Fatal("asset not indexed")
+	}
+	if meta.Overlay != "halo" || meta.Focus == nil || *meta.Focus != (Focus{0.25, 0.75}) || meta.SafeArea == nil || meta.SafeArea.Width != 0.5 {
+		t.Errorf("index entry not applied: %+v", meta)
+	}
+	if got := getAltText("avatar", "bob"); got != alt {
+		t.Errorf("alt = %q, want %q", got, alt)
+	}
+	if got := aliasesOf("bob"); len(got) != 1 || !got["bobby"].Redirect {
+		t.Errorf("aliases of bob = %v", got)
+	}
+	if _, ok := lookupAlias("other"); !ok {
+		t.Error("alias of another user was dropped")
+	}
+}
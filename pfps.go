@@ -2,46 +2,48 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
 	"image"
 	"image/gif"
-	"image/jpeg"
+	"image/png"
+	"io"
 	"net/http"
 	"os"
-	"path/filepath"
 	"slices"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nfnt/resize"
 )
 
-var (
-	transformCache = make(map[string]CachedImage)
-)
-
 func deleteAvatars(username string) error {
-	avatarDir := filepath.Join(documentPath, "rotur", "avatars")
 	base := strings.ToLower(username)
 
 	extensions := []string{".gif", ".jpg"}
 	for _, ext := range extensions {
-		filePath := filepath.Join(avatarDir, base+ext)
-		_ = os.Remove(filePath)
+		_ = os.Remove(assetPath("avatar", base, ext))
 	}
+	deletePresets(base)
+	unindexAsset("avatar", base)
 	return nil
 }
 
 func getAvatarMetadata(username string) (string, string, string, error) {
-	avatarDir := filepath.Join(documentPath, "rotur", "avatars")
+	if meta, ok, ready := lookupAsset("avatar", username); ready {
+		if !ok {
+			return "", "", "", os.ErrNotExist
+		}
+		return meta.Path, meta.ContentType(), meta.Etag(), nil
+	}
+
 	base := strings.ToLower(username)
 
 	extensions := []string{".gif", ".jpg"}
 	for _, ext := range extensions {
-		filePath := filepath.Join(avatarDir, base+ext)
+		filePath := assetPath("avatar", base, ext)
 		info, err := os.Stat(filePath)
 		if err == nil {
 			contentType := "image/jpeg"
@@ -58,194 +60,427 @@ func getAvatarMetadata(username string) (string, string, string, error) {
 
 func avatarHandler(c *gin.Context) {
 	username, _ := strings.CutSuffix(strings.ToLower(c.Param("username")), ".gif")
-	radius := c.Query("radius")
-	sizeStr := c.Query("s")
-
-	clientEtag := c.GetHeader("If-None-Match")
+	username, ok := resolveAlias(c, "avatar", username)
+	if !ok {
+		return
+	}
+	spec, err := parseTransformSpec(c, "avatar")
+	if err != nil {
+		invalidTransform(c, err)
+		return
+	}
+	if presetOnly {
+		// only the preset sizes are served; anything else would render
+		unsized := spec
+		unsized.Size = 0
+		if !unsized.IsZero() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Transforms are disabled on this server"})
+			return
+		}
+		if handlePresetAvatar(c, username, c.Query("s")) {
+			return
+		}
+	}
+	if redirectToCanonical(c, spec) {
+		return
+	}
+	startPipeline(c)
 
 	filePath, contentType, baseEtag, metaErr := getAvatarMetadata(username)
+	if metaErr != nil && hasReadThrough() && fetchFromOrigin("avatar", username) == nil {
+		filePath, contentType, baseEtag, metaErr = getAvatarMetadata(username)
+	}
 
 	finalEtagBase := baseEtag
 	if metaErr != nil {
-		contentType = "image/jpeg"
-		finalEtagBase = defaultImageEtag
+		contentType = defaultAvatarType()
+		theme := requestTheme(c)
+		_, finalEtagBase = defaultAvatar(theme)
+		c.Request = c.Request.WithContext(withTheme(c.Request.Context(), theme))
+	}
+
+	if metaErr != nil && errorPlaceholders {
+		servePlaceholder(c, http.StatusNotFound)
+		return
+	}
+	if metaErr == nil {
+		setAltTextHeader(c, "avatar", username)
 	}
 
-	modifierParts := []string{}
-	if sizeStr != "" {
-		modifierParts = append(modifierParts, "size="+sizeStr)
+	sourceHash := finalEtagBase
+	_, explicitOverlay := c.GetQuery("overlay")
+	if meta, ok, _ := lookupAsset("avatar", username); ok && metaErr == nil {
+		sourceHash = meta.Hash
+		spec = spec.withoutNoops(meta.Width)
+		spec.focus = meta.Focus
+		setPipelineSource(c, meta.Width, meta.Height)
+		if _, known := findOverlay(meta.Overlay); known && !explicitOverlay {
+			spec.Overlay = meta.Overlay
+		}
 	}
-	if radius != "" {
-		modifierParts = append(modifierParts, "radius="+radius)
+
+	if spec.Overlay != "" {
+		o, _ := findOverlay(spec.Overlay)
+		owner, err := findUserByName(username)
+		switch {
+		case err == nil && owner != nil && o.Allowed(*owner):
+			// animated results are a paid feature, like animated uploads
+			spec.OverlayStill = !slices.Contains(animatedAvatarTiers, strings.ToLower(owner.GetSubscription()))
+		case explicitOverlay:
+			countFeature(statOverlayRejected, "", "")
+			c.JSON(http.StatusForbidden, gin.H{"error": "Overlay is not available for this user"})
+			return
+		default:
+			// a saved overlay the user no longer qualifies for is skipped
+			spec.Overlay = ""
+		}
 	}
-	modifier := strings.Join(modifierParts, "-")
 
-	if modifier == "" {
+	if !negotiateFormat(c, &spec, contentType) {
+		return
+	}
+
+	if spec.IsZero() {
 		if metaErr == nil {
-			if clientEtag == fmt.Sprintf(`"%s"`, finalEtagBase) {
-				c.Status(http.StatusNotModified)
+			if notModified(c, fmt.Sprintf(`"%s"`, finalEtagBase)) {
 				return
 			}
 
 			c.Header("ETag", fmt.Sprintf(`"%s"`, finalEtagBase))
 			c.Header("Content-Type", contentType)
-			c.Header("Cache-Control", "public, max-age=0, must-revalidate")
+			setCachePolicy(c, cacheOriginal)
 			if c.Request.Method == http.MethodHead {
 				c.Status(200)
 				return
 			}
+			countAnimatedServe(contentType)
 			c.File(filePath)
 			return
 		}
 	}
 
-	cacheKey := finalEtagBase
-	if modifier != "" {
-		cacheKey = cacheKey + "-" + modifier
+	cacheKey := spec.Key(finalEtagBase)
+	etag := transformETag(spec, sourceHash)
+	if metaErr == nil {
+		avatarCache.recordHot(username, spec)
 	}
 
 	if c.Request.Method == http.MethodHead {
 		c.Header("Content-Type", contentType)
 		c.Header("Cache-Control", "public, max-age=0, must-revalidate")
-		c.Header("ETag", fmt.Sprintf(`"%s"`, cacheKey))
+		c.Header("ETag", etag)
 		c.Status(200)
 		return
 	}
 
-	cacheMutex.RLock()
-	cached, ok := transformCache[cacheKey]
-	cacheMutex.RUnlock()
+	ctx := c.Request.Context()
+	_, lookup := startSpan(ctx, "cache.lookup")
+	cached, ok := avatarCache.Get(cacheKey)
+	lookup.SetAttr("cache.hit", ok)
+	lookup.End()
 
 	if ok {
-		if clientEtag == fmt.Sprintf(`"%s"`, cacheKey) {
-			c.Status(http.StatusNotModified)
+		status := avatarCache.Status(cached)
+		if status == cacheHit || avatarCache.swr {
+			if status == cacheStale {
+				queueTransform(avatarCache, cacheKey, c.Request.URL.RequestURI(), func() (CachedImage, error) {
+					return renderAvatar(withTheme(context.Background(), themeFrom(ctx)), filePath, metaErr, spec)
+				})
+			}
+
+			if notModified(c, etag) {
+				return
+			}
+
+			c.Header("ETag", etag)
+			setCachePolicy(c, avatarVariantClass(cached.ContentType, metaErr))
+			setCacheStatus(c, status, cached.Timestamp)
+			setPipelineHeaders(c)
+			countAnimatedServe(cached.ContentType)
+			c.Data(http.StatusOK, cached.ContentType, cached.Data)
 			return
 		}
+	}
 
-		c.Header("ETag", fmt.Sprintf(`"%s"`, cacheKey))
-		c.Header("Cache-Control", "public, max-age=0, must-revalidate")
-		c.Data(http.StatusOK, cached.ContentType, cached.Data)
+	imageData, contentType := loadAvatarSource(ctx, filePath, metaErr)
+	if shedTransform(c, imageData, contentType) {
 		return
 	}
 
-	var imageData []byte
-	if metaErr != nil {
-		imageData = defaultImageContent
-		contentType = "image/jpeg"
-		if finalEtagBase == "" {
-			finalEtagBase = defaultImageEtag
-		}
-	} else {
+	variant, done := takeTransformResult(cacheKey)
+	if !done && contentType == "image/gif" && asyncTransforms && !spec.Radius.IsZero() {
+		id := queueTransform(avatarCache, cacheKey, c.Request.URL.RequestURI(), func() (CachedImage, error) {
+			return renderAvatarData(context.Background(), imageData, contentType, spec)
+		})
+		respondPending(c, id)
+		return
+	}
+
+	if !done {
 		var err error
-		imageData, err = os.ReadFile(filePath)
+		variant, err = avatarCache.Render(cacheKey, func() (CachedImage, error) {
+			return renderAvatarData(ctx, imageData, contentType, spec)
+		})
 		if err != nil {
-			imageData = defaultImageContent
-			contentType = "image/jpeg"
-			finalEtagBase = defaultImageEtag
+			transformFailed(c, imageData, contentType, err)
+			return
 		}
 	}
 
-	finalEtag := cacheKey
+	if notModified(c, etag) {
+		return
+	}
 
-	if contentType == "image/gif" {
-		if sizeStr != "" {
-			sz, err := strconv.Atoi(sizeStr)
-			if err == nil && sz > 0 && sz <= 256 {
-				resizedData, err := resizeGIF(imageData, sz, sz)
-				if err == nil {
-					imageData = resizedData
-				}
-			}
-		}
+	c.Header("Content-Type", variant.ContentType)
+	setCachePolicy(c, avatarVariantClass(variant.ContentType, metaErr))
+	c.Header("ETag", etag)
+	setCacheStatus(c, cacheMiss, time.Time{})
+	setPipelineHeaders(c)
+	countAnimatedServe(variant.ContentType)
+	c.Data(http.StatusOK, variant.ContentType, variant.Data)
+}
 
-		if radius != "" {
-			radiusInt, err := strconv.Atoi(strings.TrimSuffix(radius, "px"))
-			if err == nil && radiusInt > 0 {
-				src, err := gif.DecodeAll(bytes.NewReader(imageData))
-				if err == nil {
-					rounded, err := roundGIF(src, radiusInt)
-					if err == nil {
-						buf := bytes.NewBuffer(nil)
-						err = gif.EncodeAll(buf, rounded)
-						if err == nil {
-							imageData = buf.Bytes()
-						}
-					}
-				}
-			}
-		}
+// avatarVariant resolves the avatar for username with spec applied, through
+// the same cache as avatarHandler, for endpoints that re-package the image
+// (data URIs, pixel arrays, ANSI art). It returns the variant and its ETag.
+func avatarVariant(ctx context.Context, username string, spec TransformSpec) (CachedImage, string, error) {
+	filePath, contentType, baseEtag, metaErr := getAvatarMetadata(username)
+	if metaErr != nil && hasReadThrough() && fetchFromOrigin("avatar", username) == nil {
+		filePath, contentType, baseEtag, metaErr = getAvatarMetadata(username)
+	}
+	if metaErr != nil {
+		_, baseEtag = defaultAvatar(themeFrom(ctx))
+	}
 
-		cacheMutex.Lock()
-		transformCache[cacheKey] = CachedImage{ContentType: "image/gif", Data: imageData}
-		cacheMutex.Unlock()
+	sourceHash := baseEtag
+	if meta, ok, _ := lookupAsset("avatar", username); ok && metaErr == nil {
+		sourceHash = meta.Hash
+		spec = spec.withoutNoops(meta.Width)
+		spec.focus = meta.Focus
+	}
 
-		if clientEtag == fmt.Sprintf(`"%s"`, finalEtag) {
-			c.Status(http.StatusNotModified)
-			return
+	if spec.IsZero() {
+		data, ct := loadAvatarSource(ctx, filePath, metaErr)
+		if metaErr == nil {
+			ct = contentType
 		}
+		return CachedImage{Data: data, ContentType: ct}, fmt.Sprintf(`"%s"`, baseEtag), nil
+	}
 
-		c.Header("Content-Type", "image/gif")
-		c.Header("Cache-Control", "public, max-age=0, must-revalidate")
-		c.Header("ETag", fmt.Sprintf(`"%s"`, finalEtag))
-		c.Data(http.StatusOK, "image/gif", imageData)
-		return
+	etag := transformETag(spec, sourceHash)
+	cacheKey := spec.Key(baseEtag)
+	if cached, ok := avatarCache.Get(cacheKey); ok && avatarCache.Status(cached) == cacheHit {
+		return cached, etag, nil
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(imageData))
+	variant, err := avatarCache.Render(cacheKey, func() (CachedImage, error) {
+		return renderAvatar(ctx, filePath, metaErr, spec)
+	})
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding image"})
-		return
+		return CachedImage{}, "", err
 	}
+	return variant, etag, nil
+}
 
-	if sizeStr != "" {
-		sz, err := strconv.Atoi(sizeStr)
-		if err == nil && sz > 0 && sz <= 256 {
-			resized := resize.Resize(uint(sz), 0, img, resize.Lanczos3)
-			var buf bytes.Buffer
-			jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 85})
-			imageData = buf.Bytes()
-			finalEtag = cacheKey
-		}
+// loadAvatarSource reads the stored avatar, falling back to the default image.
+func loadAvatarSource(ctx context.Context, filePath string, metaErr error) ([]byte, string) {
+	if metaErr != nil {
+		data, _ := defaultAvatar(themeFrom(ctx))
+		return data, defaultAvatarType()
+	}
+	_, sp := startSpan(ctx, "storage.read")
+	imageData, err := os.ReadFile(filePath)
+	sp.SetAttr("bytes", len(imageData))
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		data, _ := defaultAvatar(themeFrom(ctx))
+		return data, defaultAvatarType()
+	}
+	if strings.HasSuffix(filePath, ".gif") {
+		return imageData, "image/gif"
 	}
+	return imageData, "image/jpeg"
+}
 
-	if radius != "" {
-		radiusInt, err := strconv.Atoi(strings.TrimSuffix(radius, "px"))
-		if err == nil && radiusInt > 0 {
-			rounded, newContentType, err := roundCorners(imageData, radiusInt)
-			if err == nil {
-				imageData = rounded
-				contentType = newContentType
-				finalEtag = cacheKey
-			}
+func renderAvatar(ctx context.Context, filePath string, metaErr error, spec TransformSpec) (CachedImage, error) {
+	imageData, contentType := loadAvatarSource(ctx, filePath, metaErr)
+	return renderAvatarData(ctx, imageData, contentType, spec)
+}
+
+func renderAvatarData(ctx context.Context, imageData []byte, contentType string, spec TransformSpec) (CachedImage, error) {
+	if spec.Strip > 0 || spec.Overlay != "" {
+		var variant CachedImage
+		var err error
+		if spec.Strip > 0 {
+			variant, err = renderStrip(ctx, imageData, contentType, spec)
+		} else {
+			variant, err = renderComposite(ctx, imageData, spec)
+		}
+		if err != nil {
+			return CachedImage{}, err
+		}
+		return convertVariant(ctx, variant, spec.Format)
+	}
+	// a forced still format takes the first frame through the still path
+	if contentType == "image/gif" && spec.Format == "" {
+		data, err := transformAvatarGIF(ctx, imageData, spec)
+		if err == nil {
+			data, err = limitGIFOutput(ctx, data)
+		}
+		if err != nil {
+			return CachedImage{}, err
 		}
+		return CachedImage{ContentType: "image/gif", Data: data, Timestamp: time.Now()}, nil
 	}
 
-	cacheMutex.Lock()
-	transformCache[cacheKey] = CachedImage{ContentType: contentType, Data: imageData}
-	cacheMutex.Unlock()
+	_, sp := startSpan(ctx, "decode")
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return CachedImage{}, err
+	}
 
-	if clientEtag == fmt.Sprintf(`"%s"`, finalEtag) {
-		c.Status(http.StatusNotModified)
-		return
+	if spec.Crop != [2]int{} {
+		_, sp = startSpan(ctx, "crop")
+		sp.SetAttr("crop", fmt.Sprintf("%dx%d", spec.Crop[0], spec.Crop[1]))
+		img = fitImage(img, spec.Crop[0], spec.Crop[1], spec.Fit, spec.Gravity, spec.focus)
+		sp.End()
+	} else if spec.Size > 0 {
+		_, sp = startSpan(ctx, "resize")
+		sp.SetAttr("size", spec.Size)
+		img = resize.Resize(uint(spec.Size), 0, progressiveDownscale(img, uint(spec.Size), 0), resize.Lanczos3)
+		sp.End()
 	}
 
-	maxAge := 86400
-	c.Header("Content-Type", contentType)
-	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d, must-revalidate", maxAge))
-	c.Header("ETag", fmt.Sprintf(`"%s"`, finalEtag))
-	if c.Request.Method == http.MethodHead {
-		c.Status(200)
-		return
+	if spec.Shape == shapeCircle {
+		img = squareCrop(img)
+	}
+
+	if spec.Chip != "" {
+		_, sp = startSpan(ctx, "chip")
+		img = chipImage(img, spec.Chip)
+		sp.End()
+	}
+
+	if !spec.Radius.IsZero() {
+		_, sp = startSpan(ctx, "round")
+		sp.SetAttr("radius", spec.Radius.String())
+		rgba := toRGBA(img)
+		applyRoundedMask(rgba, spec.Radius)
+		img = rgba
+		sp.End()
+	}
+
+	// Encode exactly once, after every step, so chained transforms never
+	// pay for an intermediate lossy re-encode.
+	_, sp = startSpan(ctx, "encode")
+	var buf bytes.Buffer
+	transparent := !spec.Radius.IsZero() || spec.Fit == fitContain
+	contentType = "image/jpeg"
+	if spec.Format == formatPNG || (transparent && spec.Format == "") {
+		contentType = "image/png"
+		err = png.Encode(&buf, img)
+	} else if transparent {
+		err = encodeJPEG(&buf, flattenImage(img))
+	} else if budget, ok := sizeBudgets[img.Bounds().Dx()]; ok {
+		var data []byte
+		var quality int
+		data, quality, err = encodeJPEGBudget(img, budget)
+		buf.Write(data)
+		sp.SetAttr("quality", quality)
+	} else {
+		err = encodeJPEG(&buf, img)
+	}
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return CachedImage{}, err
+	}
+	imageData = buf.Bytes()
+
+	return CachedImage{ContentType: contentType, Data: imageData, Timestamp: time.Now()}, nil
+}
+
+func transformAvatarGIF(ctx context.Context, imageData []byte, spec TransformSpec) ([]byte, error) {
+	if spec.Shape == shapeCircle {
+		squared, err := squareCropGIF(imageData)
+		if err != nil {
+			return nil, fmt.Errorf("cropping gif: %w", err)
+		}
+		imageData = squared
+	}
+	if spec.Crop != [2]int{} {
+		_, sp := startSpan(ctx, "crop")
+		cropped, err := fitGIF(imageData, spec.Crop[0], spec.Crop[1], spec.Fit, spec.Gravity, spec.focus)
+		sp.RecordError(err)
+		sp.End()
+		if err != nil {
+			return nil, fmt.Errorf("cropping gif: %w", err)
+		}
+		imageData = cropped
+	} else if spec.Size > 0 {
+		_, sp := startSpan(ctx, "resize")
+		sp.SetAttr("size", spec.Size)
+		resizedData, err := resizeGIF(imageData, spec.Size, spec.Size)
+		sp.RecordError(err)
+		sp.End()
+		if err != nil {
+			return nil, fmt.Errorf("resizing gif: %w", err)
+		}
+		imageData = resizedData
+	}
+
+	if !spec.Radius.IsZero() || spec.Chip != "" {
+		_, sp := startSpan(ctx, "decode")
+		src, err := gif.DecodeAll(bytes.NewReader(imageData))
+		sp.RecordError(err)
+		sp.End()
+		if err != nil {
+			return nil, fmt.Errorf("decoding gif: %w", err)
+		}
+
+		if spec.Chip != "" {
+			_, sp = startSpan(ctx, "chip")
+			chipGIF(src, spec.Chip)
+			sp.End()
+		}
+
+		if !spec.Radius.IsZero() {
+			roundCtx, sp := startSpan(ctx, "round")
+			sp.SetAttr("radius", spec.Radius.String())
+			src, err = roundGIF(roundCtx, src, spec.Radius)
+			sp.RecordError(err)
+			sp.End()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, sp = startSpan(ctx, "encode")
+		buf := bytes.NewBuffer(nil)
+		err = gif.EncodeAll(buf, src)
+		sp.RecordError(err)
+		sp.End()
+		if err != nil {
+			return nil, fmt.Errorf("encoding gif: %w", err)
+		}
+		imageData = buf.Bytes()
 	}
-	c.Data(http.StatusOK, contentType, imageData)
+
+	return imageData, nil
 }
 
 func uploadPfpHandler(c *gin.Context) {
+	audit := AuditEntry{Action: "upload", Asset: "avatar"}
+	defer auditRequest(c, &audit)
+
 	var req UploadRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+	if !bindUploadJSON(c, &req) {
 		return
 	}
+	defer req.discardImage()
 
 	usersFile, err := os.ReadFile("users.json")
 	if err != nil {
@@ -270,87 +505,189 @@ func uploadPfpHandler(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid token"})
 		return
 	}
+	audit.Username = strings.ToLower(user.Username)
+	if !checkUploadPolicy(c, *user, "avatar") {
+		return
+	}
 
-	if req.Image == "" {
+	var altText string
+	if req.Alt != nil {
+		altText, err = normalizeAltText(*req.Alt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Alt text must be at most 300 characters"})
+			return
+		}
+	}
+
+	if req.Image == nil {
+		if req.Alt != nil {
+			audit.Action = "alt"
+			setAltText("avatar", audit.Username, altText)
+			c.JSON(http.StatusOK, gin.H{"status": "Success", "message": "Alt text updated"})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing image"})
 		return
 	}
 
-	parts := strings.Split(req.Image, ",")
-	if len(parts) != 2 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image format"})
+	tier := strings.ToLower(toString(user.GetSubscription()))
+	if req.Image.size > uploadLimit(*user) {
+		rejectOversized(c, "avatar", *user)
 		return
 	}
 
-	mimeHeader := parts[0]
-	imageData, err := base64.StdEncoding.DecodeString(parts[1])
+	mem := newMemTracker()
+	mimeHeader, upload, size, err := req.Image.open()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image data"})
+		rejectUpload(c, err)
 		return
 	}
+	audit.Size = size
+	audit.Hash = fileDigest(upload)
+	mem.sample()
 
-	avatarDir := filepath.Join(documentPath, "rotur", "avatars")
-	os.MkdirAll(avatarDir, 0755)
 	username := strings.ToLower(user.Username)
 
-	tier := strings.ToLower(toString(user.GetSubscription()))
-	isPro := slices.Contains([]string{"drive", "pro", "max"}, tier)
+	isPro := slices.Contains(animatedAvatarTiers, tier)
 
 	var ext, contentType string
+	var downgraded bool
 	switch {
 	case strings.Contains(mimeHeader, "image/gif"):
 		if isPro {
 			ext = ".gif"
 			contentType = "image/gif"
+			countFeature(statGIFAccepted, "avatar", tier)
 		} else {
 			// downgrade to jpg if not pro
 			ext = ".jpg"
 			contentType = "image/jpeg"
+			downgraded = true
+			countFeature(statGIFDowngraded, "avatar", tier)
 		}
 	default:
 		ext = ".jpg"
 		contentType = "image/jpeg"
 	}
 
-	filePath := filepath.Join(avatarDir, username+ext)
-	deleteAvatars(username)
+	// Uploads are cropped square around the requested focus, or the
+	// detected subject (or the skin-toned region, with ?focus=skin) when
+	// none was given.
+	var focus *Focus
+	if req.Focus != nil {
+		f, err := parseFocus(req.Focus)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		focus = &f
+	}
+	skinCrop := false
+	switch v := c.Query("focus"); v {
+	case "":
+	case "skin":
+		skinCrop = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown focus %q, expected skin", v)})
+		return
+	}
+	var subject Focus
 
+	archiveAvatar(username)
+	var filePath string
 	if contentType == "image/gif" {
 		// Pro users only
-		resizedData, err := resizeGIF(imageData, 256, 256)
+		first, err := gif.Decode(upload)
+		if err == nil {
+			_, err = upload.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding GIF"})
+			return
+		}
+		edge := avatarSize()
+		if focus == nil {
+			detected := uploadFocus(first, edge, skinCrop)
+			focus = &detected
+		}
+		resizedData, window, err := cropGIFReader(upload, edge, edge, *focus)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error resizing GIF"})
 			return
 		}
+		subject = focusInWindow(detectFocus(first), first.Bounds(), window)
 
-		err = os.WriteFile(filePath, resizedData, 0644)
+		filePath, err = storeAsset("avatar", username, ext, resizedData)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving GIF"})
 			return
 		}
 	} else {
-		img, _, err := image.Decode(bytes.NewReader(imageData))
+		cfg, _, err := image.DecodeConfig(upload)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding image"})
 			return
 		}
+		if !checkSourceDimensions(cfg) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Image dimensions too large"})
+			return
+		}
+		if _, err := upload.Seek(0, io.SeekStart); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading upload"})
+			return
+		}
 
-		resized := resize.Resize(256, 256, img, resize.Lanczos3)
-		out, err := os.Create(filePath)
+		img, err := decodeStill(upload, downgraded)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding image"})
+			return
+		}
+		mem.sample()
+
+		edge := avatarSize()
+		if focus == nil {
+			detected := uploadFocus(img, edge, skinCrop)
+			focus = &detected
+		}
+		window := cropWindow(img.Bounds(), edge, edge, *focus)
+		resized := cropImage(img, window, edge, edge)
+		subject = focusInWindow(detectFocus(img), img.Bounds(), window)
+		var buf bytes.Buffer
+		if err := encodeJPEG(&buf, resized); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encoding image"})
+			return
+		}
+		filePath, err = storeAsset("avatar", username, ext, buf.Bytes())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving image"})
 			return
 		}
-		defer out.Close()
-		jpeg.Encode(out, resized, &jpeg.Options{Quality: 85})
 	}
 
-	cacheMutex.Lock()
-	transformCache = make(map[string]CachedImage)
-	cacheMutex.Unlock()
-
-	c.JSON(http.StatusOK, gin.H{
-		"status":  "Success",
-		"message": "Profile picture uploaded successfully",
+	indexAssetWith("avatar", username, filePath, func(meta *AssetMeta) {
+		meta.Focus = &subject
 	})
+	if req.Alt != nil {
+		setAltText("avatar", username, altText)
+	}
+	deletePresets(username)
+	generateAvatarPresets(username, filePath, contentType)
+	mem.report("pfp", username)
+
+	avatarCache.Invalidate(username)
+	notifyPeers("avatar", username)
+
+	resp := gin.H{
+		"status":     "Success",
+		"message":    "Profile picture uploaded successfully",
+		"downgraded": downgraded,
+		"url":        publicURL(c, "/"+username),
+		"focus":      subject,
+	}
+	if downgraded {
+		resp["reason"] = "tier"
+		emitEvent(Event{Type: "upload.downgraded", Asset: "avatar", Username: username, Reason: "tier", Tier: tier})
+	}
+	setUploadValidators(c, "avatar", username)
+	c.JSON(http.StatusOK, resp)
 }
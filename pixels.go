@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pixel arrays grow quadratically, so sizes are capped well below the
+// image endpoints.
+const (
+	defaultPixelSize = 32
+	maxPixelSize     = 64
+)
+
+// pixelsHandler serves the avatar as a JSON array of rows of hex colours for
+// clients that cannot decode images (Scratch costumes, LED matrices).
+// Colours are #rrggbb, or #rrggbbaa for pixels that are not fully opaque.
+func pixelsHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+
+	size, err := boundedQuery(c, "s", defaultPixelSize, 1, maxPixelSize)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	spec, err := parseTransformSpec(c, "avatar")
+	if err != nil {
+		invalidTransform(c, err)
+		return
+	}
+	spec.Size = size
+
+	variant, etag, err := avatarVariant(c.Request.Context(), username, spec)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error transforming image"})
+		return
+	}
+
+	etag = strings.TrimSuffix(etag, `"`) + `-pixels"`
+	if notModified(c, etag) {
+		return
+	}
+
+	cacheKey := "pixels-" + etag
+	body, ok := avatarCache.Get(cacheKey)
+	if !ok {
+		data, err := pixelArray(variant.Data)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error decoding image"})
+			return
+		}
+		body = CachedImage{Data: data, ContentType: "application/json", Timestamp: time.Now()}
+		avatarCache.Put(cacheKey, body)
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age=0, must-revalidate")
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body.Data)
+}
+
+func pixelArray(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	rows := make([][]string, 0, b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := make([]string, 0, b.Dx())
+		for x := b.Min.X; x < b.Max.X; x++ {
+			px := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if px.A == 255 {
+				row = append(row, fmt.Sprintf("#%02x%02x%02x", px.R, px.G, px.B))
+			} else {
+				row = append(row, fmt.Sprintf("#%02x%02x%02x%02x", px.R, px.G, px.B, px.A))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return json.Marshal(gin.H{"width": b.Dx(), "height": b.Dy(), "pixels": rows})
+}
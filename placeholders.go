@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errorPlaceholders bool
+	placeholderImages = make(map[int]CachedImage)
+	darkPlaceholders  = make(map[int]CachedImage)
+)
+
+// loadPlaceholders reads PLACEHOLDER_<status> images, generating a plain
+// tinted square for any status that is not configured. The dark theme set
+// comes from PLACEHOLDER_<status>_DARK, or dimmed tints.
+func loadPlaceholders() {
+	tints := map[int]color.RGBA{
+		http.StatusTooManyRequests:     {R: 230, G: 180, B: 60, A: 255},
+		http.StatusInternalServerError: {R: 200, G: 90, B: 90, A: 255},
+	}
+
+	sets := map[string]map[int]CachedImage{"": placeholderImages, themeDark: darkPlaceholders}
+	for theme, images := range sets {
+		for _, status := range []int{http.StatusNotFound, http.StatusTooManyRequests, http.StatusInternalServerError} {
+			key := fmt.Sprintf("PLACEHOLDER_%d", status)
+			if theme != "" {
+				key += "_" + strings.ToUpper(theme)
+			}
+			if path := os.Getenv(key); path != "" {
+				data, err := os.ReadFile(path)
+				if err == nil {
+					images[status] = CachedImage{Data: data, ContentType: http.DetectContentType(data)}
+					continue
+				}
+				log.Printf("[placeholders] failed to read %s: %v", path, err)
+			}
+
+			if status == http.StatusNotFound {
+				data, _ := defaultAvatar(theme)
+				images[status] = CachedImage{Data: data, ContentType: defaultAvatarType()}
+				continue
+			}
+
+			tint := tints[status]
+			if theme == themeDark {
+				tint = color.RGBA{R: tint.R / 2, G: tint.G / 2, B: tint.B / 2, A: 255}
+			}
+			img := image.NewRGBA(image.Rect(0, 0, avatarSize(), avatarSize()))
+			draw.Draw(img, img.Bounds(), &image.Uniform{tint}, image.Point{}, draw.Src)
+			var buf bytes.Buffer
+			png.Encode(&buf, img)
+			images[status] = CachedImage{Data: buf.Bytes(), ContentType: "image/png"}
+		}
+	}
+}
+
+// servePlaceholder responds with the image for an error status so embedding
+// clients can tell "no avatar" from "rate limited" without parsing JSON.
+func servePlaceholder(c *gin.Context, status int) {
+	images := placeholderImages
+	if requestTheme(c) == themeDark {
+		images = darkPlaceholders
+	}
+	placeholder, ok := images[status]
+	if !ok {
+		placeholder = CachedImage{Data: defaultImageContent, ContentType: "image/jpeg"}
+	}
+	setCachePolicy(c, cacheNegative)
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", placeholder.ContentType)
+		c.Status(status)
+		return
+	}
+	c.Data(status, placeholder.ContentType, placeholder.Data)
+}
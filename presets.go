@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nfnt/resize"
+)
+
+var (
+	presetOnly        bool
+	presetSizes       []int
+	defaultPresetData = make(map[int][]byte)
+)
+
+func parsePresetSizes(val string) []int {
+	var sizes []int
+	for _, part := range strings.Split(val, ",") {
+		sz, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || sz <= 0 || sz > avatarSize() {
+			continue
+		}
+		if !slices.Contains(sizes, sz) {
+			sizes = append(sizes, sz)
+		}
+	}
+	return sizes
+}
+
+func presetPath(username string, size int, ext string) string {
+	return filepath.Join(assetDir("avatar"), "presets", fmt.Sprintf("%s-%d%s", username, size, ext))
+}
+
+func deletePresets(username string) {
+	for _, size := range presetSizes {
+		for _, ext := range []string{".gif", ".jpg"} {
+			_ = os.Remove(presetPath(username, size, ext))
+		}
+	}
+}
+
+func resizeAvatarVariant(data []byte, contentType string, size int) ([]byte, error) {
+	if contentType == "image/gif" {
+		return resizeGIF(data, size, size)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	resized := resize.Resize(uint(size), 0, img, resize.Lanczos3)
+	var buf bytes.Buffer
+	if err := encodeJPEG(&buf, resized); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// generateAvatarPresets writes every preset size for a freshly uploaded
+// avatar so preset-only deployments never transform on request.
+func generateAvatarPresets(username, filePath, contentType string) {
+	if !presetOnly {
+		return
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		log.Printf("[presets] failed to read %s: %v", filePath, err)
+		return
+	}
+
+	ext := filepath.Ext(filePath)
+	os.MkdirAll(filepath.Dir(presetPath(username, 0, ext)), 0755)
+	for _, size := range presetSizes {
+		variant, err := resizeAvatarVariant(data, contentType, size)
+		if err != nil {
+			log.Printf("[presets] failed to resize %s to %d: %v", username, size, err)
+			continue
+		}
+		if err := os.WriteFile(presetPath(username, size, ext), variant, 0644); err != nil {
+			log.Printf("[presets] failed to write %s at %d: %v", username, size, err)
+		}
+	}
+}
+
+func generateDefaultPresets() {
+	for _, size := range presetSizes {
+		variant, err := resizeAvatarVariant(defaultImageContent, "image/jpeg", size)
+		if err != nil {
+			log.Printf("[presets] failed to resize default image to %d: %v", size, err)
+			continue
+		}
+		defaultPresetData[size] = variant
+	}
+}
+
+// handlePresetAvatar serves avatar requests when on-the-fly transforms are
+// disabled. It returns false when the request has no transform and should be
+// served as the plain original.
+func handlePresetAvatar(c *gin.Context, username, sizeStr string) bool {
+	if sizeStr == "" {
+		return false
+	}
+
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || !slices.Contains(presetSizes, size) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Size must be one of the preset sizes", "sizes": presetSizes})
+		return true
+	}
+
+	filePath, contentType, baseEtag, metaErr := getAvatarMetadata(username)
+	if metaErr != nil {
+		etag := fmt.Sprintf(`"%s-%d"`, defaultImageEtag, size)
+		if notModified(c, etag) {
+			return true
+		}
+		c.Header("ETag", etag)
+		setCachePolicy(c, cacheDefault)
+		c.Data(http.StatusOK, "image/jpeg", defaultPresetData[size])
+		return true
+	}
+
+	variantPath := presetPath(username, size, filepath.Ext(filePath))
+	if _, err := os.Stat(variantPath); err != nil {
+		// uploaded before presets were enabled
+		variantPath = filePath
+	}
+
+	etag := fmt.Sprintf(`"%s-%d"`, baseEtag, size)
+	if notModified(c, etag) {
+		return true
+	}
+	c.Header("ETag", etag)
+	c.Header("Content-Type", contentType)
+	setAltTextHeader(c, "avatar", username)
+	setCachePolicy(c, cacheOriginal)
+	if c.Request.Method == http.MethodHead {
+		c.Status(200)
+		return true
+	}
+	c.File(variantPath)
+	return true
+}
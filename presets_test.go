@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPresetOnlyRejectsTransforms(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := presetOnly
+	presetOnly = true
+	t.Cleanup(func() { presetOnly = old })
+
+	r := gin.New()
+	r.GET("/:username", avatarHandler)
+
+	for _, query := range []string{
+		"radius=8",
+		"chip=she/her",
+		"strip=3",
+		"shape=circle",
+		"crop=64x32",
+		"s=64&chip=hi",
+	} {
+		t.Run(query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/someone?"+query, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("GET /someone?%s = %d, want 400", query, w.Code)
+			}
+		})
+	}
+}
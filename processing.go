@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Processing defaults shared by uploads, presets, imports, origin pulls and
+// the transform pipeline. configureProcessing applies env overrides.
+var (
+	jpegQuality = 85
+
+	// progressiveJPEG encodes JPEGs of at least progressiveMinPixels as
+	// progressive; smaller ones gain nothing from it.
+	progressiveJPEG      = false
+	progressiveMinPixels = 100_000
+
+	// sizeBudgets caps the encoded size of JPEG avatar variants by edge
+	// length. Quality is lowered as far as minBudgetQuality to fit.
+	sizeBudgets = map[int]int64{}
+
+	assetDimensions = map[string][2]int{
+		"avatar": {256, 256},
+		"banner": {900, 300},
+	}
+)
+
+func jpegOptions() *jpeg.Options {
+	return &jpeg.Options{Quality: jpegQuality}
+}
+
+const minBudgetQuality = 20
+
+// encodeJPEG is the shared JPEG encode stage.
+func encodeJPEG(w io.Writer, img image.Image) error {
+	return encodeJPEGQuality(w, img, jpegQuality)
+}
+
+func encodeJPEGQuality(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if progressiveJPEG && b.Dx()*b.Dy() >= progressiveMinPixels {
+		return encodeProgressiveJPEG(w, img, quality)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+// encodeJPEGBudget encodes img at the highest quality up to jpegQuality
+// whose output fits in budget bytes, binary searching on quality. If even
+// the floor (minBudgetQuality, or jpegQuality when that is lower) is too
+// large, that encoding is returned anyway.
+func encodeJPEGBudget(img image.Image, budget int64) ([]byte, int, error) {
+	var best []byte
+	bestQ := 0
+	floor := min(minBudgetQuality, jpegQuality)
+	lo, hi := floor, jpegQuality
+	for lo <= hi {
+		q := (lo + hi) / 2
+		var buf bytes.Buffer
+		if err := encodeJPEGQuality(&buf, img, q); err != nil {
+			return nil, 0, err
+		}
+		if int64(buf.Len()) <= budget || q == floor {
+			best, bestQ = buf.Bytes(), q
+		}
+		if int64(buf.Len()) <= budget {
+			lo = q + 1
+		} else {
+			hi = q - 1
+		}
+	}
+	return best, bestQ, nil
+}
+
+// parseSizeBudgets reads "64:8KB,128:16KB" style edge:size pairs.
+func parseSizeBudgets(v string) (map[int]int64, error) {
+	budgets := map[int]int64{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		edge, size, ok := strings.Cut(part, ":")
+		n, err := strconv.Atoi(edge)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid entry %q, expected EDGE:SIZE", part)
+		}
+		limit, err := parseByteSize(size)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid size in %q", part)
+		}
+		budgets[n] = limit
+	}
+	return budgets, nil
+}
+
+// avatarSize is the stored avatar edge length and the largest ?s= served.
+func avatarSize() int {
+	return assetDimensions["avatar"][0]
+}
+
+func configureProcessing() {
+	if v := os.Getenv("JPEG_QUALITY"); v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 1 || q > 100 {
+			log.Printf("[config] ignoring JPEG_QUALITY=%q, must be 1-100", v)
+		} else {
+			jpegQuality = q
+		}
+	}
+	progressiveJPEG = mustEnv("PROGRESSIVE_JPEG", "false") == "true"
+	if v := os.Getenv("PROGRESSIVE_JPEG_MIN_PIXELS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("[config] ignoring PROGRESSIVE_JPEG_MIN_PIXELS=%q", v)
+		} else {
+			progressiveMinPixels = n
+		}
+	}
+	if v := os.Getenv("SIZE_BUDGETS"); v != "" {
+		budgets, err := parseSizeBudgets(v)
+		if err != nil {
+			log.Printf("[config] ignoring SIZE_BUDGETS: %v", err)
+		} else {
+			sizeBudgets = budgets
+		}
+	}
+	if v := os.Getenv("MAX_GIF_OUTPUT"); v != "" {
+		limit, err := parseByteSize(v)
+		if err != nil {
+			log.Printf("[config] ignoring MAX_GIF_OUTPUT=%q", v)
+		} else {
+			maxGIFOutputBytes = limit
+		}
+	}
+	if v := os.Getenv("AVATAR_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			log.Printf("[config] ignoring AVATAR_SIZE=%q", v)
+		} else {
+			assetDimensions["avatar"] = [2]int{size, size}
+		}
+	}
+	if v := os.Getenv("BANNER_SIZE"); v != "" {
+		var w, h int
+		if _, err := fmt.Sscanf(v, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+			log.Printf("[config] ignoring BANNER_SIZE=%q, expected WIDTHxHEIGHT", v)
+		} else {
+			assetDimensions["banner"] = [2]int{w, h}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeJPEGBudget(t *testing.T) {
+	old := jpegQuality
+	t.Cleanup(func() { jpegQuality = old })
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), uint8(x ^ y), 255})
+		}
+	}
+
+	tests := []struct {
+		quality int
+		budget  int64
+		wantQ   int // 0 means any quality in [floor, quality]
+	}{
+		{quality: 90, budget: 1 << 20, wantQ: 90},
+		{quality: 90, budget: 1, wantQ: minBudgetQuality},
+		{quality: 10, budget: 1 << 20, wantQ: 10},
+		{quality: 10, budget: 1, wantQ: 10},
+		{quality: 90, budget: 1500},
+	}
+	for _, tt := range tests {
+		jpegQuality = tt.quality
+		data, q, err := encodeJPEGBudget(img, tt.budget)
+		if err != nil {
+			t.Fatalf("quality %d budget %d: %v", tt.quality, tt.budget, err)
+		}
+		if len(data) == 0 {
+			t.Errorf("quality %d budget %d: no output", tt.quality, tt.budget)
+		}
+		if tt.wantQ != 0 && q != tt.wantQ {
+			t.Errorf("quality %d budget %d: got q=%d, want %d", tt.quality, tt.budget, q, tt.wantQ)
+		}
+		if q < min(minBudgetQuality, tt.quality) || q > tt.quality {
+			t.Errorf("quality %d budget %d: q=%d out of range", tt.quality, tt.budget, q)
+		}
+	}
+}
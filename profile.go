@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Colours and the blurhash are computed from a small rendition of the
+// avatar; finer detail would be lost in a blurhash anyway.
+const (
+	profileSampleSize = 32
+	profileColors     = 5
+)
+
+// profileHandler bundles what a profile page needs to render before any
+// images load: asset URLs with content hashes for cache busting, the
+// avatar's dominant colours and blurhash, and the user's badges.
+func profileHandler(c *gin.Context) {
+	username := strings.ToLower(c.Param("username"))
+
+	avatar := profileAsset(c, "avatar", username, "/"+username)
+	banner := profileAsset(c, "banner", username, "/.banners/"+username)
+
+	variant, etag, err := avatarVariant(c.Request.Context(), username, TransformSpec{Size: profileSampleSize})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error transforming image"})
+		return
+	}
+	cacheKey := "profile-" + etag
+	summary, ok := avatarCache.Get(cacheKey)
+	if !ok {
+		data, err := avatarSummary(variant.Data)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error decoding image"})
+			return
+		}
+		summary = CachedImage{Data: data, ContentType: "application/json", Timestamp: time.Now()}
+		avatarCache.Put(cacheKey, summary)
+	}
+	var colors struct {
+		Colors   []string `json:"colors"`
+		Blurhash string   `json:"blurhash"`
+	}
+	json.Unmarshal(summary.Data, &colors)
+
+	badges := []string{}
+	if user, err := findUserByName(username); err == nil && user != nil && user.Badges != nil {
+		badges = user.Badges
+	}
+
+	c.Header("Cache-Control", "public, max-age=60")
+	c.JSON(http.StatusOK, gin.H{
+		"username": username,
+		"avatar":   avatar,
+		"banner":   banner,
+		"colors":   colors.Colors,
+		"blurhash": colors.Blurhash,
+		"badges":   badges,
+	})
+}
+
+func profileAsset(c *gin.Context, kind, username, url string) gin.H {
+	meta, ok, _ := lookupAsset(kind, username)
+	if !ok {
+		return nil
+	}
+	return gin.H{"url": publicURL(c, url), "hash": meta.Hash, "animated": meta.Animated}
+}
+
+// avatarSummary returns the JSON-encoded dominant colours, most common
+// first, and blurhash of an encoded avatar.
+func avatarSummary(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(gin.H{
+		"colors":   dominantColors(img, profileColors),
+		"blurhash": encodeBlurhash(img, 4, 4),
+	})
+}
+
+func dominantColors(img image.Image, n int) []string {
+	palette := extractPalette(img, n)
+	if len(palette) == 0 {
+		return nil
+	}
+	counts := make([]int, len(palette))
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			counts[palette.Index(img.At(x, y))]++
+		}
+	}
+
+	order := make([]int, len(palette))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return counts[b] - counts[a] })
+
+	colors := make([]string, 0, len(order))
+	for _, i := range order {
+		px := color.NRGBAModel.Convert(palette[i]).(color.NRGBA)
+		colors = append(colors, fmt.Sprintf("#%02x%02x%02x", px.R, px.G, px.B))
+	}
+	return colors
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"io"
+	"math"
+)
+
+// Progressive JPEG encoding. image/jpeg only writes baseline files, which
+// render top to bottom; progressive files show a blurry full image after
+// the first scan and sharpen as the rest arrives, which suits large
+// banners on slow connections.
+//
+// This encoder uses spectral selection only: one interleaved DC scan, then
+// a low and a high AC band for each component. Chroma is subsampled 4:2:0
+// and the tables are the Annex K ones image/jpeg uses, scaled the same way,
+// so quality settings mean the same thing and files come out about the
+// size of image/jpeg's baseline output.
+
+// progressiveBands are the AC spectral bands sent after the DC scan.
+var progressiveBands = [][2]int{{1, 5}, {6, 63}}
+
+// unzig maps zig-zag order to natural order.
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// progressiveQuant holds the unscaled luminance and chrominance tables in
+// zig-zag order.
+var progressiveQuant = [2][64]byte{
+	// Luminance.
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	// Chrominance.
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// progressiveHuffman holds the luminance DC, luminance AC, chrominance DC
+// and chrominance AC tables as code-length counts and symbols.
+var progressiveHuffman = [4]struct {
+	count [16]byte
+	value []byte
+}{
+	// Luminance DC.
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// Luminance AC.
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	// Chrominance DC.
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// Chrominance AC.
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+type huffCode struct {
+	code uint32
+	size uint8
+}
+
+// huffTable builds the code for each symbol from a table spec (Annex C).
+func huffTable(count [16]byte, value []byte) [256]huffCode {
+	var t [256]huffCode
+	code, k := uint32(0), 0
+	for length := 1; length <= 16; length++ {
+		for i := 0; i < int(count[length-1]); i++ {
+			t[value[k]] = huffCode{code, uint8(length)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return t
+}
+
+type bitWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nBits uint8
+}
+
+func (b *bitWriter) emit(bits uint32, n uint8) {
+	b.bits = b.bits<<n | bits&(1<<n-1)
+	b.nBits += n
+	for b.nBits >= 8 {
+		c := byte(b.bits >> (b.nBits - 8))
+		b.w.WriteByte(c)
+		if c == 0xff {
+			b.w.WriteByte(0x00)
+		}
+		b.nBits -= 8
+	}
+}
+
+func (b *bitWriter) emitHuff(t *[256]huffCode, symbol byte) {
+	b.emit(t[symbol].code, t[symbol].size)
+}
+
+// emitValue writes the size category symbol for v followed by its bits.
+func (b *bitWriter) emitValue(t *[256]huffCode, run int, v int32) {
+	a, bits := v, v
+	if a < 0 {
+		a, bits = -v, v-1
+	}
+	n := uint8(0)
+	for a > 0 {
+		n++
+		a >>= 1
+	}
+	b.emitHuff(t, byte(run<<4)|n)
+	if n > 0 {
+		b.emit(uint32(bits), n)
+	}
+}
+
+// flush pads the last byte with ones, as scans must end byte-aligned.
+func (b *bitWriter) flush() {
+	if b.nBits > 0 {
+		b.emit(0x7f, 8-b.nBits)
+	}
+	b.bits, b.nBits = 0, 0
+}
+
+// dctCos[x][u] is cos((2x+1)uπ/16), scaled by 1/√2 for u == 0.
+var dctCos = func() (t [8][8]float64) {
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			t[x][u] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+			if u == 0 {
+				t[x][u] /= math.Sqrt2
+			}
+		}
+	}
+	return t
+}()
+
+// quantizeBlock applies the forward DCT to a level-shifted 8x8 block in
+// natural order and returns the quantized coefficients in zig-zag order.
+func quantizeBlock(px *[64]float64, quant *[64]float64) (out [64]int32) {
+	var tmp [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += px[y*8+x] * dctCos[x][u]
+			}
+			tmp[y*8+u] = s / 2
+		}
+	}
+	for zz := 0; zz < 64; zz++ {
+		n := unzig[zz]
+		u, v := n%8, n/8
+		var s float64
+		for y := 0; y < 8; y++ {
+			s += tmp[y*8+u] * dctCos[y][v]
+		}
+		out[zz] = int32(math.Round(s / 2 / quant[zz]))
+	}
+	return out
+}
+
+// encodeProgressiveJPEG writes img as a progressive JPEG at the given
+// quality (1-100).
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	quality = max(1, min(quality, 100))
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var quant [2][64]byte
+	var quantF [2][64]float64
+	for t := range quant {
+		for i, q := range progressiveQuant[t] {
+			v := max(1, min((int(q)*scale+50)/100, 255))
+			quant[t][i] = byte(v)
+			quantF[t][i] = float64(v)
+		}
+	}
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	// An MCU is 16x16 pixels: four luma blocks and one block of each
+	// chroma component, averaged over 2x2 pixels.
+	mw, mh := (width+15)/16, (height+15)/16
+	ycc := func(x, y int) (float64, float64, float64) {
+		o := src.PixOffset(b.Min.X+min(x, width-1), b.Min.Y+min(y, height-1))
+		r, g, bl := float64(src.Pix[o]), float64(src.Pix[o+1]), float64(src.Pix[o+2])
+		return 0.299*r + 0.587*g + 0.114*bl - 128,
+			-0.168736*r - 0.331264*g + 0.5*bl,
+			0.5*r - 0.418688*g - 0.081312*bl
+	}
+
+	// coefficient blocks per component in raster order, with the luma grid
+	// padded out to whole MCUs for the interleaved DC scan
+	stride := [3]int{2 * mw, mw, mw}
+	var coeffs [3][][64]int32
+	coeffs[0] = make([][64]int32, 4*mw*mh)
+	coeffs[1] = make([][64]int32, mw*mh)
+	coeffs[2] = make([][64]int32, mw*mh)
+	var planes [3][64]float64
+	for by := 0; by < 2*mh; by++ {
+		for bx := 0; bx < 2*mw; bx++ {
+			for i := 0; i < 64; i++ {
+				planes[0][i], _, _ = ycc(bx*8+i%8, by*8+i/8)
+			}
+			coeffs[0][by*stride[0]+bx] = quantizeBlock(&planes[0], &quantF[0])
+		}
+	}
+	for by := 0; by < mh; by++ {
+		for bx := 0; bx < mw; bx++ {
+			for i := 0; i < 64; i++ {
+				x, y := (bx*8+i%8)*2, (by*8+i/8)*2
+				var cb, cr float64
+				for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+					_, u, v := ycc(x+d[0], y+d[1])
+					cb, cr = cb+u, cr+v
+				}
+				planes[1][i], planes[2][i] = cb/4, cr/4
+			}
+			for c := 1; c < 3; c++ {
+				coeffs[c][by*stride[c]+bx] = quantizeBlock(&planes[c], &quantF[1])
+			}
+		}
+	}
+
+	var huff [4][256]huffCode
+	for i, spec := range progressiveHuffman {
+		huff[i] = huffTable(spec.count, spec.value)
+	}
+
+	bw2 := bufio.NewWriter(w)
+	marker := func(m byte, payload ...byte) {
+		bw2.Write([]byte{0xff, m, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)})
+		bw2.Write(payload)
+	}
+
+	bw2.Write([]byte{0xff, 0xd8})
+	for t := range quant {
+		marker(0xdb, append([]byte{byte(t)}, quant[t][:]...)...)
+	}
+	marker(0xc2, 8, byte(height>>8), byte(height), byte(width>>8), byte(width), 3,
+		1, 0x22, 0,
+		2, 0x11, 1,
+		3, 0x11, 1)
+	for i, spec := range progressiveHuffman {
+		class := byte(i%2)<<4 | byte(i/2)
+		payload := append([]byte{class}, spec.count[:]...)
+		marker(0xc4, append(payload, spec.value...)...)
+	}
+
+	bits := &bitWriter{w: bw2}
+
+	// DC scan, interleaved; each MCU is four luma blocks, then one Cb and
+	// one Cr block
+	marker(0xda, 3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 0, 0)
+	var pred [3]int32
+	emitDC := func(c, i int) {
+		dc := coeffs[c][i][0]
+		bits.emitValue(&huff[min(c, 1)*2], 0, dc-pred[c])
+		pred[c] = dc
+	}
+	for my := 0; my < mh; my++ {
+		for mx := 0; mx < mw; mx++ {
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				emitDC(0, (my*2+d[1])*stride[0]+mx*2+d[0])
+			}
+			emitDC(1, my*stride[1]+mx)
+			emitDC(2, my*stride[2]+mx)
+		}
+	}
+	bits.flush()
+
+	// Non-interleaved scans cover only the blocks that hold component
+	// samples, not the MCU padding.
+	extent := [3][2]int{{(width + 7) / 8, (height + 7) / 8}, {mw, mh}, {mw, mh}}
+
+	// AC scans, one component per scan
+	for _, band := range progressiveBands {
+		for c := range coeffs {
+			table := &huff[min(c, 1)*2+1]
+			marker(0xda, 1, byte(c+1), byte(min(c, 1)), byte(band[0]), byte(band[1]), 0)
+			for n := 0; n < extent[c][0]*extent[c][1]; n++ {
+				i := n/extent[c][0]*stride[c] + n%extent[c][0]
+				run := 0
+				for k := band[0]; k <= band[1]; k++ {
+					v := coeffs[c][i][k]
+					if v == 0 {
+						run++
+						continue
+					}
+					for run > 15 {
+						bits.emitHuff(table, 0xf0)
+						run -= 16
+					}
+					bits.emitValue(table, run, v)
+					run = 0
+				}
+				if run > 0 {
+					bits.emitHuff(table, 0x00) // EOB, an end-of-band run of one
+				}
+			}
+			bits.flush()
+		}
+	}
+
+	bw2.Write([]byte{0xff, 0xd9})
+	return bw2.Flush()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestProgressiveJPEGDecodes(t *testing.T) {
+	for _, size := range [][2]int{{1, 1}, {8, 8}, {17, 9}, {33, 40}, {300, 100}} {
+		img := image.NewRGBA(image.Rect(0, 0, size[0], size[1]))
+		for y := 0; y < size[1]; y++ {
+			for x := 0; x < size[0]; x++ {
+				img.Set(x, y, color.RGBA{uint8(x), uint8(y * 2), 128, 255})
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := encodeProgressiveJPEG(&buf, img, 90); err != nil {
+			t.Fatalf("%v: encode: %v", size, err)
+		}
+		got, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatalf("%v: decode: %v", size, err)
+		}
+		if got.Bounds() != img.Bounds() {
+			t.Fatalf("%v: bounds = %v", size, got.Bounds())
+		}
+		var diff int
+		for y := 0; y < size[1]; y++ {
+			for x := 0; x < size[0]; x++ {
+				r1, g1, b1, _ := img.At(x, y).RGBA()
+				r2, g2, b2, _ := got.At(x, y).RGBA()
+				diff += absDiff(r1, r2) + absDiff(g1, g2) + absDiff(b1, b2)
+			}
+		}
+		if mean := diff / (3 * size[0] * size[1]) >> 8; mean > 6 {
+			t.Errorf("%v: mean channel error %d", size, mean)
+		}
+	}
+}
+
+func TestProgressiveJPEGSize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 640, 240))
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 640; x++ {
+			img.Set(x, y, color.RGBA{uint8(x ^ y), uint8(x / 3), uint8(y), 255})
+		}
+	}
+
+	var baseline, progressive bytes.Buffer
+	if err := jpeg.Encode(&baseline, img, &jpeg.Options{Quality: 85}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeProgressiveJPEG(&progressive, img, 85); err != nil {
+		t.Fatal(err)
+	}
+	if ratio := float64(progressive.Len()) / float64(baseline.Len()); ratio > 1.25 {
+		t.Errorf("progressive is %.2fx the baseline size (%d vs %d bytes)", ratio, progressive.Len(), baseline.Len())
+	}
+}
+
+func absDiff(a, b uint32) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
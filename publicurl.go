@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// publicBase is where clients should fetch assets from, typically a
+// cookie-less subdomain behind the CDN. When set, generated URLs are
+// absolute and reads arriving on any other host are redirected to it so the
+// CDN sees one cache key per asset.
+var publicBase *url.URL
+
+// trustedProxies are the peers whose X-Forwarded-Proto and X-Forwarded-Host
+// are believed when no public base URL is configured, from TRUSTED_PROXIES
+// (IPs or CIDRs).
+var trustedProxies []netip.Prefix
+
+func configureTrustedProxies(spec string) {
+	trustedProxies = nil
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				log.Printf("[env] ignoring TRUSTED_PROXIES entry %q: %v", entry, err)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+}
+
+func fromTrustedProxy(c *gin.Context) bool {
+	addr, err := netip.ParseAddr(c.RemoteIP())
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost is the host the client addressed, taking X-Forwarded-Host
+// from trusted proxies into account.
+func requestHost(c *gin.Context) string {
+	if fromTrustedProxy(c) {
+		if host, _, _ := strings.Cut(c.GetHeader("X-Forwarded-Host"), ","); strings.TrimSpace(host) != "" {
+			return strings.TrimSpace(host)
+		}
+	}
+	return c.Request.Host
+}
+
+// requestScheme is "https" or "http" as seen by the client.
+func requestScheme(c *gin.Context) string {
+	if fromTrustedProxy(c) {
+		proto, _, _ := strings.Cut(c.GetHeader("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	if c.Request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func configurePublicURL(raw string) {
+	publicBase = nil
+	if raw == "" {
+		return
+	}
+	u, err := url.Parse(strings.TrimSuffix(raw, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		log.Printf("[env] ignoring PUBLIC_BASE_URL %q: expected scheme://host", raw)
+		return
+	}
+	publicBase = u
+}
+
+// publicURL makes a server-relative path absolute. The configured public
+// base URL wins; behind a trusted proxy the forwarded scheme and host are
+// used; otherwise the path stays relative.
+func publicURL(c *gin.Context, path string) string {
+	if publicBase != nil {
+		return publicBase.String() + path
+	}
+	if fromTrustedProxy(c) {
+		return requestScheme(c) + "://" + requestHost(c) + path
+	}
+	return path
+}
+
+// canonicalHost redirects GET and HEAD requests on other hosts to the
+// public base URL. Admin routes and uploads are left alone so internal
+// tooling can keep talking to the server directly.
+func canonicalHost() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if publicBase == nil || strings.EqualFold(requestHost(c), publicBase.Host) ||
+			(c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) ||
+			strings.HasPrefix(c.Request.URL.Path, "/admin/") {
+			c.Next()
+			return
+		}
+		c.Redirect(http.StatusMovedPermanently, publicURL(c, c.Request.URL.RequestURI()))
+		c.Abort()
+	}
+}
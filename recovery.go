@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recoverWithDefaultImage turns a panic on an avatar/banner GET into the
+// default image so pages embedding it never show a broken image. Other
+// routes fall through to gin's own recovery.
+func recoverWithDefaultImage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+
+			method := c.Request.Method
+			if (method != http.MethodGet && method != http.MethodHead) || c.Writer.Written() {
+				panic(err)
+			}
+
+			log.Printf("[panic] %s %s: %v\n%s", method, c.Request.URL.RequestURI(), err, debug.Stack())
+
+			data, contentType := defaultImageContent, "image/jpeg"
+			if strings.HasPrefix(c.FullPath(), "/.banners/") {
+				data, contentType = defaultBannerContent, "image/jpeg"
+			} else if errorPlaceholders {
+				placeholder := placeholderImages[http.StatusInternalServerError]
+				data, contentType = placeholder.Data, placeholder.ContentType
+			}
+
+			c.Writer.Header().Del("ETag")
+			c.Writer.Header().Del("Last-Modified")
+			setCachePolicy(c, cacheNegative)
+			c.Abort()
+			if method == http.MethodHead {
+				c.Header("Content-Type", contentType)
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.Data(http.StatusInternalServerError, contentType, data)
+		}()
+		c.Next()
+	}
+}
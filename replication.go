@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Warm standby: when REPLICA_URL is set, a loop pushes every new or changed
+// asset to another instance of this service, and deletes the ones removed
+// here, so the standby can take over if the primary volume dies. An asset
+// goes with its index entry, alt text and aliases, and is pushed again when
+// any of those change. A fingerprint of the last copy pushed for each key
+// is kept on disk so a restart does not re-send everything.
+var (
+	replicaURL          string
+	replicaToken        string
+	replicationInterval = time.Minute
+	replicaClient       = &http.Client{Timeout: 30 * time.Second}
+
+	replicated       = make(map[string]string)
+	replicationMutex sync.Mutex
+	replicationState ReplicationStatus
+)
+
+// ReplicationStatus is reported by /admin/replication.
+type ReplicationStatus struct {
+	LastRun     time.Time `json:"last_run"`
+	LastSuccess time.Time `json:"last_success"`
+	Pushed      int       `json:"pushed"`
+	Deleted     int       `json:"deleted"`
+	Failed      int       `json:"failed"`
+	Pending     int       `json:"pending"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func replicationPath() string {
+	return filepath.Join(storageRoot(), "replication.json")
+}
+
+func startReplication() {
+	if replicaURL == "" {
+		return
+	}
+	if data, err := os.ReadFile(replicationPath()); err == nil {
+		if err := json.Unmarshal(data, &replicated); err != nil {
+			log.Printf("[replication] failed to parse %s, resending everything: %v", replicationPath(), err)
+			replicated = make(map[string]string)
+		}
+	}
+	go func() {
+		for {
+			replicateOnce()
+			time.Sleep(replicationInterval)
+		}
+	}()
+}
+
+// replicateOnce pushes every asset whose hash differs from the last copy
+// sent and deletes keys that no longer exist here.
+func replicateOnce() {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	indexMutex.RLock()
+	metas := make(map[string]AssetMeta, len(assetIndex))
+	for key, meta := range assetIndex {
+		metas[key] = meta
+	}
+	indexMutex.RUnlock()
+
+	status := ReplicationStatus{LastRun: time.Now().UTC(), LastSuccess: replicationState.LastSuccess}
+	for _, key := range slices.Sorted(maps.Keys(metas)) {
+		meta := metas[key]
+		state, err := json.Marshal(assetState(meta.Kind, meta.Username))
+		if err != nil {
+			continue
+		}
+		fingerprint := fmt.Sprintf("%x", sha256.Sum256(append([]byte(meta.Hash), state...)))
+		if replicated[key] == fingerprint {
+			continue
+		}
+		if err := pushReplica(meta, state); err != nil {
+			status.Failed++
+			status.LastError = fmt.Sprintf("%s: %v", key, err)
+			continue
+		}
+		replicated[key] = fingerprint
+		status.Pushed++
+	}
+	for key := range replicated {
+		if _, ok := metas[key]; ok {
+			continue
+		}
+		kind, username, _ := strings.Cut(key, ":")
+		if err := sendReplica(http.MethodDelete, kind, username, nil, nil); err != nil {
+			status.Failed++
+			status.LastError = fmt.Sprintf("%s: %v", key, err)
+			continue
+		}
+		delete(replicated, key)
+		status.Deleted++
+	}
+	status.Pending = status.Failed
+	if status.Failed == 0 {
+		status.LastSuccess = status.LastRun
+	} else {
+		log.Printf("[replication] %d pushed, %d deleted, %d failed; last error: %s", status.Pushed, status.Deleted, status.Failed, status.LastError)
+	}
+	replicationState = status
+
+	if status.Pushed > 0 || status.Deleted > 0 {
+		data, err := json.Marshal(replicated)
+		if err == nil {
+			err = writeAssetFile(replicationPath(), data)
+		}
+		if err != nil {
+			log.Printf("[replication] failed to save state: %v", err)
+		}
+	}
+}
+
+// pushReplica sends an asset with its state, the JSON of an invalidation,
+// base64-encoded in X-Asset-State so alt text survives as a header value.
+func pushReplica(meta AssetMeta, state []byte) error {
+	data, err := os.ReadFile(meta.Path)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", meta.ContentType())
+	header.Set("X-Asset-Hash", meta.Hash)
+	header.Set("X-Asset-State", base64.StdEncoding.EncodeToString(state))
+	return sendReplica(http.MethodPut, meta.Kind, meta.Username, data, header)
+}
+
+func sendReplica(method, kind, username string, body []byte, header http.Header) error {
+	target := fmt.Sprintf("%s/admin/replica/%s/%s?ADMIN_TOKEN=%s",
+		strings.TrimRight(replicaURL, "/"), kind, url.PathEscape(username), url.QueryEscape(replicaToken))
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("replica returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func replicationStatusHandler(c *gin.Context) {
+	if replicaURL == "" {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	replicationMutex.Lock()
+	status := replicationState
+	tracked := len(replicated)
+	replicationMutex.Unlock()
+
+	var lag float64
+	if !status.LastSuccess.IsZero() {
+		lag = time.Since(status.LastSuccess).Seconds()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":     true,
+		"replica":     replicaURL,
+		"interval":    replicationInterval.Seconds(),
+		"tracked":     tracked,
+		"status":      status,
+		"lag_seconds": lag,
+	})
+}
+
+// replicaReceiveHandler is the standby side: it stores a pushed asset as if
+// it had been uploaded here, after checking it arrived intact.
+func replicaReceiveHandler(c *gin.Context) {
+	kind, username := c.Param("kind"), strings.ToLower(c.Param("key"))
+	if kind != "avatar" && kind != "banner" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown asset kind"})
+		return
+	}
+	if username == "" || strings.ContainsAny(username, `/\`) || strings.Contains(username, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid asset key"})
+		return
+	}
+
+	if c.Request.Method == http.MethodDelete {
+		for _, ext := range []string{".gif", ".jpg"} {
+			os.Remove(assetPath(kind, username, ext))
+		}
+		unindexAsset(kind, username)
+		setAltText(kind, username, "")
+	} else {
+		data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, 4*maxUploadBytes))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+			return
+		}
+		if want := c.GetHeader("X-Asset-Hash"); want != "" && fmt.Sprintf("%x", sha256.Sum256(data)) != want {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum mismatch"})
+			return
+		}
+		ext := ".jpg"
+		if c.GetHeader("Content-Type") == "image/gif" {
+			ext = ".gif"
+		}
+		var state invalidation
+		if encoded := c.GetHeader("X-Asset-State"); encoded != "" {
+			raw, err := base64.StdEncoding.DecodeString(encoded)
+			if err == nil {
+				err = json.Unmarshal(raw, &state)
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid asset state"})
+				return
+			}
+		}
+		filePath, err := storeAsset(kind, username, ext, data)
+		if err != nil {
+			log.Printf("[replication] failed to store %s %s: %v", kind, username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store asset"})
+			return
+		}
+		applyAssetState(kind, username, filePath, state, true)
+	}
+
+	if kind == "avatar" {
+		avatarCache.Invalidate(username)
+	} else {
+		bannerCache.Invalidate(username)
+	}
+	c.Status(http.StatusNoContent)
+}
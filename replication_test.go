@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func withTempState(t *testing.T) {
+	oldPath, oldIndex, oldAliases, oldAlt := documentPath, assetIndex, userAliases, altTexts
+	oldURL, oldReplicated := replicaURL, replicated
+	t.Cleanup(func() {
+		documentPath, assetIndex, userAliases, altTexts = oldPath, oldIndex, oldAliases, oldAlt
+		replicaURL, replicated = oldURL, oldReplicated
+	})
+	documentPath = t.TempDir()
+	assetIndex = make(map[string]AssetMeta)
+	userAliases = make(map[string]Alias)
+	altTexts = make(map[string]string)
+	replicated = make(map[string]string)
+}
+
+func testJPEG() []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+	return buf.Bytes()
+}
+
+func TestReplicaReceivesState(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withTempState(t)
+
+	alt := "Portrait"
+	state, _ := json.Marshal(invalidation{
+		Overlay: "halo",
+		Focus:   &Focus{0.1, 0.9},
+		Alt:     &alt,
+		Aliases: map[string]Alias{"ally": {Redirect: true}},
+	})
+	r := gin.New()
+	r.PUT("/admin/replica/:kind/:key", replicaReceiveHandler)
+	req := httptest.NewRequest(http.MethodPut, "/admin/replica/avatar/al", bytes.NewReader(testJPEG()))
+	req.Header.Set("Content-Type", "image/jpeg")
+	req.Header.Set("X-Asset-State", base64.StdEncoding.EncodeToString(state))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	meta, ok, _ := lookupAsset("avatar", "al")
+	if !ok || meta.Overlay != "halo" || meta.Focus == nil || *meta.Focus != (Focus{0.1, 0.9}) {
+		t.Errorf("index entry = %+v", meta)
+	}
+	if getAltText("avatar", "al") != alt {
+		t.Errorf("alt text not stored")
+	}
+	if a, ok := lookupAlias("ally"); !ok || a.Target != "al" || !a.Redirect {
+		t.Errorf("alias = %+v, %v", a, ok)
+	}
+}
+
+func TestReplicationPushesMetadataChanges(t *testing.T) {
+	withTempState(t)
+	var pushes []http.Header
+	standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes = append(pushes, r.Header.Clone())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer standby.Close()
+	replicaURL = standby.URL
+
+	path, err := storeAsset("avatar", "al", ".jpg", testJPEG())
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexAsset("avatar", "al", path)
+
+	replicateOnce()
+	replicateOnce()
+	if len(pushes) != 1 {
+		t.Fatalf("unchanged asset pushed %d times, want 1", len(pushes))
+	}
+
+	setAssetOverlay("avatar", "al", "halo")
+	replicateOnce()
+	setAltText("avatar", "al", "Portrait")
+	replicateOnce()
+	if len(pushes) != 3 {
+		t.Fatalf("metadata changes pushed %d times in total, want 3", len(pushes))
+	}
+	raw, _ := base64.StdEncoding.DecodeString(pushes[2].Get("X-Asset-State"))
+	var state invalidation
+	if err := json.Unmarshal(raw, &state); err != nil || state.Overlay != "halo" || state.Alt == nil || *state.Alt != "Portrait" {
+		t.Errorf("pushed state %s (%v)", raw, err)
+	}
+}
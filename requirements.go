@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Overlay requirements are small boolean expressions over the requesting
+// user, e.g. `tier>=pro && badge:early` or `!badge:banned`. A bare word is
+// shorthand for tier>=word, which keeps old manifests ("requires": "Pro")
+// working. Expressions are compiled once when the manifest is loaded.
+
+// Manifests are trusted, but a typo should not take the server down, so
+// expressions are bounded in length and nesting.
+const (
+	maxRequirementLength = 512
+	maxRequirementDepth  = 16
+)
+
+// tierOrder ranks subscription tiers from lowest to highest.
+var tierOrder = []string{"free", "drive", "pro", "max"}
+
+// requirementEnv is the user data a requirement is evaluated against.
+type requirementEnv struct {
+	Tier   string
+	Badges []string
+}
+
+func userRequirementEnv(u User) requirementEnv {
+	return requirementEnv{Tier: strings.ToLower(u.GetSubscription()), Badges: u.Badges}
+}
+
+type requirement func(env requirementEnv) bool
+
+func tierRank(tier string) int {
+	return slices.Index(tierOrder, strings.ToLower(tier))
+}
+
+// compileRequirement parses expr. An empty expression always matches.
+func compileRequirement(expr string) (requirement, error) {
+	if strings.TrimSpace(expr) == "" {
+		return func(requirementEnv) bool { return true }, nil
+	}
+	if len(expr) > maxRequirementLength {
+		return nil, fmt.Errorf("expression longer than %d bytes", maxRequirementLength)
+	}
+	p := &reqParser{tokens: tokenizeRequirement(expr)}
+	req, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return req, nil
+}
+
+func tokenizeRequirement(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		ch := rune(expr[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"),
+			strings.HasPrefix(expr[i:], ">="), strings.HasPrefix(expr[i:], "<="),
+			strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case strings.ContainsRune("()!<>", ch):
+			tokens = append(tokens, string(ch))
+			i++
+		default:
+			j := i
+			for j < len(expr) && (isWordByte(expr[j])) {
+				j++
+			}
+			if j == i {
+				// unknown character; let the parser reject it
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b == '-' || b == ':' || b == '.' ||
+		(b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+type reqParser struct {
+	tokens []string
+	pos    int
+	depth  int
+}
+
+func (p *reqParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *reqParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *reqParser) or() (requirement, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(env requirementEnv) bool { return l(env) || right(env) }
+	}
+	return left, nil
+}
+
+func (p *reqParser) and() (requirement, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(env requirementEnv) bool { return l(env) && right(env) }
+	}
+	return left, nil
+}
+
+func (p *reqParser) unary() (requirement, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxRequirementDepth {
+		return nil, fmt.Errorf("expression nested deeper than %d", maxRequirementDepth)
+	}
+	switch tok := p.next(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "!":
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env requirementEnv) bool { return !inner(env) }, nil
+	case "(":
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	default:
+		return p.term(tok)
+	}
+}
+
+func (p *reqParser) term(tok string) (requirement, error) {
+	if badge, ok := strings.CutPrefix(tok, "badge:"); ok {
+		if badge == "" {
+			return nil, fmt.Errorf("empty badge name")
+		}
+		return func(env requirementEnv) bool {
+			return slices.ContainsFunc(env.Badges, func(b string) bool { return strings.EqualFold(b, badge) })
+		}, nil
+	}
+
+	if !isWordByte(tok[0]) {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+
+	op, want := ">=", tok
+	if strings.EqualFold(tok, "tier") {
+		op = p.next()
+		want = p.next()
+	}
+	rank := tierRank(want)
+	if rank < 0 {
+		return nil, fmt.Errorf("unknown tier %q", want)
+	}
+
+	cmp := map[string]func(a, b int) bool{
+		">=": func(a, b int) bool { return a >= b },
+		"<=": func(a, b int) bool { return a <= b },
+		">":  func(a, b int) bool { return a > b },
+		"<":  func(a, b int) bool { return a < b },
+		"==": func(a, b int) bool { return a == b },
+		"!=": func(a, b int) bool { return a != b },
+	}[op]
+	if cmp == nil {
+		return nil, fmt.Errorf("unknown comparison %q", op)
+	}
+	return func(env requirementEnv) bool {
+		// unknown user tiers rank as free
+		return cmp(max(tierRank(env.Tier), 0), rank)
+	}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileRequirement(t *testing.T) {
+	free := requirementEnv{Tier: "free"}
+	pro := requirementEnv{Tier: "pro"}
+	proEarly := requirementEnv{Tier: "pro", Badges: []string{"Early"}}
+	maxBanned := requirementEnv{Tier: "max", Badges: []string{"banned"}}
+	unknown := requirementEnv{Tier: "legacy"}
+
+	tests := []struct {
+		expr string
+		env  requirementEnv
+		want bool
+	}{
+		{"", free, true},
+		{"   ", free, true},
+		{"Pro", free, false},
+		{"Pro", pro, true},
+		{"pro", maxBanned, true},
+		{"tier>=pro", pro, true},
+		{"tier > pro", pro, false},
+		{"tier<pro", free, true},
+		{"tier == drive", pro, false},
+		{"tier != free", pro, true},
+		{"badge:early", proEarly, true},
+		{"badge:early", pro, false},
+		{"tier>=pro && badge:early", proEarly, true},
+		{"tier>=pro && badge:early", pro, false},
+		{"badge:early || tier==max", maxBanned, true},
+		{"!badge:banned", maxBanned, false},
+		{"!badge:banned", free, true},
+		{"!!badge:banned", maxBanned, true},
+		{"(tier>=pro || badge:early) && !badge:banned", maxBanned, false},
+		{"(tier>=pro || badge:early) && !badge:banned", proEarly, true},
+		{"badge:early || tier>=pro && badge:banned", pro, false},
+		{"tier == free", unknown, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			req, err := compileRequirement(tt.expr)
+			if err != nil {
+				t.Fatalf("compileRequirement(%q): %v", tt.expr, err)
+			}
+			if got := req(tt.env); got != tt.want {
+				t.Errorf("%q on %+v = %v, want %v", tt.expr, tt.env, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileRequirementRejects(t *testing.T) {
+	for _, expr := range []string{
+		"tier",
+		"tier >=",
+		"tier >= gold",
+		"tier ~ pro",
+		"tier >= (",
+		"gold",
+		"badge:",
+		"&& pro",
+		"pro &&",
+		"pro ||| max",
+		"pro pro",
+		"(pro",
+		"pro)",
+		"()",
+		"!",
+		"pro; rm -rf /",
+		"$(id)",
+		"pro && `x`",
+		"tier>=pro\x00",
+		strings.Repeat("(", 10000) + "pro" + strings.Repeat(")", 10000),
+		strings.Repeat("!", 10000) + "pro",
+		strings.Repeat("pro && ", 1000) + "pro",
+	} {
+		name := expr
+		if len(name) > 40 {
+			name = name[:40] + "..."
+		}
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileRequirement(expr); err == nil {
+				t.Errorf("compileRequirement(%q) succeeded, want an error", expr)
+			}
+		})
+	}
+}
+
+func TestCompileRequirementNestingWithinLimit(t *testing.T) {
+	expr := strings.Repeat("(", maxRequirementDepth-1) + "pro" + strings.Repeat(")", maxRequirementDepth-1)
+	req, err := compileRequirement(expr)
+	if err != nil {
+		t.Fatalf("compileRequirement(%q): %v", expr, err)
+	}
+	if !req(requirementEnv{Tier: "max"}) {
+		t.Errorf("%q does not match a max user", expr)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// maxSourcePixels caps the decoded size of an upload. An 8K frame is ~33MP.
+const maxSourcePixels = 64 * 1024 * 1024
+
+// progressiveDownscale halves img with a box filter until it is within 4x of
+// the target, so Lanczos only ever runs on a small source. A zero width or
+// height leaves that axis unconstrained, matching resize.Resize.
+func progressiveDownscale(img image.Image, width, height uint) image.Image {
+	for {
+		b := img.Bounds()
+		if width == 0 && height == 0 {
+			return img
+		}
+		if width != 0 && b.Dx() < int(width)*4 {
+			return img
+		}
+		if height != 0 && b.Dy() < int(height)*4 {
+			return img
+		}
+		img = halveImage(img)
+	}
+}
+
+func halveImage(img image.Image) image.Image {
+	switch src := img.(type) {
+	case *image.YCbCr:
+		if src.Rect.Min == (image.Point{}) {
+			return halveYCbCr(src)
+		}
+	case *image.RGBA:
+		if src.Rect.Min == (image.Point{}) {
+			return halveRGBA(src)
+		}
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx()/2, b.Dy()/2
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var r, g, bl, a uint32
+			for dy := 0; dy < 2; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					cr, cg, cb, ca := img.At(b.Min.X+2*x+dx, b.Min.Y+2*y+dy).RGBA()
+					r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r >> 10), uint8(g >> 10), uint8(bl >> 10), uint8(a >> 10)})
+		}
+	}
+	return dst
+}
+
+func halveRGBA(src *image.RGBA) *image.RGBA {
+	w, h := src.Rect.Dx()/2, src.Rect.Dy()/2
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row0 := src.Pix[2*y*src.Stride:]
+		row1 := src.Pix[(2*y+1)*src.Stride:]
+		out := dst.Pix[y*dst.Stride:]
+		for x := 0; x < w; x++ {
+			for ch := 0; ch < 4; ch++ {
+				i := 8*x + ch
+				sum := int(row0[i]) + int(row0[i+4]) + int(row1[i]) + int(row1[i+4])
+				out[4*x+ch] = uint8(sum / 4)
+			}
+		}
+	}
+	return dst
+}
+
+// halveYCbCr keeps the source's subsampling so the full-resolution frame is
+// never expanded to RGBA.
+func halveYCbCr(src *image.YCbCr) *image.YCbCr {
+	w, h := src.Rect.Dx()/2, src.Rect.Dy()/2
+	dst := image.NewYCbCr(image.Rect(0, 0, w, h), src.SubsampleRatio)
+
+	halvePlane(dst.Y, dst.YStride, w, h, src.Y, src.YStride, src.Rect.Dx(), src.Rect.Dy())
+
+	scw, sch := chromaSize(src.Rect, src.SubsampleRatio)
+	dcw, dch := chromaSize(dst.Rect, dst.SubsampleRatio)
+	halvePlane(dst.Cb, dst.CStride, dcw, dch, src.Cb, src.CStride, scw, sch)
+	halvePlane(dst.Cr, dst.CStride, dcw, dch, src.Cr, src.CStride, scw, sch)
+	return dst
+}
+
+func halvePlane(dst []byte, dstStride, dw, dh int, src []byte, srcStride, sw, sh int) {
+	for y := 0; y < dh; y++ {
+		y0 := min(2*y, sh-1)
+		y1 := min(2*y+1, sh-1)
+		for x := 0; x < dw; x++ {
+			x0 := min(2*x, sw-1)
+			x1 := min(2*x+1, sw-1)
+			sum := int(src[y0*srcStride+x0]) + int(src[y0*srcStride+x1]) +
+				int(src[y1*srcStride+x0]) + int(src[y1*srcStride+x1])
+			dst[y*dstStride+x] = uint8(sum / 4)
+		}
+	}
+}
+
+func chromaSize(r image.Rectangle, ratio image.YCbCrSubsampleRatio) (int, int) {
+	w, h := r.Dx(), r.Dy()
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return (w + 1) / 2, h
+	case image.YCbCrSubsampleRatio420:
+		return (w + 1) / 2, (h + 1) / 2
+	case image.YCbCrSubsampleRatio440:
+		return w, (h + 1) / 2
+	case image.YCbCrSubsampleRatio411:
+		return (w + 3) / 4, h
+	case image.YCbCrSubsampleRatio410:
+		return (w + 3) / 4, (h + 1) / 2
+	default:
+		return w, h
+	}
+}
+
+func checkSourceDimensions(cfg image.Config) bool {
+	return cfg.Width > 0 && cfg.Height > 0 && cfg.Width*cfg.Height <= maxSourcePixels
+}
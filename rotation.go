@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BannerRotation cycles a user's plain banner URL through some of their
+// slots. The slot shown is a pure function of the time, so every server
+// agrees on it without coordinating and the redirect can be cached until
+// the next change.
+type BannerRotation struct {
+	Slots    []string `json:"slots"`
+	Interval string   `json:"interval"`
+}
+
+var rotationIntervals = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+}
+
+var (
+	bannerRotations = make(map[string]BannerRotation)
+	rotationMutex   sync.RWMutex
+)
+
+func rotationPath() string {
+	return filepath.Join(storageRoot(), "rotations.json")
+}
+
+func loadBannerRotations() {
+	data, err := os.ReadFile(rotationPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[rotation] failed to read %s: %v", rotationPath(), err)
+		}
+		return
+	}
+	rotations := make(map[string]BannerRotation)
+	if err := json.Unmarshal(data, &rotations); err != nil {
+		log.Printf("[rotation] failed to parse %s: %v", rotationPath(), err)
+		return
+	}
+	rotationMutex.Lock()
+	bannerRotations = rotations
+	rotationMutex.Unlock()
+}
+
+func saveBannerRotations() {
+	rotationMutex.RLock()
+	data, err := json.Marshal(bannerRotations)
+	rotationMutex.RUnlock()
+	if err != nil {
+		log.Printf("[rotation] failed to encode rotations: %v", err)
+		return
+	}
+	if err := writeStateFile(rotationPath(), data); err != nil {
+		log.Printf("[rotation] failed to write rotations: %v", err)
+	}
+}
+
+func bannerRotation(username string) *BannerRotation {
+	rotationMutex.RLock()
+	defer rotationMutex.RUnlock()
+	if rot, ok := bannerRotations[username]; ok {
+		return &rot
+	}
+	return nil
+}
+
+// currentRotationSlot returns the slot to show for username at now and how
+// long until it changes. Slots whose banner is gone are skipped. ok is
+// false when the user has no rotation.
+func currentRotationSlot(username string, now time.Time) (slot string, remaining time.Duration, ok bool) {
+	rotationMutex.RLock()
+	rot, found := bannerRotations[strings.ToLower(username)]
+	rotationMutex.RUnlock()
+	if !found {
+		return "", 0, false
+	}
+
+	var live []string
+	for _, s := range rot.Slots {
+		if _, exists, _ := lookupAsset("banner", bannerKey(username, s)); exists {
+			live = append(live, s)
+		}
+	}
+	if len(live) == 0 {
+		return "", 0, false
+	}
+
+	period := rotationIntervals[rot.Interval]
+	n := now.UnixNano() / int64(period)
+	remaining = time.Duration((n+1)*int64(period) - now.UnixNano())
+	return live[n%int64(len(live))], remaining, true
+}
+
+// redirectToRotation sends a plain banner request to the current rotation
+// slot. It returns true when it responded.
+func redirectToRotation(c *gin.Context, username string) bool {
+	slot, remaining, ok := currentRotationSlot(username, time.Now())
+	if !ok {
+		return false
+	}
+	target := "/.banners/" + url.PathEscape(username) + "/" + url.PathEscape(slot)
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(remaining.Seconds())))
+	c.Redirect(http.StatusFound, publicURL(c, target))
+	return true
+}
+
+// bannerRotationHandler sets or, with no slots, clears the caller's
+// banner rotation.
+func bannerRotationHandler(c *gin.Context) {
+	user := tokenUser(c)
+	if user == nil {
+		return
+	}
+	var req BannerRotation
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	username := strings.ToLower(user.Username)
+
+	if len(req.Slots) == 0 {
+		rotationMutex.Lock()
+		delete(bannerRotations, username)
+		rotationMutex.Unlock()
+		saveBannerRotations()
+		c.JSON(http.StatusOK, gin.H{"status": "Success", "rotation": nil})
+		return
+	}
+
+	tier := strings.ToLower(user.GetSubscription())
+	if !slices.Contains(animatedBannerTiers, tier) {
+		c.JSON(http.StatusForbidden, gin.H{"error": errSlotsTierOnly.Error()})
+		return
+	}
+	if _, ok := rotationIntervals[req.Interval]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be hourly or daily"})
+		return
+	}
+	slots := make([]string, 0, len(req.Slots))
+	for _, s := range req.Slots {
+		slot, err := parseBannerSlot(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, exists, _ := lookupAsset("banner", bannerKey(username, slot)); !exists {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("no banner in slot %q", s)})
+			return
+		}
+		if slot == "" {
+			slot = defaultBannerSlot
+		}
+		slots = append(slots, slot)
+	}
+
+	rot := BannerRotation{Slots: slots, Interval: req.Interval}
+	rotationMutex.Lock()
+	bannerRotations[username] = rot
+	rotationMutex.Unlock()
+	saveBannerRotations()
+	c.JSON(http.StatusOK, gin.H{"status": "Success", "rotation": rot})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"image"
+
+	"github.com/nfnt/resize"
+)
+
+// SafeArea is the largest low-detail rectangle of a banner, as fractions of
+// its width and height, where overlaid text stays readable.
+type SafeArea struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+const (
+	safeAreaCols = 24
+	safeAreaRows = 8
+	// calmDetail is the mean luma gradient below which a cell counts as
+	// calm enough for text.
+	calmDetail = 10
+)
+
+// detectSafeArea finds the largest rectangle of calm cells on a grid over
+// img. It returns nil when no such rectangle covers at least a twelfth of
+// the banner.
+func detectSafeArea(img image.Image) *SafeArea {
+	thumb := toRGBA(resize.Resize(safeAreaCols*4, safeAreaRows*4, img, resize.Bilinear))
+	tb := thumb.Bounds()
+	luma := func(x, y int) int {
+		o := thumb.PixOffset(tb.Min.X+x, tb.Min.Y+y)
+		return (299*int(thumb.Pix[o]) + 587*int(thumb.Pix[o+1]) + 114*int(thumb.Pix[o+2])) / 1000
+	}
+
+	var detail [safeAreaRows][safeAreaCols]int
+	for y := 0; y < tb.Dy(); y++ {
+		for x := 0; x < tb.Dx(); x++ {
+			gx := abs(luma(min(x+1, tb.Dx()-1), y) - luma(max(x-1, 0), y))
+			gy := abs(luma(x, min(y+1, tb.Dy()-1)) - luma(x, max(y-1, 0)))
+			detail[y/4][x/4] += gx + gy
+		}
+	}
+
+	// largest rectangle of calm cells, via the histogram of calm runs
+	// ending at each row
+	var heights [safeAreaCols]int
+	var best image.Rectangle
+	for row := 0; row < safeAreaRows; row++ {
+		for col := 0; col < safeAreaCols; col++ {
+			if detail[row][col]/16 < calmDetail {
+				heights[col]++
+			} else {
+				heights[col] = 0
+			}
+		}
+		for left := 0; left < safeAreaCols; left++ {
+			h := heights[left]
+			for right := left; right < safeAreaCols && h > 0; right++ {
+				h = min(h, heights[right])
+				r := image.Rect(left, row+1-h, right+1, row+1)
+				if r.Dx()*r.Dy() > best.Dx()*best.Dy() {
+					best = r
+				}
+			}
+		}
+	}
+	if best.Dx()*best.Dy()*12 < safeAreaCols*safeAreaRows {
+		return nil
+	}
+	return &SafeArea{
+		X:      float64(best.Min.X) / safeAreaCols,
+		Y:      float64(best.Min.Y) / safeAreaRows,
+		Width:  float64(best.Dx()) / safeAreaCols,
+		Height: float64(best.Dy()) / safeAreaRows,
+	}
+}
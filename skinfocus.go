@@ -0,0 +1,98 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/nfnt/resize"
+)
+
+// skinFocus returns the centre of the largest face-shaped skin-toned region
+// in img, for ?focus=skin. It is a colour heuristic, not a face detector:
+// on a 96px thumbnail, pixels whose chroma falls in the usual skin range
+// (Cb 77-127, Cr 133-173) are grouped into connected regions, regions that
+// are tiny, cover most of the image or aren't roughly upright ovals are
+// dropped, and the top of the largest one left is taken as the face. It is
+// cheap and keeps a portrait's face in a square crop, but skin-coloured
+// backgrounds, hands or wood can win, and faces outside that chroma range,
+// in drawings or under coloured light, aren't found. It reports false when
+// no region qualifies.
+func skinFocus(img image.Image) (Focus, bool) {
+	thumb := toRGBA(resize.Thumbnail(96, 96, img, resize.Bilinear))
+	tb := thumb.Bounds()
+	tw, th := tb.Dx(), tb.Dy()
+	if tw < 8 || th < 8 {
+		return Focus{}, false
+	}
+
+	skin := make([]bool, tw*th)
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			o := thumb.PixOffset(tb.Min.X+x, tb.Min.Y+y)
+			_, cb, cr := color.RGBToYCbCr(thumb.Pix[o], thumb.Pix[o+1], thumb.Pix[o+2])
+			skin[y*tw+x] = cb >= 77 && cb <= 127 && cr >= 133 && cr <= 173
+		}
+	}
+
+	best, found := 0, false
+	var face image.Rectangle
+	seen := make([]bool, len(skin))
+	queue := make([]int, 0, len(skin))
+	for start := range skin {
+		if !skin[start] || seen[start] {
+			continue
+		}
+		seen[start] = true
+		queue = append(queue[:0], start)
+		region := image.Rect(start%tw, start/tw, start%tw+1, start/tw+1)
+		for i := 0; i < len(queue); i++ {
+			p := queue[i]
+			x, y := p%tw, p/tw
+			region = region.Union(image.Rect(x, y, x+1, y+1))
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[1] < 0 || n[0] >= tw || n[1] >= th {
+					continue
+				}
+				if q := n[1]*tw + n[0]; skin[q] && !seen[q] {
+					seen[q] = true
+					queue = append(queue, q)
+				}
+			}
+		}
+
+		// too small to matter, or a skin-coloured background
+		count := len(queue)
+		if count < tw*th/100 || count < 16 || count > tw*th*3/4 {
+			continue
+		}
+		// faces are roughly upright ovals, a neck making them taller
+		w, h := region.Dx(), region.Dy()
+		if h*5 < w*4 || h > w*5/2 || count*10 < w*h*4 {
+			continue
+		}
+		if count > best {
+			best, face, found = count, region, true
+		}
+	}
+	if !found {
+		return Focus{}, false
+	}
+
+	// the face is the top of the region when a neck or shoulders are in it
+	cy := float64(face.Min.Y) + float64(min(face.Dy(), face.Dx()*13/10))/2
+	cx := float64(face.Min.X) + float64(face.Dx())/2
+	return Focus{cx / float64(tw), cy / float64(th)}, true
+}
+
+// uploadFocus picks the focal point for cropping an upload that did not give
+// one: the skin-toned region for ?focus=skin, falling back to the centre, or
+// else the most salient window.
+func uploadFocus(img image.Image, edge int, skin bool) Focus {
+	if !skin {
+		return smartFocus(img, edge, edge)
+	}
+	if focus, ok := skinFocus(img); ok {
+		return focus
+	}
+	return centerFocus
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Stampede protection: concurrent misses for one variant share a single
+// render, and after a cache is cleared its most requested variants are
+// regenerated in the background, spread over prewarmJitter, before the
+// herd of clients asks for them.
+var (
+	prewarmTopN   = 50
+	prewarmJitter = 10 * time.Second
+	// maxHotVariants bounds the request counts kept per cache.
+	maxHotVariants = 1000
+	hotSaveEvery   = 5 * time.Minute
+)
+
+type flight struct {
+	done chan struct{}
+	img  CachedImage
+	err  error
+}
+
+// hotVariant is a requested variant, stored as what to render rather than
+// its cache key, so after an upload it regenerates from the new source.
+type hotVariant struct {
+	Username string        `json:"username"`
+	Spec     TransformSpec `json:"spec"`
+	Hits     int64         `json:"hits"`
+}
+
+// Render returns the variant from render, caching it and feeding its
+// latency to load shedding. Callers that miss on the same key while a
+// render is running wait for it instead of starting their own.
+func (vc *variantCache) Render(key string, render func() (CachedImage, error)) (CachedImage, error) {
+	vc.flightMu.Lock()
+	if f, ok := vc.flights[key]; ok {
+		vc.flightMu.Unlock()
+		<-f.done
+		return f.img, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	vc.flights[key] = f
+	vc.flightMu.Unlock()
+
+	started := time.Now()
+	f.img, f.err = render()
+	recordTransformLatency(time.Since(started))
+	if f.err == nil {
+		vc.Put(key, f.img)
+	}
+
+	vc.flightMu.Lock()
+	delete(vc.flights, key)
+	vc.flightMu.Unlock()
+	close(f.done)
+	return f.img, f.err
+}
+
+// recordHot counts a request for a stored asset's variant. When the table
+// is full the coldest half is dropped and the rest decay, so old favourites
+// make way for new ones.
+func (vc *variantCache) recordHot(username string, spec TransformSpec) {
+	spec.focus = nil
+	id := spec.Key(username)
+	vc.flightMu.Lock()
+	defer vc.flightMu.Unlock()
+	if hv, ok := vc.hot[id]; ok {
+		hv.Hits++
+		return
+	}
+	if len(vc.hot) >= maxHotVariants {
+		for _, hv := range vc.hottest(len(vc.hot))[len(vc.hot)/2:] {
+			delete(vc.hot, hv.Spec.Key(hv.Username))
+		}
+		for _, hv := range vc.hot {
+			hv.Hits /= 2
+		}
+	}
+	vc.hot[id] = &hotVariant{Username: username, Spec: spec, Hits: 1}
+}
+
+// forgetHot drops a user's variants, banner slots included, from the hot
+// list.
+func (vc *variantCache) forgetHot(username string) {
+	vc.flightMu.Lock()
+	defer vc.flightMu.Unlock()
+	for id, hv := range vc.hot {
+		if user, _ := splitBannerKey(hv.Username); user == username {
+			delete(vc.hot, id)
+		}
+	}
+}
+
+// hottest returns up to n variants by request count. Callers hold
+// vc.flightMu.
+func (vc *variantCache) hottest(n int) []hotVariant {
+	all := make([]hotVariant, 0, len(vc.hot))
+	for _, hv := range vc.hot {
+		all = append(all, *hv)
+	}
+	slices.SortFunc(all, func(a, b hotVariant) int {
+		return cmp.Compare(b.Hits, a.Hits)
+	})
+	return all[:min(n, len(all))]
+}
+
+// prewarm regenerates the hottest variants, each after a random delay up to
+// prewarmJitter so the renders don't all land at once. Rounds closer
+// together than prewarmJitter are skipped, as the pending one covers them.
+func (vc *variantCache) prewarm() {
+	if vc.regenerate == nil || prewarmTopN <= 0 {
+		return
+	}
+	vc.flightMu.Lock()
+	if time.Now().Before(vc.prewarmUntil) {
+		vc.flightMu.Unlock()
+		return
+	}
+	vc.prewarmUntil = time.Now().Add(prewarmJitter)
+	hot := vc.hottest(prewarmTopN)
+	vc.flightMu.Unlock()
+	vc.rewarm(hot)
+}
+
+// prewarmUser regenerates the hot variants of one user's assets after they
+// were invalidated. A banner key ("user@slot") warms only that slot.
+func (vc *variantCache) prewarmUser(username string) {
+	if vc.regenerate == nil || prewarmTopN <= 0 {
+		return
+	}
+	vc.flightMu.Lock()
+	var hot []hotVariant
+	for _, hv := range vc.hottest(prewarmTopN) {
+		if user, _ := splitBannerKey(hv.Username); hv.Username == username || user == username {
+			hot = append(hot, hv)
+		}
+	}
+	vc.flightMu.Unlock()
+	vc.rewarm(hot)
+}
+
+// rewarm renders each variant after a random delay up to prewarmJitter.
+func (vc *variantCache) rewarm(hot []hotVariant) {
+	for _, hv := range hot {
+		delay := time.Duration(0)
+		if prewarmJitter > 0 {
+			delay = rand.N(prewarmJitter)
+		}
+		time.AfterFunc(delay, func() {
+			if err := vc.regenerate(hv.Username, hv.Spec); err != nil {
+				log.Printf("[cache] prewarming %s %s failed: %v", vc.name, hv.Username, err)
+			}
+		})
+	}
+}
+
+// Variants of assets deleted since they were counted are skipped rather
+// than rendered from the default image.
+func init() {
+	avatarCache.regenerate = func(username string, spec TransformSpec) error {
+		if _, ok, _ := lookupAsset("avatar", username); !ok {
+			return nil
+		}
+		_, _, err := avatarVariant(context.Background(), username, spec)
+		return err
+	}
+	bannerCache.regenerate = func(key string, spec TransformSpec) error {
+		if _, ok, _ := lookupAsset("banner", key); !ok {
+			return nil
+		}
+		_, err := bannerVariant(context.Background(), key, spec)
+		return err
+	}
+}
+
+// bannerVariant renders a stored banner's variant through bannerCache.
+func bannerVariant(ctx context.Context, key string, spec TransformSpec) (CachedImage, error) {
+	path, contentType, _, modTime, err := getBannerPath(key)
+	if err != nil {
+		return CachedImage{}, err
+	}
+	cacheKey := spec.Key(fmt.Sprintf("banner-%s-%d", key, modTime.Unix()))
+	if cached, ok := bannerCache.Get(cacheKey); ok && bannerCache.Status(cached) == cacheHit {
+		return cached, nil
+	}
+	return bannerCache.Render(cacheKey, func() (CachedImage, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return CachedImage{}, err
+		}
+		return renderBanner(ctx, data, contentType, spec)
+	})
+}
+
+func hotVariantsPath() string {
+	return filepath.Join(storageRoot(), "hot.json")
+}
+
+// startPrewarm warms the variants that were hot before a restart and keeps
+// saving the hot list for the next one.
+func startPrewarm() {
+	if data, err := os.ReadFile(hotVariantsPath()); err == nil {
+		saved := make(map[string][]hotVariant)
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Printf("[cache] failed to parse %s: %v", hotVariantsPath(), err)
+		}
+		for _, vc := range []*variantCache{avatarCache, bannerCache} {
+			vc.flightMu.Lock()
+			for _, hv := range saved[vc.name] {
+				vc.hot[hv.Spec.Key(hv.Username)] = &hotVariant{Username: hv.Username, Spec: hv.Spec, Hits: hv.Hits}
+			}
+			vc.flightMu.Unlock()
+			vc.prewarm()
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(hotSaveEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			saveHotVariants()
+		}
+	}()
+}
+
+func saveHotVariants() {
+	saved := make(map[string][]hotVariant)
+	for _, vc := range []*variantCache{avatarCache, bannerCache} {
+		vc.flightMu.Lock()
+		saved[vc.name] = vc.hottest(prewarmTopN)
+		vc.flightMu.Unlock()
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Printf("[cache] failed to encode hot variants: %v", err)
+		return
+	}
+	if err := writeAssetFile(hotVariantsPath(), data); err != nil {
+		log.Printf("[cache] failed to write hot variants: %v", err)
+	}
+}
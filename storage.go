@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Storage layouts:
+//
+//	flat:    avatars/user.jpg
+//	sharded: avatars/ab/cd/user.jpg (two levels of hash prefix)
+//	user:    users/user/avatar.jpg, users/user/banner.gif, ...
+//
+// The user layout keeps every asset for an account in one directory so
+// per-user operations and backups touch a single path.
+const (
+	layoutFlat    = "flat"
+	layoutSharded = "sharded"
+	layoutUser    = "user"
+)
+
+var storageLayout = layoutFlat
+
+func storageRoot() string {
+	return filepath.Join(documentPath, "rotur")
+}
+
+// ensureStorageTree creates the storage root and asset directories, and
+// switches to the overlays in the data directory when it has a manifest.
+func ensureStorageTree() error {
+	for _, dir := range []string{assetDir("avatar"), assetDir("banner")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	dataOverlays := filepath.Join(documentPath, "overlays")
+	if _, err := os.Stat(filepath.Join(dataOverlays, "-manifest.json")); err == nil {
+		overlayDir = dataOverlays
+	}
+	return nil
+}
+
+func assetDir(kind string) string {
+	return filepath.Join(storageRoot(), kind+"s")
+}
+
+func userDir(username string) string {
+	return filepath.Join(storageRoot(), "users", strings.ToLower(username))
+}
+
+var errInvalidUsername = errors.New("invalid username")
+
+// validUsername reports whether a username or banner key is safe to use as
+// one path element. Paths are built by joining it under the storage root,
+// so "..", a separator or a NUL would let it escape users/ or the asset
+// directories.
+func validUsername(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// validateUsernameParams refuses requests whose username, banner key or
+// alias route parameter isn't a valid username, before any handler builds
+// a path from it.
+func validateUsernameParams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, name := range []string{"username", "key", "alias"} {
+			if v, ok := c.Params.Get(name); ok && !validUsername(v) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+func assetPath(kind, username, ext string) string {
+	return assetPathAt(storageRoot(), storageLayout, kind, username, ext)
+}
+
+// assetPathAt expects a validUsername; storeAsset and the routes refuse
+// anything else.
+func assetPathAt(root, layout, kind, username, ext string) string {
+	username = strings.ToLower(username)
+	switch layout {
+	case layoutSharded:
+		h := fmt.Sprintf("%x", md5.Sum([]byte(username)))
+		return filepath.Join(root, kind+"s", h[:2], h[2:4], username+ext)
+	case layoutUser:
+		return filepath.Join(root, "users", username, kind+ext)
+	default:
+		return filepath.Join(root, kind+"s", username+ext)
+	}
+}
+
+// writeAssetFile replaces path atomically so readers never see a partial file.
+func writeAssetFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		closeTemp(tmp)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// storeAsset writes an asset to primary storage, drops any copy in another
+// format, and mirrors it to the secondary store when dual-write is on.
+func storeAsset(kind, username, ext string, data []byte) (string, error) {
+	if !validUsername(username) {
+		return "", errInvalidUsername
+	}
+	if assetBackend != nil {
+		if err := assetBackend.Put(kind, username, ext, data); err != nil {
+			return "", fmt.Errorf("storing on %s: %w", assetBackend.Name(), err)
+		}
+		removeBackendFormats(kind, username, ext)
+	}
+	if err := primaryStore.Put(kind, username, ext, data); err != nil {
+		return "", err
+	}
+	removeOtherFormats(kind, username, ext)
+	mirrorAsset(kind, username, ext, data)
+	return assetPath(kind, username, ext), nil
+}
+
+// removeOtherFormats deletes a user's asset in every format except keepExt,
+// after the new file is in place, so the asset never goes missing mid-upload.
+func removeOtherFormats(kind, username, keepExt string) {
+	for _, ext := range []string{".gif", ".jpg"} {
+		if ext != keepExt {
+			primaryStore.Delete(kind, username, ext)
+		}
+	}
+}
+
+// walkAssets calls fn for every stored asset file of a kind, in any layout.
+func walkAssets(kind string, fn func(username, ext, path string)) {
+	root := assetDir(kind)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && (d.Name() == "presets" || d.Name() == "history") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := filepath.Ext(d.Name())
+		if ext != ".gif" && ext != ".jpg" {
+			return nil
+		}
+		fn(strings.TrimSuffix(d.Name(), ext), ext, path)
+		return nil
+	})
+
+	users, err := os.ReadDir(filepath.Join(storageRoot(), "users"))
+	if err != nil {
+		return
+	}
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		for _, ext := range []string{".gif", ".jpg"} {
+			path := filepath.Join(storageRoot(), "users", user.Name(), kind+ext)
+			if _, err := os.Stat(path); err == nil {
+				fn(user.Name(), ext, path)
+			}
+		}
+	}
+}
+
+// migrateLayout moves every stored asset and avatar history into the given
+// layout.
+func migrateLayout(layout string) error {
+	switch layout {
+	case layoutFlat, layoutSharded, layoutUser:
+	default:
+		return fmt.Errorf("unknown layout %q", layout)
+	}
+	storageLayout = layout
+
+	moved, failed := 0, 0
+	for _, kind := range []string{"avatar", "banner"} {
+		walkAssets(kind, func(username, ext, path string) {
+			dest := assetPath(kind, username, ext)
+			if path == dest {
+				return
+			}
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				log.Printf("[migrate] %s: %v", path, err)
+				failed++
+				return
+			}
+			if err := os.Rename(path, dest); err != nil {
+				log.Printf("[migrate] %s: %v", path, err)
+				failed++
+				return
+			}
+			moved++
+		})
+	}
+
+	histories, historyFailed := migrateHistory(layout)
+
+	rebuildAssetIndex()
+	log.Printf("[migrate] moved %d files and %d avatar histories to the %s layout, %d failed", moved, histories, layout, failed+historyFailed)
+	if failed+historyFailed > 0 {
+		return fmt.Errorf("%d files or histories could not be moved", failed+historyFailed)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const storageGrowthDays = 30
+
+// storageReportHandler summarises disk use from the asset index. Growth is
+// the size of assets last written in each of the past 30 days; replaced
+// files only count at their current size, so it is a lower bound.
+func storageReportHandler(c *gin.Context) {
+	top, err := boundedQuery(c, "top", 10, 1, 100)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	since := now.AddDate(0, 0, -storageGrowthDays)
+	byKind := make(map[string]int64)
+	byUser := make(map[string]int64)
+	daily := make([]int64, storageGrowthDays)
+	var total, growth int64
+
+	indexMutex.RLock()
+	for _, meta := range assetIndex {
+		total += meta.Size
+		byKind[meta.Kind] += meta.Size
+		user, _ := splitBannerKey(meta.Username)
+		byUser[user] += meta.Size
+		if meta.UpdatedAt.After(since) {
+			growth += meta.Size
+			day := int(now.Sub(meta.UpdatedAt) / (24 * time.Hour))
+			daily[storageGrowthDays-1-min(day, storageGrowthDays-1)] += meta.Size
+		}
+	}
+	indexMutex.RUnlock()
+
+	type userUsage struct {
+		Username string `json:"username"`
+		Bytes    int64  `json:"bytes"`
+	}
+	users := make([]userUsage, 0, len(byUser))
+	for name, size := range byUser {
+		users = append(users, userUsage{name, size})
+	}
+	slices.SortFunc(users, func(a, b userUsage) int { return cmp.Compare(b.Bytes, a.Bytes) })
+	users = users[:min(top, len(users))]
+
+	days := make([]gin.H, storageGrowthDays)
+	for i, size := range daily {
+		date := now.AddDate(0, 0, i-storageGrowthDays+1).Format(time.DateOnly)
+		days[i] = gin.H{"date": date, "bytes": size}
+	}
+
+	volume := gin.H{"path": storageRoot()}
+	if size, free, err := volumeSpace(storageRoot()); err != nil {
+		volume["error"] = err.Error()
+	} else {
+		volume["total_bytes"] = size
+		volume["free_bytes"] = free
+		perDay := float64(growth) / storageGrowthDays
+		if perDay > 0 {
+			volume["days_until_full"] = float64(free) / perDay
+		} else {
+			volume["days_until_full"] = nil
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total_bytes":  total,
+		"by_kind":      byKind,
+		"top_users":    users,
+		"growth_bytes": growth,
+		"growth_days":  days,
+		"volume":       volume,
+		"generated_at": now,
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"strconv"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+const maxStripFrames = 16
+
+func parseStrip(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 2 || n > maxStripFrames {
+		return 0, fmt.Errorf("strip must be a frame count from 2 to %d", maxStripFrames)
+	}
+	return n, nil
+}
+
+// stripFrames picks n composited frames spread evenly over the animation.
+// Still images yield the same frame n times so the sprite layout does not
+// depend on the source format.
+func stripFrames(data []byte, contentType string, n int) ([]image.Image, error) {
+	if contentType != "image/gif" {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		frames := make([]image.Image, n)
+		for i := range frames {
+			frames[i] = img
+		}
+		return frames, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding gif: %w", err)
+	}
+
+	want := make(map[int]bool, n)
+	for i := 0; i < n; i++ {
+		want[i*len(g.Image)/n] = true
+	}
+	var frames []image.Image
+	walkComposited(g, func(i int, canvas *image.RGBA) {
+		if want[i] {
+			frames = append(frames, cloneRGBA(canvas))
+		}
+	})
+	// short animations repeat their last frame
+	for len(frames) < n {
+		frames = append(frames, frames[len(frames)-1])
+	}
+	return frames, nil
+}
+
+// renderStrip lays spec.Strip frames side by side in one PNG for CSS sprite
+// hover previews. Crop (or else size), radius and chip apply to every tile.
+func renderStrip(ctx context.Context, data []byte, contentType string, spec TransformSpec) (CachedImage, error) {
+	_, sp := startSpan(ctx, "decode")
+	frames, err := stripFrames(data, contentType, spec.Strip)
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return CachedImage{}, err
+	}
+
+	if spec.Crop != [2]int{} {
+		frames = fitFrames(frames, spec.Crop[0], spec.Crop[1], spec.Fit, spec.Gravity, spec.focus)
+	}
+
+	_, sp = startSpan(ctx, "strip")
+	sp.SetAttr("frames", spec.Strip)
+	var sheet *image.RGBA
+	for i, frame := range frames {
+		if spec.Size > 0 && spec.Crop == [2]int{} {
+			frame = resize.Resize(uint(spec.Size), 0, frame, resize.Lanczos3)
+		}
+		tile := image.NewRGBA(image.Rect(0, 0, frame.Bounds().Dx(), frame.Bounds().Dy()))
+		draw.Draw(tile, tile.Bounds(), frame, frame.Bounds().Min, draw.Src)
+		if spec.Chip != "" {
+			drawChip(tile, tile.Bounds(), spec.Chip)
+		}
+		applyRoundedMask(tile, spec.Radius)
+
+		if sheet == nil {
+			sheet = image.NewRGBA(image.Rect(0, 0, tile.Bounds().Dx()*len(frames), tile.Bounds().Dy()))
+		}
+		at := image.Pt(i*tile.Bounds().Dx(), 0)
+		draw.Draw(sheet, tile.Bounds().Add(at), tile, image.Point{}, draw.Src)
+	}
+	sp.End()
+
+	_, sp = startSpan(ctx, "encode")
+	var buf bytes.Buffer
+	err = png.Encode(&buf, sheet)
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		return CachedImage{}, err
+	}
+	return CachedImage{ContentType: "image/png", Data: buf.Bytes(), Timestamp: time.Now()}, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// textFace is the built-in bitmap face used for all server-side text, so no
+// font files have to be shipped with the service.
+var textFace = basicfont.Face7x13
+
+// checkRenderable returns an error naming the first rune the face cannot draw.
+func checkRenderable(text string) error {
+	for _, r := range text {
+		if _, ok := textFace.GlyphAdvance(r); !ok {
+			return fmt.Errorf("unsupported character %q", r)
+		}
+	}
+	return nil
+}
+
+// renderTextMask draws text into an alpha mask whose height is lineHeight
+// pixels. The face is drawn at its native size and scaled, so very small
+// line heights lose legibility.
+func renderTextMask(text string, lineHeight int) image.Image {
+	metrics := textFace.Metrics()
+	height := metrics.Height.Ceil()
+	width := font.MeasureString(textFace, text).Ceil()
+
+	mask := image.NewAlpha(image.Rect(0, 0, width, height))
+	d := font.Drawer{
+		Dst:  mask,
+		Src:  image.Opaque,
+		Face: textFace,
+		Dot:  fixed.P(0, metrics.Ascent.Ceil()),
+	}
+	d.DrawString(text)
+
+	if lineHeight == height {
+		return mask
+	}
+	return resize.Resize(uint(width*lineHeight/height), uint(lineHeight), mask, resize.Bilinear)
+}
+
+// drawText composites text onto dst with its top-left corner at pt.
+func drawText(dst draw.Image, pt image.Point, text string, lineHeight int, c color.Color) {
+	mask := renderTextMask(text, lineHeight)
+	r := mask.Bounds().Sub(mask.Bounds().Min).Add(pt)
+	draw.DrawMask(dst, r, image.NewUniform(c), image.Point{}, mask, mask.Bounds().Min, draw.Over)
+}
+
+// textWidth is the width text occupies at the given line height.
+func textWidth(text string, lineHeight int) int {
+	return font.MeasureString(textFace, text).Ceil() * lineHeight / textFace.Metrics().Height.Ceil()
+}
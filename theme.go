@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"image/gif"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Themes only change generated or explicitly configured defaults; real
+// uploads are never recoloured. The light theme is the historical look.
+
+const (
+	themeLight = "light"
+	themeDark  = "dark"
+)
+
+var (
+	// defaultIsFallback is set when the default avatar could not be fetched
+	// and the embedded one is used, in which case it follows the theme too.
+	defaultIsFallback bool
+	themedDefaults    = make(map[string]CachedImage)
+	// animatedDefault, from DEFAULT_AVATAR_GIF, replaces the default avatar
+	// in every theme when set.
+	animatedDefault CachedImage
+)
+
+type themeKey struct{}
+
+// requestTheme returns the theme from ?theme=, else from the
+// Sec-CH-Prefers-Color-Scheme client hint, else "". Responses that used it
+// must vary on the hint, so it is always declared.
+func requestTheme(c *gin.Context) string {
+	c.Header("Accept-CH", "Sec-CH-Prefers-Color-Scheme")
+	switch theme := c.Query("theme"); theme {
+	case themeLight, themeDark:
+		return theme
+	}
+
+	c.Writer.Header().Add("Vary", "Sec-CH-Prefers-Color-Scheme")
+	switch hint := strings.Trim(c.GetHeader("Sec-CH-Prefers-Color-Scheme"), `"`); hint {
+	case themeLight, themeDark:
+		return hint
+	}
+	return ""
+}
+
+func withTheme(ctx context.Context, theme string) context.Context {
+	return context.WithValue(ctx, themeKey{}, theme)
+}
+
+func themeFrom(ctx context.Context) string {
+	theme, _ := ctx.Value(themeKey{}).(string)
+	return theme
+}
+
+// loadThemedDefaults reads DEFAULT_AVATAR_LIGHT / DEFAULT_AVATAR_DARK and
+// the animated DEFAULT_AVATAR_GIF.
+func loadThemedDefaults() {
+	if path := os.Getenv("DEFAULT_AVATAR_GIF"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			_, err = gif.DecodeAll(bytes.NewReader(data))
+		}
+		if err != nil {
+			log.Printf("[theme] ignoring DEFAULT_AVATAR_GIF=%s: %v", path, err)
+		} else {
+			animatedDefault = CachedImage{
+				Data:        data,
+				ContentType: "image/gif",
+				Etag:        fmt.Sprintf("%x", md5.Sum(data)),
+			}
+		}
+	}
+
+	for _, theme := range []string{themeLight, themeDark} {
+		key := "DEFAULT_AVATAR_" + strings.ToUpper(theme)
+		path := os.Getenv(key)
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("[theme] failed to read %s=%s: %v", key, path, err)
+			continue
+		}
+		themedDefaults[theme] = CachedImage{
+			Data:        data,
+			ContentType: "image/jpeg",
+			Etag:        fmt.Sprintf("%x", md5.Sum(data)),
+		}
+	}
+
+	if defaultIsFallback {
+		for _, theme := range []string{themeLight, themeDark} {
+			if _, ok := themedDefaults[theme]; !ok {
+				themedDefaults[theme] = fallbackAsset("avatar", theme)
+			}
+		}
+	}
+}
+
+// defaultAvatar returns the default avatar bytes and ETag base for a theme.
+func defaultAvatar(theme string) ([]byte, string) {
+	if animatedDefault.Data != nil {
+		return animatedDefault.Data, animatedDefault.Etag
+	}
+	if img, ok := themedDefaults[theme]; ok {
+		return img.Data, img.Etag
+	}
+	return defaultImageContent, defaultImageEtag
+}
+
+// defaultAvatarType is the content type of the bytes defaultAvatar returns.
+func defaultAvatarType() string {
+	if animatedDefault.Data != nil {
+		return "image/gif"
+	}
+	return "image/jpeg"
+}
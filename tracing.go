@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Minimal OpenTelemetry-compatible tracer. Spans are batched and exported as
+// OTLP/HTTP JSON to OTEL_EXPORTER_OTLP_ENDPOINT; tracing is off when unset.
+
+// Spans wait in spanQueue for the exporter, which posts them in batches of
+// up to maxSpanBatch. When the collector is slow or down the queue fills
+// and further spans are dropped and counted rather than held, and a batch
+// that fails to post is dropped rather than retried.
+const (
+	spanQueueSize = 4096
+	maxSpanBatch  = 256
+)
+
+var (
+	otlpEndpoint string
+	serviceName  string
+	spanQueue    chan *span
+	spansDropped atomic.Int64
+
+	// otlpClient bounds each export so a hung collector can't stall the
+	// exporter indefinitely.
+	otlpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type spanKey struct{}
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	failed   bool
+	message  string
+
+	mu    sync.Mutex
+	attrs map[string]string
+}
+
+func startTracing() {
+	if otlpEndpoint == "" {
+		return
+	}
+	spanQueue = make(chan *span, spanQueueSize)
+	go exportSpans()
+	log.Printf("[tracing] exporting spans to %s", otlpEndpoint)
+}
+
+// startSpan starts a child of the span in ctx, or a new trace when there is
+// none. It returns a nil span when tracing is disabled; all span methods are
+// nil-safe.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	recordPipelineStep(ctx, name)
+	if spanQueue == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: 1, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = toString(value)
+	s.mu.Unlock()
+}
+
+func (s *span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.failed = true
+	s.message = err.Error()
+}
+
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case spanQueue <- s:
+	default:
+		// exporter is behind; drop rather than block the request
+		spansDropped.Add(1)
+	}
+}
+
+// parseTraceparent reads a W3C traceparent header into an (unstarted) parent.
+func parseTraceparent(header string) *span {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	var parent span
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	return &parent
+}
+
+func tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if spanQueue == nil {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		if parent := parseTraceparent(c.GetHeader("traceparent")); parent != nil {
+			ctx = context.WithValue(ctx, spanKey{}, parent)
+		}
+		ctx, s := startSpan(ctx, c.Request.Method+" "+c.FullPath())
+		s.kind = 2
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		s.SetAttr("http.method", c.Request.Method)
+		s.SetAttr("http.route", c.FullPath())
+		s.SetAttr("http.target", c.Request.URL.RequestURI())
+		s.SetAttr("http.status_code", c.Writer.Status())
+		if c.Writer.Status() >= 500 {
+			s.failed = true
+		}
+		s.End()
+	}
+}
+
+func exportSpans() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-spanQueue:
+			batch = append(batch, s)
+			if len(batch) < maxSpanBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := postSpans(batch); err != nil {
+			log.Printf("[tracing] export of %d spans failed, dropping them: %v", len(batch), err)
+		}
+		if n := spansDropped.Swap(0); n > 0 {
+			log.Printf("[tracing] dropped %d spans while the exporter was behind", n)
+		}
+		batch = nil
+	}
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttrs(attrs map[string]string) []otlpAttr {
+	out := make([]otlpAttr, 0, len(attrs))
+	for k, v := range attrs {
+		a := otlpAttr{Key: k}
+		a.Value.StringValue = v
+		out = append(out, a)
+	}
+	return out
+}
+
+func postSpans(batch []*span) error {
+	spans := make([]gin.H, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		entry := gin.H{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.attrs),
+		}
+		s.mu.Unlock()
+		if s.parentID != [8]byte{} {
+			entry["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			entry["status"] = gin.H{"code": 2, "message": s.message}
+		}
+		spans = append(spans, entry)
+	}
+
+	payload := gin.H{
+		"resourceSpans": []gin.H{{
+			"resource": gin.H{"attributes": otlpAttrs(map[string]string{"service.name": serviceName})},
+			"scopeSpans": []gin.H{{
+				"scope": gin.H{"name": "avatars"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := otlpClient.Post(strings.TrimSuffix(otlpEndpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPostSpansTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(func() {
+		close(release)
+		collector.Close()
+	})
+	oldEndpoint, oldClient := otlpEndpoint, otlpClient
+	t.Cleanup(func() { otlpEndpoint, otlpClient = oldEndpoint, oldClient })
+	otlpEndpoint = collector.URL
+	otlpClient = &http.Client{Timeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := postSpans([]*span{{name: "GET /:username", start: start, end: start}})
+	if err == nil {
+		t.Fatal("posting to a hung collector succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("postSpans took %s against a hung collector", elapsed)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// transformKeyVersion is part of every cache key. Bump it whenever the
+// pipeline output changes so old variants are never served again.
+const transformKeyVersion = 2
+
+// TransformSpec is the normalized set of transforms applied to a source
+// image. Its Key is the cache key for the variant everywhere.
+type TransformSpec struct {
+	Size    int
+	Radius  Radius
+	Chip    string
+	Strip   int
+	Overlay string
+	// OverlayStill freezes animated overlays and avatars to their first
+	// frame; set from the avatar owner's tier, not the query.
+	OverlayStill bool
+	Format       string
+	Quality      int
+	Filters      []string
+	// Shape is "circle" or empty. A circle is cropped square first, so the
+	// 50% radius it implies never produces a stadium.
+	Shape string
+	// Crop is an exact output size from ?crop=WxH; Fit and Gravity are
+	// empty for the cover/center defaults.
+	Crop    [2]int
+	Fit     string
+	Gravity string
+	// focus is the focal point detected on upload, used by smart gravity.
+	// It comes from the source, which the key already identifies.
+	focus *Focus
+}
+
+// Radius is a corner radius in output pixels, or a percentage of the
+// output's shorter side when Percent is set (50% gives a circle/stadium).
+type Radius struct {
+	Value   int
+	Percent bool
+}
+
+const maxRadiusPercent = 50
+
+var errInvalidRadius = errors.New("invalid radius")
+
+const shapeCircle = "circle"
+
+var circleRadius = Radius{Value: maxRadiusPercent, Percent: true}
+
+// radiusRules is returned alongside radius validation errors.
+const radiusRules = "radius is a whole number of output pixels (16 or 16px) or a percentage of the shorter side from 0 to 50 (25%); pixel values larger than half the shorter side are clamped"
+
+func parseRadius(v string) (Radius, error) {
+	if v == "" {
+		return Radius{}, nil
+	}
+
+	var r Radius
+	if num, ok := strings.CutSuffix(v, "%"); ok {
+		r.Percent = true
+		v = num
+	} else {
+		v = strings.TrimSuffix(v, "px")
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return Radius{}, fmt.Errorf("%w %q", errInvalidRadius, v)
+	}
+	if r.Percent && n > maxRadiusPercent {
+		return Radius{}, fmt.Errorf("%w: percentage %d%% is out of range", errInvalidRadius, n)
+	}
+	r.Value = n
+	return r, nil
+}
+
+func (r Radius) IsZero() bool {
+	return r.Value == 0
+}
+
+// Pixels resolves the radius against the output dimensions.
+func (r Radius) Pixels(width, height int) int {
+	if !r.Percent {
+		return r.Value
+	}
+	return min(width, height) * r.Value / 100
+}
+
+func (r Radius) String() string {
+	if r.Percent {
+		return strconv.Itoa(r.Value) + "%"
+	}
+	return strconv.Itoa(r.Value)
+}
+
+// transformParams lists the query parameters each asset kind accepts.
+// Banners only resize and round; the rest of the pipeline is avatar-only.
+var transformParams = map[string][]string{
+	"avatar": {"s", "radius", "shape", "crop", "fit", "gravity", "chip", "strip", "overlay"},
+	"banner": {"s", "crop", "radius"},
+}
+
+// parseTransformSpec reads the transform query parameters for an asset
+// kind, rejecting ones the kind does not support. An out-of-range avatar ?s
+// is ignored as before.
+func parseTransformSpec(c *gin.Context, kind string) (TransformSpec, error) {
+	var spec TransformSpec
+
+	query := c.Request.URL.Query()
+	for _, params := range transformParams {
+		for _, p := range params {
+			if query.Has(p) && !slices.Contains(transformParams[kind], p) {
+				return TransformSpec{}, fmt.Errorf("%s is not supported for %ss", p, kind)
+			}
+		}
+	}
+
+	size, cropParam := c.Query("s"), "crop"
+	if kind == "banner" {
+		// banner sizes are exact crops, so ?s= is an alias of ?crop= that
+		// also takes a bare width for the stored aspect ratio
+		if size != "" {
+			cropParam = "s"
+		}
+	} else if sz, err := strconv.Atoi(size); err == nil && sz > 0 && sz <= avatarSize() {
+		spec.Size = sz
+	}
+	r, err := parseRadius(c.Query("radius"))
+	if err != nil {
+		return TransformSpec{}, err
+	}
+	spec.Radius = r
+
+	switch shape := c.Query("shape"); shape {
+	case "":
+	case shapeCircle:
+		spec.Shape = shapeCircle
+		spec.Radius = circleRadius
+	default:
+		return TransformSpec{}, fmt.Errorf("unknown shape %q, expected circle", shape)
+	}
+
+	if v, ok := c.GetQuery(cropParam); ok {
+		crop, err := parseKindSize(kind, v)
+		if err != nil {
+			return TransformSpec{}, err
+		}
+		spec.Crop = crop
+		switch fit := c.Query("fit"); fit {
+		case "", fitCover:
+		case fitContain:
+			spec.Fit = fit
+		default:
+			return TransformSpec{}, fmt.Errorf("unknown fit %q, expected cover or contain", fit)
+		}
+		switch gravity := c.Query("gravity"); gravity {
+		case "", gravityCenter:
+		case gravityTop, gravitySmart:
+			spec.Gravity = gravity
+		default:
+			return TransformSpec{}, fmt.Errorf("unknown gravity %q, expected center, top or smart", gravity)
+		}
+	}
+
+	if v, ok := c.GetQuery("chip"); ok {
+		chip, err := parseChip(v)
+		if err != nil {
+			return TransformSpec{}, err
+		}
+		spec.Chip = chip
+	}
+
+	if v, ok := c.GetQuery("strip"); ok {
+		n, err := parseStrip(v)
+		if err != nil {
+			return TransformSpec{}, err
+		}
+		spec.Strip = n
+	}
+
+	if name := c.Query("overlay"); name != "" {
+		if _, ok := findOverlay(name); !ok {
+			return TransformSpec{}, fmt.Errorf("unknown overlay %q", name)
+		}
+		spec.Overlay = name
+	}
+	if !spec.IsZero() {
+		c.Set(transformLogKey, spec.Query().Encode())
+	}
+	return spec, nil
+}
+
+// parseKindSize parses a crop size, limited to the stored dimensions for
+// banners, which also accept a bare width for the stored aspect ratio.
+func parseKindSize(kind, v string) ([2]int, error) {
+	dims, capped := assetDimensions[kind]
+	if kind != "banner" || !capped {
+		return parseCropSize(v)
+	}
+	if !strings.ContainsAny(v, "xX") {
+		w, err := strconv.Atoi(v)
+		if err != nil || w < 1 {
+			return [2]int{}, fmt.Errorf("s must be WIDTH or WIDTHxHEIGHT, got %q", v)
+		}
+		v = fmt.Sprintf("%dx%d", w, max(w*dims[1]/dims[0], 1))
+	}
+	crop, err := parseCropSize(v)
+	if err != nil {
+		return [2]int{}, err
+	}
+	if crop[0] > dims[0] || crop[1] > dims[1] {
+		return [2]int{}, fmt.Errorf("banner size is limited to %dx%d", dims[0], dims[1])
+	}
+	return crop, nil
+}
+
+// invalidTransform answers a request whose transform parameters failed
+// validation.
+func invalidTransform(c *gin.Context, err error) {
+	if errors.Is(err, errInvalidRadius) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "radius": radiusRules})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+func (t TransformSpec) IsZero() bool {
+	return t.Size == 0 && t.Crop == [2]int{} && t.Radius.IsZero() && t.Chip == "" && t.Strip == 0 && t.Overlay == "" && t.Format == "" && t.Quality == 0 && len(t.Filters) == 0
+}
+
+// withoutNoops drops transforms that would leave a source of the given width
+// unchanged, so e.g. ?s=256 on a 256px avatar serves the original bytes
+// instead of a lossy re-encode.
+func (t TransformSpec) withoutNoops(width int) TransformSpec {
+	if t.Size == width {
+		t.Size = 0
+	}
+	return t
+}
+
+// Key serializes the spec in a fixed field order so equivalent requests
+// (e.g. radius=8 and radius=8px) share one cache entry.
+func (t TransformSpec) Key(source string) string {
+	parts := []string{fmt.Sprintf("v%d", transformKeyVersion), source}
+	if t.Size != 0 {
+		parts = append(parts, "size="+strconv.Itoa(t.Size))
+	}
+	if t.Crop != [2]int{} {
+		parts = append(parts, fmt.Sprintf("crop=%dx%d", t.Crop[0], t.Crop[1]))
+		if t.Fit != "" {
+			parts = append(parts, "fit="+t.Fit)
+		}
+		if t.Gravity != "" {
+			parts = append(parts, "gravity="+t.Gravity)
+		}
+	}
+	if t.Shape != "" {
+		parts = append(parts, "shape="+t.Shape)
+	} else if !t.Radius.IsZero() {
+		parts = append(parts, "radius="+t.Radius.String())
+	}
+	if t.Chip != "" {
+		parts = append(parts, "chip="+strconv.Quote(t.Chip))
+	}
+	if t.Strip != 0 {
+		parts = append(parts, "strip="+strconv.Itoa(t.Strip))
+	}
+	if t.Overlay != "" {
+		parts = append(parts, "overlay="+strconv.Quote(t.Overlay))
+		if t.OverlayStill {
+			parts = append(parts, "still")
+		}
+	}
+	if t.Format != "" {
+		parts = append(parts, "format="+t.Format)
+	}
+	if t.Quality != 0 {
+		parts = append(parts, "q="+strconv.Itoa(t.Quality))
+	}
+	if len(t.Filters) > 0 {
+		parts = append(parts, "filters="+strings.Join(t.Filters, ","))
+	}
+	return strings.Join(parts, "-")
+}
+
+var strictTransforms bool
+
+// isStrict reports whether transform failures should surface as errors for
+// this request. ?strict=1 or ?strict=0 overrides the server default.
+func isStrict(c *gin.Context) bool {
+	if v, ok := c.GetQuery("strict"); ok {
+		strict, err := strconv.ParseBool(v)
+		if err == nil {
+			return strict
+		}
+	}
+	return strictTransforms
+}
+
+// transformFailed reports a failed transform as a JSON error in strict mode,
+// and otherwise falls back to the untransformed source.
+func transformFailed(c *gin.Context, data []byte, contentType string, err error) {
+	if isStrict(c) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error transforming image", "detail": err.Error()})
+		return
+	}
+	serveUntransformed(c, data, contentType, err)
+}
+
+var canonicalRedirects bool
+
+// Query renders the spec as canonical query parameters: no padding or
+// units, invalid values dropped.
+func (t TransformSpec) Query() url.Values {
+	q := url.Values{}
+	if t.Size != 0 {
+		q.Set("s", strconv.Itoa(t.Size))
+	}
+	if t.Crop != [2]int{} {
+		q.Set("crop", fmt.Sprintf("%dx%d", t.Crop[0], t.Crop[1]))
+		if t.Fit != "" {
+			q.Set("fit", t.Fit)
+		}
+		if t.Gravity != "" {
+			q.Set("gravity", t.Gravity)
+		}
+	}
+	if t.Shape != "" {
+		q.Set("shape", t.Shape)
+	} else if !t.Radius.IsZero() {
+		q.Set("radius", t.Radius.String())
+	}
+	if t.Chip != "" {
+		q.Set("chip", t.Chip)
+	}
+	if t.Strip != 0 {
+		q.Set("strip", strconv.Itoa(t.Strip))
+	}
+	if t.Overlay != "" {
+		q.Set("overlay", t.Overlay)
+	}
+	return q
+}
+
+// redirectToCanonical answers with a 301 to the canonical form of the
+// request URL when it differs, so equivalent URLs collapse to a single CDN
+// object. Only the transform parameters are rewritten; the others (theme,
+// tokens, debug switches) are carried over unchanged. Returns true when it
+// redirected.
+func redirectToCanonical(c *gin.Context, spec TransformSpec) bool {
+	if !canonicalRedirects {
+		return false
+	}
+
+	q := c.Request.URL.Query()
+	for _, params := range transformParams {
+		for _, p := range params {
+			q.Del(p)
+		}
+	}
+	for k, v := range spec.Query() {
+		q[k] = v
+	}
+	if v, ok := c.GetQuery("strict"); ok {
+		q.Del("strict")
+		if strict, err := strconv.ParseBool(v); err == nil {
+			q.Set("strict", strconv.FormatBool(strict))
+		}
+	}
+
+	// url.Values.Encode sorts keys, which is the canonical order
+	canonical := q.Encode()
+	if canonical == c.Request.URL.RawQuery {
+		return false
+	}
+
+	target := c.Request.URL.Path
+	if canonical != "" {
+		target += "?" + canonical
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Redirect(http.StatusMovedPermanently, target)
+	return true
+}
+
+// transformETag is a weak validator for a variant. It is derived from the
+// source content hash and the normalized spec (which carries the pipeline
+// version), so re-encodes that differ byte-for-byte keep the same tag. The
+// spec is hashed because chip and overlay values may hold quotes and other
+// bytes an entity tag cannot.
+func transformETag(spec TransformSpec, sourceHash string) string {
+	if len(sourceHash) > 16 {
+		sourceHash = sourceHash[:16]
+	}
+	sum := sha256.Sum256([]byte(spec.Key(sourceHash)))
+	return fmt.Sprintf(`W/"%s-%x"`, sourceHash, sum[:8])
+}
+
+// serveUntransformed responds with the source image when a transform fails,
+// so <img> tags still get an image rather than a JSON error body.
+func serveUntransformed(c *gin.Context, data []byte, contentType string, err error) {
+	requestLogger(c.Request.Context()).Warn("transform failed, serving original",
+		"path", c.Request.URL.Path, "transform", c.GetString(transformLogKey), "error", err)
+	setCachePolicy(c, cacheNegative)
+	c.Data(http.StatusOK, contentType, data)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTransformETagRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		spec TransformSpec
+	}{
+		{"plain", TransformSpec{}},
+		{"size", TransformSpec{Size: 128}},
+		{"chip with quotes", TransformSpec{Chip: `she/her "x"`}},
+		{"chip with backslash", TransformSpec{Chip: `a\b`}},
+		{"chip with non-ascii", TransformSpec{Chip: "ünï 🎉"}},
+		{"overlay", TransformSpec{Overlay: "cat_ears.png"}},
+		{"overlay with quotes", TransformSpec{Overlay: `cat "ears".png`}},
+		{"overlay still", TransformSpec{Overlay: "cat_ears.png", OverlayStill: true}},
+		{"chip and overlay", TransformSpec{Chip: `"hi"`, Overlay: `a\b.png`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etag := transformETag(tt.spec, "0123456789abcdef0123")
+			tags := parseETags(etag)
+			if len(tags) != 1 || tags[0] != etag {
+				t.Fatalf("parseETags(%q) = %q, want the tag back", etag, tags)
+			}
+			if !etagMatches(etag, etag) {
+				t.Errorf("etagMatches(%q, %q) = false", etag, etag)
+			}
+			if !etagMatches(`"other", `+etag, etag) {
+				t.Errorf("etag not matched inside a list: %q", etag)
+			}
+			opaque := etag[len(`W/"`) : len(etag)-1]
+			for i := 0; i < len(opaque); i++ {
+				if b := opaque[i]; b < 0x21 || b > 0x7e || b == '"' || b == '\\' {
+					t.Fatalf("etag %q has byte %q that needs escaping", etag, b)
+				}
+			}
+		})
+	}
+}
+
+func TestTransformETagDistinguishesSpecs(t *testing.T) {
+	a := transformETag(TransformSpec{Chip: "a"}, "hash")
+	b := transformETag(TransformSpec{Chip: "b"}, "hash")
+	if a == b {
+		t.Errorf("different chips share etag %q", a)
+	}
+	if transformETag(TransformSpec{Overlay: "x.png"}, "hash") == transformETag(TransformSpec{Overlay: "y.png"}, "hash") {
+		t.Errorf("different overlays share an etag")
+	}
+	if c := transformETag(TransformSpec{Chip: "a"}, "other"); c == a {
+		t.Errorf("different sources share etag %q", a)
+	}
+}
+
+func TestRedirectToCanonicalKeepsOtherParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := canonicalRedirects
+	canonicalRedirects = true
+	t.Cleanup(func() { canonicalRedirects = old })
+
+	tests := []struct {
+		query    string
+		location string // empty when no redirect is expected
+	}{
+		{"radius=8", ""},
+		{"radius=8&theme=dark", ""},
+		{"radius=8px&theme=dark", "/someone?radius=8&theme=dark"},
+		{"theme=dark&radius=8px&ADMIN_TOKEN=x", "/someone?ADMIN_TOKEN=x&radius=8&theme=dark"},
+		{"strict=1&s=64", "/someone?s=64&strict=true"},
+		{"strict=nope&s=64", "/someone?s=64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/someone?"+tt.query, nil)
+			spec, err := parseTransformSpec(c, "avatar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			redirected := redirectToCanonical(c, spec)
+			if redirected != (tt.location != "") {
+				t.Fatalf("redirected = %v, want %v", redirected, tt.location != "")
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	errInvalidImageFormat = errors.New("invalid image format")
+	errUnsupportedType    = errors.New("unsupported image type")
+)
+
+// uploadTypes are the sniffed content types uploads may have, from
+// UPLOAD_TYPES. WebP is decoded and stored as JPEG.
+var uploadTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// parseUploadTypes reads a list like "jpeg,png,webp" or "image/gif".
+func parseUploadTypes(spec string) []string {
+	var types []string
+	for _, t := range strings.Split(spec, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		t = strings.TrimPrefix(t, "image/")
+		if t == "jpg" {
+			t = "jpeg"
+		}
+		if !slices.Contains(types, "image/"+t) {
+			types = append(types, "image/"+t)
+		}
+	}
+	return types
+}
+
+// rejectUpload responds to an uploadImage.open error: 415 with the accepted
+// types for a disallowed type, 400 otherwise.
+func rejectUpload(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errUnsupportedType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":    "Unsupported image type, accepted types are " + strings.Join(uploadTypes, ", "),
+			"accepted": uploadTypes,
+		})
+	case errors.Is(err, errInvalidImageFormat):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image format"})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image data"})
+	}
+}
+
+// tierUploadLimits caps the decoded size of an upload per subscription
+// tier, from UPLOAD_LIMITS. Tiers not listed get the free limit.
+var tierUploadLimits = map[string]int64{
+	"free": 2 * 1024 * 1024,
+	"pro":  10 * 1024 * 1024,
+	"max":  25 * 1024 * 1024,
+}
+
+// maxUploadBytes is the largest decoded image any tier may upload.
+var maxUploadBytes int64 = 25 * 1024 * 1024
+
+// parseTierLimits reads "free:2MB,pro:10MB" style tier:size pairs.
+func parseTierLimits(v string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tier, size, ok := strings.Cut(part, ":")
+		limit, err := parseByteSize(size)
+		if !ok || err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid entry %q, expected TIER:SIZE", part)
+		}
+		limits[strings.ToLower(strings.TrimSpace(tier))] = limit
+	}
+	return limits, nil
+}
+
+// configureUploadLimits overrides the listed tiers' limits and sets
+// maxUploadBytes, which bounds the request body, to the largest limit.
+func configureUploadLimits(limits map[string]int64) {
+	for tier, limit := range limits {
+		tierUploadLimits[tier] = limit
+	}
+	maxUploadBytes = 0
+	for _, limit := range tierUploadLimits {
+		maxUploadBytes = max(maxUploadBytes, limit)
+	}
+}
+
+// limitUploadBody stops reading the request body past the base64 of the
+// largest upload plus room for the other fields, so an oversized upload
+// fails while binding instead of being buffered whole.
+func limitUploadBody(c *gin.Context) {
+	limit := int64(base64.StdEncoding.EncodedLen(int(maxUploadBytes))) + 64*1024
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+}
+
+// selfServeUploads exposes /upload/pfp and /upload/banner, which clients call
+// directly: the user's token is the only credential, so no ADMIN_TOKEN
+// holder has to proxy the upload.
+var selfServeUploads bool
+
+func requiresSelfServe(c *gin.Context) {
+	if !selfServeUploads {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Self-serve uploads are disabled"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// bindUploadJSON binds a size-limited upload body, responding with 413 or
+// 400 when it can't. The image is decoded into a temp file as the body is
+// read; the caller must discardImage once done with it. An upload without a
+// token in the body falls back to ?token= or the Authorization bearer.
+func bindUploadJSON(c *gin.Context, req interface{ upload() *UploadRequest }) bool {
+	limitUploadBody(c)
+	if err := decodeUploadBody(c.Request.Body, req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			countFeature(statOversized, "", "")
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Image size exceeds the %s limit", formatUploadLimit(maxUploadBytes)),
+				"limit": maxUploadBytes,
+			})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		}
+		return false
+	}
+	if upload, ok := req.(*UploadRequest); ok && upload.Token == "" {
+		upload.Token = userToken(c)
+		if upload.Token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
+			return false
+		}
+	}
+	return true
+}
+
+// uploadLimit is the decoded size limit for a user's uploads: the user's
+// own max_size when the provider sets one, otherwise their tier's limit,
+// never above maxUploadBytes.
+func uploadLimit(user User) int64 {
+	if limit := userMaxSize(user); limit > 0 {
+		return min(limit, maxUploadBytes)
+	}
+	if limit, ok := tierUploadLimits[strings.ToLower(user.GetSubscription())]; ok {
+		return limit
+	}
+	return tierUploadLimits["free"]
+}
+
+// userMaxSize reads max_size, given as bytes or a size like "5MB".
+func userMaxSize(user User) int64 {
+	switch v := user.MaxSize.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		n, err := parseByteSize(v)
+		if err != nil {
+			return 0
+		}
+		return n
+	default:
+		return 0
+	}
+}
+
+// rejectOversized answers an upload over the user's limit with 413.
+func rejectOversized(c *gin.Context, kind string, user User) {
+	tier := strings.ToLower(user.GetSubscription())
+	limit := uploadLimit(user)
+	countFeature(statOversized, kind, tier)
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error": fmt.Sprintf("Image size exceeds your %s limit", formatUploadLimit(limit)),
+		"limit": limit,
+		"tier":  tier,
+	})
+}
+
+func formatUploadLimit(n int64) string {
+	if n%(1024*1024) == 0 {
+		return fmt.Sprintf("%dMB", n/(1024*1024))
+	}
+	return fmt.Sprintf("%.1fMB", float64(n)/(1024*1024))
+}
+
+// open checks the decoded upload and returns it rewound. The returned
+// header is the declared one, or one built from the sniffed bytes when the
+// upload had none; uploads whose bytes are not an image, or not one of
+// uploadTypes, are rejected either way. The file stays owned by the
+// request and is removed by discardImage.
+func (u *uploadImage) open() (string, *os.File, int64, error) {
+	if u.err != nil {
+		return "", nil, 0, u.err
+	}
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return "", nil, 0, err
+	}
+	sniffed, err := sniffContentType(u.file)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if !strings.HasPrefix(sniffed, "image/") {
+		return "", nil, 0, errInvalidImageFormat
+	}
+	if !slices.Contains(uploadTypes, sniffed) {
+		return "", nil, 0, errUnsupportedType
+	}
+	header := u.header
+	if header == "" {
+		header = "data:" + sniffed + ";base64"
+	}
+	return header, u.file, u.size, nil
+}
+
+// sniffContentType detects the type of f from its first bytes and rewinds
+// it.
+func sniffContentType(f *os.File) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+func closeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// memTracker records the peak heap seen between samples of an upload.
+type memTracker struct {
+	start uint64
+	peak  uint64
+}
+
+func newMemTracker() *memTracker {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return &memTracker{start: ms.HeapAlloc, peak: ms.HeapAlloc}
+}
+
+func (m *memTracker) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if ms.HeapAlloc > m.peak {
+		m.peak = ms.HeapAlloc
+	}
+}
+
+func (m *memTracker) report(kind, username string) {
+	m.sample()
+	var growth uint64
+	if m.peak > m.start {
+		growth = m.peak - m.start
+	}
+	log.Printf("[upload] %s for %s: peak heap %d KB (+%d KB)", kind, username, m.peak/1024, growth/1024)
+}
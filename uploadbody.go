@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// uploadImage is the "image" field of an upload body, base64-decoded into a
+// temp file while the body is read, so the encoded string is never held in
+// memory whole. err is set when the field was not a valid data URL; it is
+// reported by the handler once the token has been checked.
+type uploadImage struct {
+	header string
+	file   *os.File
+	size   int64
+	err    error
+}
+
+// discardImage removes the temp file an upload's image was decoded into.
+func (r *UploadRequest) discardImage() {
+	if r.Image != nil && r.Image.file != nil {
+		closeTemp(r.Image.file)
+	}
+}
+
+func (r *UploadRequest) upload() *UploadRequest {
+	return r
+}
+
+// decodeUploadBody reads a JSON object from body into req, streaming its
+// "image" field into a temp file. Every other field is bound as
+// json.Unmarshal would.
+func decodeUploadBody(body io.Reader, req interface{ upload() *UploadRequest }) error {
+	upload := req.upload()
+	r := bufio.NewReader(body)
+	fields := map[string]json.RawMessage{}
+	err := func() error {
+		if err := expectByte(r, '{'); err != nil {
+			return err
+		}
+		if b, err := peekByte(r); err != nil {
+			return err
+		} else if b == '}' {
+			r.ReadByte()
+			return nil
+		}
+		for {
+			raw, err := readJSONValue(r)
+			if err != nil {
+				return err
+			}
+			var key string
+			if err := json.Unmarshal(raw, &key); err != nil {
+				return err
+			}
+			if err := expectByte(r, ':'); err != nil {
+				return err
+			}
+			if strings.EqualFold(key, "image") {
+				upload.discardImage()
+				upload.Image = nil
+				if upload.Image, err = readUploadImage(r); err != nil {
+					return err
+				}
+			} else if fields[key], err = readJSONValue(r); err != nil {
+				return err
+			}
+			if err := skipSpace(r); err != nil {
+				return err
+			}
+			switch b, _ := r.ReadByte(); b {
+			case ',':
+				continue
+			case '}':
+				return nil
+			default:
+				return fmt.Errorf("invalid character %q after object value", b)
+			}
+		}
+	}()
+	if err == nil {
+		var rest []byte
+		if rest, err = json.Marshal(fields); err == nil {
+			err = json.Unmarshal(rest, req)
+		}
+	}
+	if err != nil {
+		upload.discardImage()
+		upload.Image = nil
+	}
+	return err
+}
+
+// readUploadImage reads the image value: a string decoded into a temp file,
+// or nil for null and "". A string that isn't a valid data URL is read to
+// its end anyway and comes back with err set.
+func readUploadImage(r *bufio.Reader) (*uploadImage, error) {
+	if err := skipSpace(r); err != nil {
+		return nil, err
+	}
+	b, err := peekByte(r)
+	if err != nil {
+		return nil, err
+	}
+	if b != '"' {
+		raw, err := readJSONValue(r)
+		if err != nil || !bytes.Equal(raw, []byte("null")) {
+			return nil, errors.Join(err, errors.New("image must be a string"))
+		}
+		return nil, nil
+	}
+	r.ReadByte()
+	s := &jsonStringReader{r: r}
+	if b, err := r.Peek(1); err == nil && b[0] == '"' {
+		r.ReadByte()
+		return nil, nil
+	}
+
+	tmp, err := os.CreateTemp("", "avatar-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	img := &uploadImage{file: tmp}
+	img.header, img.size, img.err = decodeDataURL(tmp, s)
+	if s.err != nil {
+		closeTemp(tmp)
+		return nil, s.err
+	}
+	if img.err != nil {
+		// the rest of the string still has to be read past
+		if _, err := io.Copy(io.Discard, s); err != nil {
+			closeTemp(tmp)
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// decodeDataURL splits the "data:<mime>;base64" header off src and decodes
+// the base64 payload after it into dst. Bare base64 without a header is
+// accepted too, in the standard or URL-safe alphabet, padded or not.
+func decodeDataURL(dst io.Writer, src io.Reader) (string, int64, error) {
+	br := bufio.NewReaderSize(src, 512)
+	var header string
+	if prefix, _ := br.Peek(5); string(prefix) == "data:" {
+		h, err := br.ReadSlice(',')
+		if err != nil {
+			return "", 0, errInvalidImageFormat
+		}
+		header = string(h[:len(h)-1])
+	}
+	size, err := io.Copy(dst, base64.NewDecoder(base64.RawStdEncoding, base64Alphabet{br}))
+	if err == nil && size == 0 {
+		err = errInvalidImageFormat
+	}
+	return header, size, err
+}
+
+// base64Alphabet maps the URL-safe alphabet onto the standard one and drops
+// padding, which RawStdEncoding would reject. A comma means more than one
+// data URL header and is rejected.
+type base64Alphabet struct{ r io.Reader }
+
+func (a base64Alphabet) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	out := p[:0]
+	for _, b := range p[:n] {
+		switch b {
+		case '-':
+			b = '+'
+		case '_':
+			b = '/'
+		case '=', ' ':
+			continue
+		case ',':
+			return 0, errInvalidImageFormat
+		}
+		out = append(out, b)
+	}
+	return len(out), err
+}
+
+// jsonStringReader reads the unescaped contents of a JSON string whose
+// opening quote has been consumed, returning io.EOF at the closing quote.
+// Errors from the underlying reader, including a malformed string, are kept
+// in err so callers can tell them from errors in the contents.
+type jsonStringReader struct {
+	r    *bufio.Reader
+	done bool
+	err  error
+}
+
+func (s *jsonStringReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n := 0
+	for n < len(p) && !s.done {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			s.err = noEOF(err)
+			break
+		}
+		switch {
+		case b == '"':
+			s.done = true
+		case b < 0x20:
+			s.err = errors.New("invalid control character in string")
+		case b == '\\':
+			b, s.err = s.unescape()
+			p[n] = b
+			n++
+		default:
+			p[n] = b
+			n++
+		}
+		if s.err != nil {
+			break
+		}
+	}
+	if s.err != nil {
+		return n, s.err
+	}
+	if s.done && n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// unescape reads the rest of an escape sequence. Escapes outside ASCII
+// can't be part of a data URL, so they come back as 0xff, which the base64
+// decoder then rejects.
+func (s *jsonStringReader) unescape() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	switch b {
+	case '"', '\\', '/':
+		return b, nil
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'u':
+		var hex [4]byte
+		if _, err := io.ReadFull(s.r, hex[:]); err != nil {
+			return 0, noEOF(err)
+		}
+		v, err := strconv.ParseUint(string(hex[:]), 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid escape \\u%s", hex[:])
+		}
+		if v >= 0x80 {
+			return 0xff, nil
+		}
+		return byte(v), nil
+	}
+	return 0, fmt.Errorf("invalid escape \\%c", b)
+}
+
+// readJSONValue returns the raw bytes of the next JSON value, after any
+// leading whitespace. Scalars and nesting are only delimited here;
+// json.Unmarshal validates them later.
+func readJSONValue(r *bufio.Reader) (json.RawMessage, error) {
+	if err := skipSpace(r); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	depth := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		switch b {
+		case '"':
+			buf.WriteByte(b)
+			if err := copyJSONString(&buf, r); err != nil {
+				return nil, err
+			}
+		case '{', '[':
+			depth++
+			buf.WriteByte(b)
+		case '}', ']':
+			if depth == 0 {
+				r.UnreadByte()
+				return buf.Bytes(), nil
+			}
+			depth--
+			buf.WriteByte(b)
+		case ',', ' ', '\t', '\r', '\n':
+			if depth == 0 {
+				r.UnreadByte()
+				return buf.Bytes(), nil
+			}
+			buf.WriteByte(b)
+		default:
+			buf.WriteByte(b)
+		}
+		if depth == 0 && buf.Len() > 0 && (b == '"' || b == '}' || b == ']') {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// copyJSONString copies the rest of a string, through its closing quote.
+func copyJSONString(buf *bytes.Buffer, r *bufio.Reader) error {
+	escaped := false
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		buf.WriteByte(b)
+		switch {
+		case escaped:
+			escaped = false
+		case b == '\\':
+			escaped = true
+		case b == '"':
+			return nil
+		}
+	}
+}
+
+func skipSpace(r *bufio.Reader) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return r.UnreadByte()
+		}
+	}
+}
+
+func peekByte(r *bufio.Reader) (byte, error) {
+	if err := skipSpace(r); err != nil {
+		return 0, err
+	}
+	b, err := r.Peek(1)
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	return b[0], nil
+}
+
+func expectByte(r *bufio.Reader, want byte) error {
+	if err := skipSpace(r); err != nil {
+		return err
+	}
+	b, _ := r.ReadByte()
+	if b != want {
+		return fmt.Errorf("expected %q, found %q", want, b)
+	}
+	return nil
+}
+
+// noEOF turns an EOF in the middle of a value into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecodeUploadBody(t *testing.T) {
+	data := []byte("\x89PNG\r\n\x1a\n some image bytes ~~~ ???")
+	std := base64.StdEncoding.EncodeToString(data)
+	url := base64.RawURLEncoding.EncodeToString(data)
+
+	tests := []struct {
+		name, body string
+		header     string
+		wantImage  bool
+		wantErr    error // of the image, not the body
+	}{
+		{"data url", `{"image":"data:image/png;base64,` + std + `","token":"t"}`, "data:image/png;base64", true, nil},
+		{"token first", `{"token":"t", "image" : "` + std + `"}`, "", true, nil},
+		{"url alphabet", `{"image":"` + url + `","token":"t"}`, "", true, nil},
+		{"escaped slashes", `{"image":"` + strings.ReplaceAll(std, "/", `\/`) + `","token":"t"}`, "", true, nil},
+		{"line breaks", `{"image":"` + std[:8] + `\r\n` + std[8:] + `","token":"t"}`, "", true, nil},
+		{"null", `{"image":null,"token":"t"}`, "", false, nil},
+		{"empty", `{"image":"","token":"t"}`, "", false, nil},
+		{"absent", `{"token":"t","alt":"hi"}`, "", false, nil},
+		{"header only", `{"image":"data:image/png;base64,","token":"t"}`, "", true, errInvalidImageFormat},
+		{"two headers", `{"image":"data:a,data:b,` + std + `","token":"t"}`, "", true, errInvalidImageFormat},
+		{"not base64", `{"image":"@@@@","token":"t"}`, "", true, base64.CorruptInputError(0)},
+		{"non-ascii escape", `{"image":"éAAA","token":"t"}`, "", true, base64.CorruptInputError(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req UploadRequest
+			if err := decodeUploadBody(strings.NewReader(tt.body), &req); err != nil {
+				t.Fatalf("decodeUploadBody: %v", err)
+			}
+			defer req.discardImage()
+			if req.Token != "t" {
+				t.Errorf("Token = %q", req.Token)
+			}
+			if (req.Image != nil) != tt.wantImage {
+				t.Fatalf("Image = %v, want present %v", req.Image, tt.wantImage)
+			}
+			if req.Image == nil {
+				return
+			}
+			if tt.wantErr != nil {
+				if req.Image.err == nil || errors.Is(tt.wantErr, errInvalidImageFormat) && !errors.Is(req.Image.err, errInvalidImageFormat) {
+					t.Fatalf("err = %v, want %v", req.Image.err, tt.wantErr)
+				}
+				return
+			}
+			header, f, size, err := req.Image.open()
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			got, _ := io.ReadAll(f)
+			if string(got) != string(data) || size != int64(len(data)) {
+				t.Errorf("decoded %q (%d bytes), want %q", got, size, data)
+			}
+			want := tt.header
+			if want == "" {
+				want = "data:image/png;base64"
+			}
+			if header != want {
+				t.Errorf("header = %q, want %q", header, want)
+			}
+		})
+	}
+}
+
+func TestDecodeUploadBodyFields(t *testing.T) {
+	var req ValidateRequest
+	body := `{"kind":"banner","image":"` + base64.StdEncoding.EncodeToString([]byte("GIF89a")) + `","focus":[0.25,0.5],"slot":"2","alt":"a \"b\""}`
+	if err := decodeUploadBody(strings.NewReader(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	defer req.discardImage()
+	if req.Kind != "banner" || req.Slot != "2" || req.Alt == nil || *req.Alt != `a "b"` || req.Focus == nil || req.Image == nil {
+		t.Errorf("bound %+v", req)
+	}
+}
+
+func TestDecodeUploadBodyRejects(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"image":"AAAA"`,
+		`{"image":"AAAA`,
+		`{"image":12}`,
+		`{"image":"AA\qA"}`,
+		`{"token":"t" "alt":"x"}`,
+		`{"token":1}`,
+		`{token:"t"}`,
+		`{"image":"AAAA",}`,
+	} {
+		var req UploadRequest
+		if err := decodeUploadBody(strings.NewReader(body), &req); err == nil {
+			t.Errorf("%s: accepted", body)
+		}
+		if req.Image != nil {
+			t.Errorf("%s: image left behind", body)
+		}
+	}
+}
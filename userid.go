@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserID returns the user's immutable rotur ID as a decimal string, or ""
+// when the provider doesn't supply one. JSON numbers decode as float64, so
+// they are formatted without an exponent.
+func (u User) UserID() string {
+	switch id := u.ID.(type) {
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	case string:
+		return id
+	default:
+		return ""
+	}
+}
+
+func findUserByID(uid string) (*User, error) {
+	return findUser(func(u User) bool { return u.UserID() == uid })
+}
+
+// avatarByIDHandler serves GET /.id/:uid, the avatar of whoever currently
+// holds the ID, so links made from the ID survive renames. The response is
+// the avatar itself rather than a redirect to the username, which a cache
+// would keep serving after a rename.
+func avatarByIDHandler(c *gin.Context) {
+	uid, gifSuffix := strings.CutSuffix(c.Param("uid"), ".gif")
+	if _, err := strconv.ParseUint(uid, 10, 64); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID must be numeric"})
+		return
+	}
+	user, err := findUserByID(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading users file"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown user ID"})
+		return
+	}
+
+	username := strings.ToLower(user.Username)
+	if gifSuffix {
+		username += ".gif"
+	}
+	c.Params = append(c.Params, gin.Param{Key: "username", Value: username})
+	avatarHandler(c)
+}
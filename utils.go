@@ -10,12 +10,11 @@ import (
 	"image/color/palette"
 	"image/draw"
 	"image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -26,63 +25,7 @@ import (
 	"github.com/logica0419/resigif"
 )
 
-func roundCorners(imageData []byte, radius int) ([]byte, string, error) {
-	cacheKey := fmt.Sprintf("%x-%d", md5.Sum(imageData), radius)
-
-	cacheMutex.RLock()
-	if cached, exists := roundedCache[cacheKey]; exists {
-		if time.Since(cached.Timestamp) < time.Duration(cacheTimeout)*time.Second {
-			cacheMutex.RUnlock()
-			return cached.Data, cached.ContentType, nil
-		}
-	}
-	cacheMutex.RUnlock()
-
-	img, _, err := image.Decode(bytes.NewReader(imageData))
-	if err != nil {
-		return imageData, "image/jpeg", err
-	}
-
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	if radius > height/2 {
-		radius = height / 2
-	}
-
-	result := image.NewRGBA(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			if isPixelInRoundedRect(x-bounds.Min.X, y-bounds.Min.Y, width, height, radius) {
-				result.Set(x, y, img.At(x, y))
-			} else {
-				result.Set(x, y, color.RGBA{0, 0, 0, 0})
-			}
-		}
-	}
-
-	var buf bytes.Buffer
-	err = png.Encode(&buf, result)
-	if err != nil {
-		return imageData, "image/jpeg", err
-	}
-
-	resultData := buf.Bytes()
-
-	cacheMutex.Lock()
-	roundedCache[cacheKey] = CachedImage{
-		Data:        resultData,
-		ContentType: "image/png",
-		Timestamp:   time.Now(),
-	}
-	cacheMutex.Unlock()
-
-	return resultData, "image/png", nil
-}
-
-func roundGIF(src *gif.GIF, radius int) (*gif.GIF, error) {
+func roundGIF(ctx context.Context, src *gif.GIF, r Radius) (*gif.GIF, error) {
 	if len(src.Image) == 0 {
 		return nil, fmt.Errorf("no frames in GIF")
 	}
@@ -90,14 +33,8 @@ func roundGIF(src *gif.GIF, radius int) (*gif.GIF, error) {
 	bounds := image.Rect(0, 0, src.Config.Width, src.Config.Height)
 	width, height := bounds.Dx(), bounds.Dy()
 
-	if radius > width/2 {
-		radius = width / 2
-	}
-	if radius > height/2 {
-		radius = height / 2
-	}
-
-	if radius <= 0 {
+	mask := newRoundedMask(width, height, r)
+	if mask.Empty() {
 		return src, nil // No rounding
 	}
 
@@ -138,6 +75,8 @@ func roundGIF(src *gif.GIF, radius int) (*gif.GIF, error) {
 		draw.Draw(inputRGBA, bounds, compositor, image.Point{}, draw.Src)
 
 		// Quantize to paletted with dithering
+		_, quantize := startSpan(ctx, "quantize")
+		quantize.SetAttr("frame", i)
 		paletted := image.NewPaletted(bounds, palette.WebSafe)
 		ditherer := colorquant.Dither{
 			Filter: [][]float32{
@@ -175,12 +114,13 @@ func roundGIF(src *gif.GIF, radius int) (*gif.GIF, error) {
 			}
 			outputRGBA = toRGBA(paletted)
 		}
+		quantize.End()
 
 		pix := outputRGBA.Pix
 		stride := outputRGBA.Stride
 		for y := 0; y < height; y++ {
 			for x := 0; x < width; x++ {
-				if !isPixelInRoundedRect(x, y, width, height, radius) {
+				if !mask.Contains(x, y) {
 					pix[(y*stride+x*4)+3] = 0
 				}
 			}
@@ -265,38 +205,19 @@ func uniqueColors(img image.Image, limit int) (int, bool) {
 	return len(seen), true // safe to skip quantization
 }
 
-func isPixelInRoundedRect(x, y, width, height, radius int) bool {
-	corners := []struct{ cx, cy int }{
-		{radius, radius},                          // top-left
-		{width - radius - 1, radius},              // top-right
-		{radius, height - radius - 1},             // bottom-left
-		{width - radius - 1, height - radius - 1}, // bottom-right
-	}
-
-	switch {
-	case x < radius && y < radius:
-		dx, dy := x-corners[0].cx, y-corners[0].cy
-		return dx*dx+dy*dy <= radius*radius
-	case x >= width-radius && y < radius:
-		dx, dy := x-corners[1].cx, y-corners[1].cy
-		return dx*dx+dy*dy <= radius*radius
-	case x < radius && y >= height-radius:
-		dx, dy := x-corners[2].cx, y-corners[2].cy
-		return dx*dx+dy*dy <= radius*radius
-	case x >= width-radius && y >= height-radius:
-		dx, dy := x-corners[3].cx, y-corners[3].cy
-		return dx*dx+dy*dy <= radius*radius
-	default:
-		return true
-	}
+func resizeGIF(data []byte, width, height int) ([]byte, error) {
+	return resizeGIFReader(bytes.NewReader(data), width, height)
 }
 
-func resizeGIF(data []byte, width, height int) ([]byte, error) {
-	src, err := gif.DecodeAll(bytes.NewReader(data))
+func resizeGIFReader(r io.Reader, width, height int) ([]byte, error) {
+	src, err := gif.DecodeAll(r)
 	if err != nil {
 		return nil, err
 	}
+	return resizeDecodedGIF(src, width, height)
+}
 
+func resizeDecodedGIF(src *gif.GIF, width, height int) ([]byte, error) {
 	ctx := context.Background()
 
 	dstImg, err := resigif.Resize(ctx, src, width, height, resigif.WithAspectRatio(resigif.Ignore))
@@ -335,17 +256,10 @@ func loadDefaultImage() {
 }
 
 func createFallbackImage() {
-	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
-	for y := 0; y < 256; y++ {
-		for x := 0; x < 256; x++ {
-			img.Set(x, y, color.RGBA{R: 200, G: 200, B: 200, A: 255})
-		}
-	}
-
-	var buf bytes.Buffer
-	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
-	defaultImageContent = buf.Bytes()
-	defaultImageEtag = fmt.Sprintf("%x", md5.Sum(defaultImageContent))
+	fallback := fallbackAsset("avatar", themeLight)
+	defaultImageContent = fallback.Data
+	defaultImageEtag = fallback.Etag
+	defaultIsFallback = true
 }
 
 func enableCORS() gin.HandlerFunc {
@@ -416,6 +330,103 @@ func loadEnvFile() {
 	}
 	// Reload config variables after populating environment
 	ADMIN_TOKEN = mustEnv("ADMIN_TOKEN", "")
+	if ADMIN_TOKEN == "" {
+		log.Printf("[config] ADMIN_TOKEN is not set; admin endpoints will refuse every request")
+	}
+	otlpEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	serviceName = mustEnv("OTEL_SERVICE_NAME", "avatars")
+	asyncTransforms = mustEnv("ASYNC_TRANSFORMS", "false") == "true"
+	presetOnly = mustEnv("PRESET_ONLY", "false") == "true"
+	if mustEnv("STORAGE_SHARDING", "false") == "true" {
+		storageLayout = layoutSharded
+	}
+	documentPath = mustEnv("AVATARS_DATA_DIR", documentPath)
+	storageLayout = mustEnv("STORAGE_LAYOUT", storageLayout)
+	avatarCache.configure("AVATAR")
+	bannerCache.configure("BANNER")
+	strictTransforms = mustEnv("STRICT_TRANSFORMS", "false") == "true"
+	canonicalRedirects = mustEnv("CANONICAL_REDIRECTS", "false") == "true"
+	debugHeaders = mustEnv("DEBUG_HEADERS", "false") == "true"
+	errorPlaceholders = mustEnv("ERROR_PLACEHOLDERS", "false") == "true"
+	accessLogPath = os.Getenv("ACCESS_LOG")
+	originURL = os.Getenv("ORIGIN_URL")
+	if n, err := strconv.Atoi(os.Getenv("ORIGIN_PULLS_PER_MINUTE")); err == nil && n >= 0 {
+		originPullLimit = n
+	}
+	switch backend := mustEnv("STORAGE_BACKEND", "local"); backend {
+	case "local":
+	case "s3":
+		store, err := newS3Store()
+		if err != nil {
+			// serving from local disk alone would lose uploads on restart
+			log.Fatalf("[storage] STORAGE_BACKEND=s3: %v", err)
+		}
+		assetBackend = store
+	default:
+		log.Printf("[storage] ignoring unknown STORAGE_BACKEND %q", backend)
+	}
+	webhookURL = os.Getenv("WEBHOOK_URL")
+	cachePeers = parsePeers(os.Getenv("CACHE_PEERS"))
+	replicaURL = os.Getenv("REPLICA_URL")
+	replicaToken = os.Getenv("REPLICA_TOKEN")
+	if n, err := strconv.Atoi(os.Getenv("REPLICATION_INTERVAL")); err == nil && n > 0 {
+		replicationInterval = time.Duration(n) * time.Second
+	}
+	configurePublicURL(os.Getenv("PUBLIC_BASE_URL"))
+	configureTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	diskCacheDir = os.Getenv("DISK_CACHE_DIR")
+	diskCacheCompression = mustEnv("DISK_CACHE_COMPRESSION", "gzip")
+	if n, err := strconv.Atoi(os.Getenv("CACHE_JANITOR_INTERVAL")); err == nil {
+		cacheJanitorInterval = time.Duration(n) * time.Second
+	}
+	if n, err := strconv.Atoi(os.Getenv("PREWARM_TOP_N")); err == nil && n >= 0 {
+		prewarmTopN = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PREWARM_JITTER")); err == nil && n >= 0 {
+		prewarmJitter = time.Duration(n) * time.Second
+	}
+	if n, err := strconv.Atoi(os.Getenv("INTEGRITY_CYCLE_DAYS")); err == nil {
+		integrityCycleDays = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("BANNER_SLOTS")); err == nil && n >= 0 {
+		maxBannerSlots = n
+	}
+	if n, err := strconv.ParseInt(os.Getenv("MAX_CACHE_ENTRY_BYTES"), 10, 64); err == nil && n > 0 {
+		maxCacheEntryBytes = n
+	}
+	if dir := os.Getenv("DUAL_WRITE_DIR"); dir != "" {
+		secondaryStore = dirStore{root: dir, layout: mustEnv("DUAL_WRITE_LAYOUT", layoutUser)}
+	}
+	accessLogFormat = mustEnv("ACCESS_LOG_FORMAT", "combined")
+	logFormat = mustEnv("LOG_FORMAT", "json")
+	auditRecordIP = mustEnv("AUDIT_RECORD_IP", "true") == "true"
+	auditRecordUserAgent = mustEnv("AUDIT_RECORD_USER_AGENT", "false") == "true"
+	if n, err := strconv.Atoi(os.Getenv("AUDIT_CLIENT_RETENTION_DAYS")); err == nil && n > 0 {
+		auditClientRetention = time.Duration(n) * 24 * time.Hour
+	}
+	if v := os.Getenv("UPLOAD_LIMITS"); v != "" {
+		limits, err := parseTierLimits(v)
+		if err != nil || len(limits) == 0 {
+			log.Printf("[upload] ignoring UPLOAD_LIMITS: %v", err)
+		} else {
+			configureUploadLimits(limits)
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv("AVATAR_HISTORY")); err == nil && n >= 0 {
+		avatarHistory = n
+	}
+	switch v := mustEnv("ACCEPT_NEGOTIATION", negotiateOff); v {
+	case negotiateOff, negotiateFallback, negotiateStrict:
+		acceptNegotiation = v
+	default:
+		log.Printf("[config] ignoring ACCEPT_NEGOTIATION=%q, expected off, fallback or strict", v)
+	}
+	selfServeUploads = mustEnv("SELF_SERVE_UPLOADS", "true") == "true"
+	uploadTypes = parseUploadTypes(mustEnv("UPLOAD_TYPES", "jpeg,png,gif"))
+	configureProcessing()
+	configureLoadShedding()
+	configureCacheTTLs()
+	presetSizes = parsePresetSizes(mustEnv("PRESET_SIZES", "64,128,256"))
 }
 
 func getStringOrDefault(val any, defaultVal string) string {
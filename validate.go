@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ValidateRequest struct {
+	UploadRequest
+	Kind string `json:"kind"`
+}
+
+// validateUploadHandler runs the cheap checks of an upload (token, tier,
+// size, dimensions, frames) and reports what storing it would do, without
+// resizing or writing anything. Problems are listed under "errors" with a
+// 200 status; only malformed requests fail outright.
+func validateUploadHandler(c *gin.Context) {
+	var req ValidateRequest
+	if !bindUploadJSON(c, &req) {
+		return
+	}
+	defer req.discardImage()
+	if req.Kind == "" {
+		req.Kind = "avatar"
+	}
+	if req.Kind != "avatar" && req.Kind != "banner" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be avatar or banner"})
+		return
+	}
+
+	user, err := findUserByToken(req.Token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading users file"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid token"})
+		return
+	}
+	username := strings.ToLower(user.Username)
+	tier := strings.ToLower(user.GetSubscription())
+
+	errs := []string{}
+	resp := gin.H{"kind": req.Kind, "tier": tier}
+
+	if !uploadsEnabled(*user, req.Kind) {
+		errs = append(errs, uploadDisabledCode(req.Kind))
+	}
+
+	if req.Kind == "banner" {
+		slot, err := parseBannerSlot(req.Slot)
+		if err == nil {
+			err = checkBannerSlot(username, tier, slot)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if req.Alt != nil {
+		if _, err := normalizeAltText(*req.Alt); err != nil {
+			errs = append(errs, fmt.Sprintf("alt text must be at most %d characters", maxAltTextLength))
+		}
+	}
+	if req.Image == nil {
+		errs = append(errs, "missing image")
+		resp["valid"] = false
+		resp["errors"] = errs
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	if limit := uploadLimit(*user); req.Image.size > limit {
+		errs = append(errs, fmt.Sprintf("image size exceeds your %s limit", formatUploadLimit(limit)))
+		resp["valid"] = false
+		resp["errors"] = errs
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	mimeHeader, upload, size, err := req.Image.open()
+	if errors.Is(err, errUnsupportedType) {
+		errs = append(errs, "unsupported image type, accepted types are "+strings.Join(uploadTypes, ", "))
+		resp["valid"] = false
+		resp["errors"] = errs
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	if err != nil {
+		errs = append(errs, "invalid image data")
+		resp["valid"] = false
+		resp["errors"] = errs
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	resp["size"] = size
+
+	cfg, format, err := image.DecodeConfig(upload)
+	if err != nil {
+		errs = append(errs, "error decoding image")
+	} else {
+		resp["format"] = format
+		resp["width"], resp["height"] = cfg.Width, cfg.Height
+		if !checkSourceDimensions(cfg) {
+			errs = append(errs, "image dimensions too large")
+		}
+	}
+
+	frames := 1
+	if format == "gif" && err == nil {
+		if _, err := upload.Seek(0, io.SeekStart); err == nil {
+			if g, err := gif.DecodeAll(upload); err == nil {
+				frames = len(g.Image)
+			} else {
+				errs = append(errs, "error decoding gif")
+			}
+		}
+	}
+	resp["frames"] = frames
+
+	animatedTiers := animatedAvatarTiers
+	if req.Kind == "banner" {
+		animatedTiers = animatedBannerTiers
+	}
+	dims := assetDimensions[req.Kind]
+	output := gin.H{"format": "jpg", "width": dims[0], "height": dims[1]}
+	downgraded := false
+	if strings.Contains(mimeHeader, "image/gif") {
+		if slices.Contains(animatedTiers, tier) {
+			output["format"] = "gif"
+		} else {
+			downgraded = true
+		}
+	}
+	resp["output"] = output
+	resp["downgraded"] = downgraded
+	if downgraded {
+		resp["reason"] = "tier"
+	}
+
+	resp["valid"] = len(errs) == 0
+	resp["errors"] = errs
+	c.JSON(http.StatusOK, resp)
+}
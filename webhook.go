@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Event is posted to WEBHOOK_URL for things users should be told about but
+// that do not fail the request, such as a tier downgrade on upload.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Asset    string    `json:"asset"`
+	Username string    `json:"username"`
+	Reason   string    `json:"reason,omitempty"`
+	Tier     string    `json:"tier,omitempty"`
+}
+
+var (
+	webhookURL    string
+	webhookClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// emitEvent delivers the event in the background; failures are only logged.
+func emitEvent(event Event) {
+	if webhookURL == "" {
+		return
+	}
+	event.Time = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[webhook] failed to encode %s event: %v", event.Type, err)
+		return
+	}
+
+	go func() {
+		if err := postEvent(body); err != nil {
+			log.Printf("[webhook] failed to deliver %s event for %s: %v", event.Type, event.Username, err)
+		}
+	}()
+}
+
+func postEvent(body []byte) error {
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}